@@ -0,0 +1,502 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// the admin API is served under /admin-api/v1/. every request needs an Authorization: Bearer header with a token
+// created on the admin tokens page. path elements are URL-escaped, so ban ids like ip:10.0.0.0/8 become ip:10.0.0.0%2F8.
+
+const auditActionCommentRestore = "comment.restore"
+const auditActionSubscriptionRemove = "subscription.remove"
+
+const adminAPIVersion = "v1"
+
+type apiDocument struct {
+	CommentedDocument
+	State    string `json:"state"`
+	Comments int    `json:"comments"`
+}
+
+// apiSubscription is everyone who gets emailed about replies to their comments
+type apiSubscription struct {
+	Email          string   `json:"email"`
+	Documents      []string `json:"documents"`
+	Unsubscribed   bool     `json:"unsubscribed,omitempty"`
+	MutedDocuments []string `json:"mutedDocuments,omitempty"`
+}
+
+type apiError struct {
+	status  int
+	message string
+}
+
+func (err *apiError) Error() string {
+	return err.message
+}
+
+func newAPIError(status int, format string, args ...interface{}) error {
+	return &apiError{status: status, message: fmt.Sprintf(format, args...)}
+}
+
+func adminAPI(responseWriter http.ResponseWriter, request *http.Request) {
+	ipAddress := getClientIP(request)
+	if wait := checkLoginLockout(ipAddress, ""); wait > 0 {
+		responseWriter.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeAPIError(responseWriter, newAPIError(429, "too many failed attempts, try again in %s", wait.Round(time.Second)))
+		return
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer "))
+	apiToken, err := authenticateAPIToken(token)
+	if err != nil {
+		writeAPIError(responseWriter, err)
+		return
+	}
+	if apiToken == nil {
+		log.Printf("admin api auth fail from %s: bearer token '%.9s...'\n", ipAddress, token)
+		recordLoginFailure(defaultSite, ipAddress, "")
+		responseWriter.Header().Set("WWW-Authenticate", "Bearer realm=\"comments admin api\"")
+		writeAPIError(responseWriter, newAPIError(401, "a valid bearer token is required"))
+		return
+	}
+	recordLoginSuccess(ipAddress, "")
+	request = withAdminName(request, fmt.Sprintf("api token %s", apiToken.Name))
+
+	prefix := fmt.Sprintf("%s/admin-api/%s/", commentsBasePath, adminAPIVersion)
+	if !strings.HasPrefix(request.URL.EscapedPath(), prefix) {
+		writeAPIError(responseWriter, newAPIError(404, "unknown API version, the current version is %s", adminAPIVersion))
+		return
+	}
+	path := []string{}
+	for _, element := range splitNonEmpty(strings.TrimPrefix(request.URL.EscapedPath(), prefix), "/") {
+		unescaped, err := url.PathUnescape(element)
+		if err != nil {
+			writeAPIError(responseWriter, newAPIError(400, "malformed path element '%s'", element))
+			return
+		}
+		path = append(path, unescaped)
+	}
+
+	var result interface{}
+	route := request.Method
+	if len(path) > 0 {
+		route = fmt.Sprintf("%s %s", request.Method, path[0])
+	}
+	switch {
+	case route == "GET documents" && len(path) == 1:
+		result, err = apiListDocuments()
+	case route == "GET documents" && len(path) == 3 && path[2] == "comments":
+		result, err = apiListComments(&commentFilter{}, path[1])
+	case route == "GET comments" && len(path) == 1:
+		query := request.URL.Query()
+		result, err = apiListComments(&commentFilter{
+			AvatarHash: query.Get("avatarHash"),
+			Username:   query.Get("username"),
+			Email:      query.Get("email"),
+			From:       query.Get("from"),
+			To:         query.Get("to"),
+		}, "")
+	case route == "GET comments" && len(path) == 2 && path[1] == "deleted":
+		result, err = apiListDeletedComments()
+	case route == "GET comments" && len(path) == 3:
+		result, err = apiGetComment(path[1], path[2])
+	case route == "PATCH comments" && len(path) == 3:
+		result, err = apiEditComment(request, path[1], path[2])
+	case route == "GET comments" && len(path) == 4 && path[3] == "edits":
+		result, err = apiGetCommentEdits(path[1], path[2])
+	case route == "DELETE comments" && len(path) == 3:
+		result, err = apiModerateComment(request, path[1], path[2], moderationActionDelete)
+	case route == "POST comments" && len(path) == 4:
+		result, err = apiModerateComment(request, path[1], path[2], path[3])
+	case route == "GET bans" && len(path) == 1:
+		result, err = apiListBans()
+	case route == "POST bans" && len(path) == 1:
+		result, err = apiAddBan(request)
+	case route == "DELETE bans" && len(path) == 2:
+		result, err = apiRemoveBan(request, path[1])
+	case route == "GET subscriptions" && len(path) == 1:
+		result, err = apiListSubscriptions()
+	case route == "DELETE subscriptions" && len(path) == 2:
+		result, err = apiRemoveSubscription(request, path[1])
+	default:
+		err = newAPIError(404, "%s %s not found", request.Method, request.URL.Path)
+	}
+	if err != nil {
+		writeAPIError(responseWriter, err)
+		return
+	}
+
+	responseBytes, err := json.Marshal(result)
+	if err != nil {
+		writeAPIError(responseWriter, err)
+		return
+	}
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.Write(responseBytes)
+}
+
+func writeAPIError(responseWriter http.ResponseWriter, err error) {
+	status := 500
+	message := "internal server error"
+	if apiErr, ok := err.(*apiError); ok {
+		status = apiErr.status
+		message = apiErr.message
+	} else if err == errCommentNotFound || err == errBucketNotFound {
+		status = 404
+		message = err.Error()
+	} else {
+		log.Printf("admin api request failed: %v\n", err)
+	}
+	responseBytes, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{
+		Error: message,
+	})
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.WriteHeader(status)
+	responseWriter.Write(responseBytes)
+}
+
+func parseAPICommentDate(date string) (int64, error) {
+	dateInt, err := strconv.ParseInt(date, 10, 64)
+	if err != nil {
+		return 0, newAPIError(400, "'%s' is not a valid comment date", date)
+	}
+	return dateInt, nil
+}
+
+func apiListDocuments() ([]apiDocument, error) {
+	documents := []apiDocument{}
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("posts_index"))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var document apiDocument
+			err := json.Unmarshal(v, &document.CommentedDocument)
+			if err != nil {
+				return err
+			}
+			document.State, err = getDocumentState(tx, document.DocumentID)
+			if err != nil {
+				return err
+			}
+			if postBucket := tx.Bucket([]byte(fmt.Sprintf("posts/%s", document.DocumentID))); postBucket != nil {
+				document.Comments = postBucket.Stats().KeyN
+			}
+			documents = append(documents, document)
+			return nil
+		})
+	})
+	return documents, err
+}
+
+// apiListComments returns the matching comments oldest first, including the private fields
+func apiListComments(filter *commentFilter, postID string) ([]Comment, error) {
+	_, _, err := filter.dateRange()
+	if err != nil {
+		return nil, newAPIError(400, "%s", err.Error())
+	}
+	comments := []Comment{}
+	err = db.View(func(tx *bolt.Tx) error {
+		if postID != "" && tx.Bucket([]byte(fmt.Sprintf("posts/%s", postID))) == nil {
+			return errBucketNotFound
+		}
+		found, err := findComments(tx, filter)
+		for _, comment := range found {
+			if postID == "" || comment.DocumentID == postID {
+				comments = append(comments, comment)
+			}
+		}
+		return err
+	})
+	sort.Slice(comments, func(i, j int) bool {
+		return comments[i].Date < comments[j].Date
+	})
+	return comments, err
+}
+
+func apiListDeletedComments() ([]DeletedComment, error) {
+	var deletedComments []DeletedComment
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		deletedComments, err = getDeletedComments(tx)
+		return err
+	})
+	sort.Slice(deletedComments, func(i, j int) bool {
+		return deletedComments[i].Deleted > deletedComments[j].Deleted
+	})
+	return deletedComments, err
+}
+
+func apiGetComment(postID, date string) (*Comment, error) {
+	dateInt, err := parseAPICommentDate(date)
+	if err != nil {
+		return nil, err
+	}
+	var comment *Comment
+	err = db.View(func(tx *bolt.Tx) error {
+		comment, err = getComment(tx, postID, dateInt)
+		return err
+	})
+	return comment, err
+}
+
+// apiEditComment takes a JSON object with the optional fields username, body and redact, and returns the edited comment
+func apiEditComment(request *http.Request, postID, date string) (*Comment, error) {
+	dateInt, err := parseAPICommentDate(date)
+	if err != nil {
+		return nil, err
+	}
+	var edit struct {
+		Username *string `json:"username"`
+		Body     *string `json:"body"`
+		Redact   string  `json:"redact"`
+	}
+	err = json.NewDecoder(request.Body).Decode(&edit)
+	if err != nil {
+		return nil, newAPIError(400, "can't parse the request body as an edit: %v", err)
+	}
+	var before, edited *Comment
+	err = db.Update(func(tx *bolt.Tx) error {
+		comment, err := getComment(tx, postID, dateInt)
+		if err != nil {
+			return err
+		}
+		if edit.Username == nil {
+			edit.Username = &comment.Username
+		}
+		if edit.Body == nil {
+			edit.Body = &comment.Body
+		}
+		before, err = editComment(tx, request, postID, dateInt, *edit.Username, *edit.Body, edit.Redact)
+		if err != nil {
+			return err
+		}
+		edited, err = getComment(tx, postID, dateInt)
+		return err
+	})
+	if err == errEmptyEdit {
+		return nil, newAPIError(400, "%s", err.Error())
+	}
+	if err == nil && before != nil {
+		log.Printf("admin api: edited comment %s_%d\n", postID, dateInt)
+	}
+	return edited, err
+}
+
+func apiGetCommentEdits(postID, date string) ([]CommentEdit, error) {
+	dateInt, err := parseAPICommentDate(date)
+	if err != nil {
+		return nil, err
+	}
+	var edits []CommentEdit
+	err = db.View(func(tx *bolt.Tx) error {
+		_, err := getComment(tx, postID, dateInt)
+		if err != nil {
+			return err
+		}
+		edits, err = getCommentEdits(tx, postID, dateInt)
+		return err
+	})
+	return edits, err
+}
+
+// apiModerateComment returns the comment as it was before the action, or the restored comment
+func apiModerateComment(request *http.Request, postID, date, action string) (*Comment, error) {
+	dateInt, err := parseAPICommentDate(date)
+	if err != nil {
+		return nil, err
+	}
+	switch action {
+	case moderationActionApprove, moderationActionSpam, moderationActionBan, moderationActionDelete:
+	case "restore":
+		var restored *Comment
+		err = db.Update(func(tx *bolt.Tx) error {
+			restored, err = restoreComment(tx, postID, dateInt)
+			if err != nil {
+				return err
+			}
+			auditEntry := newAuditEntry(request, auditActionCommentRestore)
+			auditEntry.DocumentID = postID
+			auditEntry.CommentDate = dateInt
+			return recordAudit(tx, auditEntry)
+		})
+		if err == nil {
+			log.Printf("admin api: restore comment %s_%d\n", postID, dateInt)
+		}
+		return restored, err
+	default:
+		return nil, newAPIError(400, "unknown moderation action '%s'", action)
+	}
+
+	var moderatedComment *Comment
+	err = db.Update(func(tx *bolt.Tx) error {
+		moderatedComment, err = moderateComment(tx, postID, dateInt, action)
+		if err != nil {
+			return err
+		}
+		return recordAudit(tx, newAuditEntry(request, commentAuditAction(action)).withComment(moderatedComment))
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("admin api: %s comment %s_%d\n", action, postID, dateInt)
+	afterModeration(moderatedComment, action)
+	return moderatedComment, nil
+}
+
+func apiListBans() ([]Ban, error) {
+	var bans []Ban
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		bans, err = getBans(tx)
+		return err
+	})
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Created > bans[j].Created
+	})
+	return bans, err
+}
+
+// apiAddBan takes a JSON Ban, only type, value, reason, expires and shadow are used
+func apiAddBan(request *http.Request) (*Ban, error) {
+	var requestBan Ban
+	err := json.NewDecoder(request.Body).Decode(&requestBan)
+	if err != nil {
+		return nil, newAPIError(400, "can't parse the request body as a ban: %v", err)
+	}
+	ban := Ban{
+		Type:    requestBan.Type,
+		Value:   requestBan.Value,
+		Reason:  requestBan.Reason,
+		Expires: requestBan.Expires,
+		Shadow:  requestBan.Shadow,
+	}
+	err = validateBan(&ban)
+	if err != nil {
+		return nil, newAPIError(400, "%s", err.Error())
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		auditEntry := newAuditEntry(request, auditActionBanAdd).withBefore(getBan(tx, ban.ID))
+		auditEntry.Target = ban.ID
+		auditEntry.Details = ban.Reason
+		err := addBan(tx, &ban)
+		if err != nil {
+			return err
+		}
+		return recordAudit(tx, auditEntry)
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("admin api: added ban %s\n", ban.ID)
+	return &ban, nil
+}
+
+func apiRemoveBan(request *http.Request, id string) (*Ban, error) {
+	var removed *Ban
+	err := db.Update(func(tx *bolt.Tx) error {
+		removed = getBan(tx, id)
+		if removed == nil {
+			return newAPIError(404, "ban '%s' not found", id)
+		}
+		auditEntry := newAuditEntry(request, auditActionBanRemove).withBefore(removed)
+		auditEntry.Target = id
+		err := removeBan(tx, id)
+		if err != nil {
+			return err
+		}
+		return recordAudit(tx, auditEntry)
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("admin api: removed ban %s\n", id)
+	return removed, nil
+}
+
+// apiListSubscriptions finds everyone who asked to be notified of replies, the same way sendNotifications does
+func apiListSubscriptions() ([]apiSubscription, error) {
+	subscriptions := map[string]*apiSubscription{}
+	err := db.View(func(tx *bolt.Tx) error {
+		comments, err := findComments(tx, &commentFilter{})
+		if err != nil {
+			return err
+		}
+		emailDisables := tx.Bucket([]byte("email_disables"))
+		emailDocumentDisables := tx.Bucket([]byte("email_document_disables"))
+		for _, comment := range comments {
+			if comment.Email == "" || comment.NotifyOfReplies != "child+sibling" {
+				continue
+			}
+			subscription, has := subscriptions[comment.Email]
+			if !has {
+				subscription = &apiSubscription{Email: comment.Email, Documents: []string{}}
+				subscription.Unsubscribed = emailDisables != nil && emailDisables.Get([]byte(comment.Email)) != nil
+				subscriptions[comment.Email] = subscription
+			}
+			if containsString(subscription.Documents, comment.DocumentID) {
+				continue
+			}
+			subscription.Documents = append(subscription.Documents, comment.DocumentID)
+			muteKey := []byte(fmt.Sprintf("%s:%s", comment.Email, comment.DocumentID))
+			if emailDocumentDisables != nil && emailDocumentDisables.Get(muteKey) != nil {
+				subscription.MutedDocuments = append(subscription.MutedDocuments, comment.DocumentID)
+			}
+		}
+		return nil
+	})
+
+	result := []apiSubscription{}
+	for _, subscription := range subscriptions {
+		result = append(result, *subscription)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Email < result[j].Email
+	})
+	return result, err
+}
+
+// apiRemoveSubscription unsubscribes the email address from all notifications, like the unsubscribe link in the emails
+func apiRemoveSubscription(request *http.Request, email string) (*apiSubscription, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("email_disables"))
+		if err != nil {
+			return err
+		}
+		err = bucket.Put([]byte(email), []byte("true"))
+		if err != nil {
+			return err
+		}
+		auditEntry := newAuditEntry(request, auditActionSubscriptionRemove)
+		auditEntry.Target = hashEmail(email)
+		return recordAudit(tx, auditEntry)
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("admin api: unsubscribed %s\n", email)
+	return &apiSubscription{Email: email, Documents: []string{}, Unsubscribed: true}, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+	"github.com/boltdb/bolt"
+)
+
+const auditActionCommentReply = "comment.reply"
+
+var errEmptyReply = errors.New("comment body is required")
+
+// adminReplyComment handles the reply form on the admin page of a document
+func adminReplyComment(request *http.Request, postID string) error {
+	dateInt, err := strconv.ParseInt(request.Form.Get("date"), 10, 64)
+	if err != nil {
+		return err
+	}
+	_, err = postAdminReply(request, postID, dateInt, request.Form.Get("body"), request.Form.Get("identity"), request.Form.Get("username"))
+	if err == errCommentNotFound {
+		return nil
+	}
+	return err
+}
+
+// postAdminReply posts a reply to a comment from the admin panel. it skips the captcha, the rate limits and the
+// spam filters, but otherwise the reply is stored and announced like any other comment. the reply can be posted as
+// one of the owner identities, so it gets their avatar, and it always counts as being written by the author.
+func postAdminReply(request *http.Request, postID string, parentDate int64, body, ownerAvatarHash, username string) (*Comment, error) {
+	if regexp.MustCompile(`^[\s\t\n\r]*$`).MatchString(body) {
+		return nil, errEmptyReply
+	}
+	user := adminUserFromRequest(request)
+	if user == nil {
+		return nil, fmt.Errorf("admin replies need a logged in admin user")
+	}
+
+	var reply Comment
+	err := db.Update(func(tx *bolt.Tx) error {
+		parent, err := getComment(tx, postID, parentDate)
+		if err != nil {
+			return err
+		}
+		documentState, err := getDocumentState(tx, postID)
+		if err != nil {
+			return err
+		}
+		if documentState == documentStateArchived {
+			return errDocumentArchived
+		}
+
+		reply = Comment{
+			URL:           parent.URL,
+			DocumentTitle: parent.DocumentTitle,
+			DocumentID:    postID,
+			InReplyTo:     fmt.Sprintf("%s_%d", postID, parent.Date),
+			Username:      strings.TrimSpace(username),
+			Body:          body,
+			AdminAuthor:   user.Username,
+			IPAddress:     getClientIP(request),
+			UserAgent:     request.UserAgent(),
+		}
+		if ownerAvatarHash != "" {
+			owners, err := getOwners(tx, siteForDocument(postID))
+			if err != nil {
+				return err
+			}
+			owner, has := owners[ownerAvatarHash]
+			if !has {
+				return fmt.Errorf("'%s' is not an owner identity", ownerAvatarHash)
+			}
+			reply.AvatarHash = owner.AvatarHash
+			if reply.Username == "" {
+				reply.Username = owner.Name
+			}
+		}
+		if reply.Username == "" {
+			reply.Username = user.Username
+		}
+
+		err = storeComment(tx, &reply, nil, "")
+		if err != nil {
+			return err
+		}
+		auditEntry := newAuditEntry(request, auditActionCommentReply)
+		auditEntry.DocumentID = postID
+		auditEntry.CommentDate = reply.Date
+		auditEntry.Target = string(commentKey(postID, parent.Date))
+		return recordAudit(tx, auditEntry)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("admin: %s replied to comment %s_%d\n", user.Username, postID, parentDate)
+	// the admin wrote the reply, so they don't need to be notified about it
+	sendNotifications(&reply, true, false)
+	queueWebhookEvent(webhookEventCommentCreated, &reply, "", nil)
+	return &reply, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"html/template"
+	"strconv"
+)
+
+// the admin page of a document shows this many threads at a time
+const adminThreadsPerPage = 50
+
+// adminComment is a comment on the admin page of a document, in the order of the thread tree
+type adminComment struct {
+	Comment
+	BodyHTML template.HTML
+	Indent   int
+	// InReplyToUsername is empty for top level comments. Orphan is set when the comment it replied to was deleted.
+	InReplyToUsername string
+	Orphan            bool
+}
+
+// flattenThreads walks the thread tree depth first and renders every comment
+func flattenThreads(rootComments []*Comment, comments map[string]*Comment) ([]adminComment, error) {
+	flattened := []adminComment{}
+	var walk func(comment *Comment, depth int) error
+	walk = func(comment *Comment, depth int) error {
+		bodyHTML, err := renderCommentBody(comment)
+		if err != nil {
+			return err
+		}
+		thread := adminComment{
+			Comment:  *comment,
+			BodyHTML: template.HTML(bodyHTML),
+			Indent:   depth * 2,
+		}
+		if comment.InReplyTo != "" && comment.InReplyTo != "root" {
+			if parent, has := comments[comment.InReplyTo]; has {
+				thread.InReplyToUsername = parent.Username
+			} else {
+				thread.Orphan = true
+			}
+		}
+		flattened = append(flattened, thread)
+		for _, reply := range comment.Replies {
+			err = walk(reply, depth+1)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, comment := range rootComments {
+		err := walk(comment, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return flattened, nil
+}
+
+// paginateThreads returns the threads on the given page, a page never splits a thread.
+// page is clamped to the existing pages.
+func paginateThreads(rootComments []*Comment, pageString string) ([]*Comment, int, int) {
+	pages := (len(rootComments) + adminThreadsPerPage - 1) / adminThreadsPerPage
+	if pages == 0 {
+		pages = 1
+	}
+	page, err := strconv.Atoi(pageString)
+	if err != nil || page < 1 {
+		page = 1
+	}
+	if page > pages {
+		page = pages
+	}
+	start := (page - 1) * adminThreadsPerPage
+	end := start + adminThreadsPerPage
+	if end > len(rootComments) {
+		end = len(rootComments)
+	}
+	return rootComments[start:end], page, pages
+}
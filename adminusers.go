@@ -0,0 +1,702 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const adminRoleOwner = "owner"
+const adminRoleModerator = "moderator"
+const adminRoleReadOnly = "read-only"
+
+const auditActionUserAdd = "user.add"
+const auditActionUserRemove = "user.remove"
+const auditActionUserRole = "user.role"
+const auditActionUserPassword = "user.password"
+const auditActionLogin = "session.login"
+const auditActionLogout = "session.logout"
+
+const adminSessionCookie = "sqr-comments-admin-session"
+const adminSessionDuration = time.Hour * 24 * 7
+const adminPasswordMinLength = 10
+
+// these admin pages can only be used by owners, see adminPages for the rest
+var ownerOnlyAdminPages = map[string]bool{
+	"users":    true,
+	"tokens":   true,
+	"webhooks": true,
+	"emails":   true,
+}
+
+// these admin pages show or change things which apply to every site, so only the admins of the default site can use them
+var defaultSiteAdminPages = map[string]bool{
+	"bayes":    true,
+	"bans":     true,
+	"bulk":     true,
+	"audit":    true,
+	"search":   true,
+	"tokens":   true,
+	"webhooks": true,
+	"emails":   true,
+}
+
+// AdminUser can log in to the admin pages. the first owner, "admin", is created from COMMENTS_ADMIN_PASSWORD
+// the first time the server starts, after that the password can be changed on the account page.
+// every user belongs to one site and can only log in there, Site is empty for the default site.
+type AdminUser struct {
+	Username          string   `json:"username"`
+	Site              string   `json:"site,omitempty"`
+	PasswordHash      string   `json:"passwordHash"`
+	Role              string   `json:"role"`
+	Created           int64    `json:"created"`
+	TOTPSecret        string   `json:"totpSecret,omitempty"`
+	PendingTOTPSecret string   `json:"pendingTotpSecret,omitempty"`
+	TOTPLastCounter   int64    `json:"totpLastCounter,omitempty"`
+	RecoveryCodes     []string `json:"recoveryCodes,omitempty"`
+}
+
+// AdminSession is stored in the admin_sessions bucket keyed by the sha256 hash of the session cookie
+type AdminSession struct {
+	Username string `json:"username"`
+	Created  int64  `json:"created"`
+	Expires  int64  `json:"expires"`
+}
+
+type adminUserContextKey struct{}
+
+type accountPage struct {
+	User          *AdminUser
+	TOTPRequired  bool
+	TOTPURI       string
+	QRCode        template.URL
+	RecoveryCodes []string
+	Message       string
+	Error         string
+}
+
+func validAdminRole(role string) bool {
+	return role == adminRoleOwner || role == adminRoleModerator || role == adminRoleReadOnly
+}
+
+// initAdminUsers creates the first owner the first time the server starts with COMMENTS_ADMIN_PASSWORD. after that the
+// password is not needed any more: the admin panel is turned on whenever there are admin users in the database.
+func initAdminUsers() {
+	err := db.Update(func(tx *bolt.Tx) error {
+		users, err := getAdminUsers(tx)
+		if err != nil {
+			return err
+		}
+		if len(users) > 0 {
+			adminEnabled = true
+			return nil
+		}
+		if adminPassword == "" {
+			return nil
+		}
+		log.Println("creating the admin user 'admin' with the password from COMMENTS_ADMIN_PASSWORD")
+		err = putAdminUser(tx, &AdminUser{Username: "admin", Role: adminRoleOwner}, adminPassword)
+		adminEnabled = err == nil
+		return err
+	})
+	if err != nil {
+		log.Printf("failed to create the first admin user: %v\n", err)
+	}
+}
+
+func getAdminUser(tx *bolt.Tx, username string) (*AdminUser, error) {
+	bucket := tx.Bucket([]byte("admin_users"))
+	if bucket == nil {
+		return nil, nil
+	}
+	userBytes := bucket.Get([]byte(username))
+	if userBytes == nil {
+		return nil, nil
+	}
+	var user AdminUser
+	err := json.Unmarshal(userBytes, &user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func getAdminUsers(tx *bolt.Tx) ([]AdminUser, error) {
+	users := []AdminUser{}
+	bucket := tx.Bucket([]byte("admin_users"))
+	if bucket == nil {
+		return users, nil
+	}
+	err := bucket.ForEach(func(k, v []byte) error {
+		var user AdminUser
+		err := json.Unmarshal(v, &user)
+		if err != nil {
+			return err
+		}
+		users = append(users, user)
+		return nil
+	})
+	return users, err
+}
+
+// putAdminUser hashes the password if it is not empty, otherwise the existing hash is kept
+func putAdminUser(tx *bolt.Tx, user *AdminUser, password string) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte("admin_users"))
+	if err != nil {
+		return err
+	}
+	if password != "" {
+		passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		user.PasswordHash = string(passwordHash)
+	}
+	if user.Created == 0 {
+		user.Created = getMillisecondsSinceUnixEpoch()
+	}
+	userBytes, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(user.Username), userBytes)
+}
+
+// countOtherOwners makes sure that there is always at least one owner left on every site
+func countOtherOwners(tx *bolt.Tx, site, username string) (int, error) {
+	users, err := getAdminUsers(tx)
+	owners := 0
+	for _, user := range users {
+		if user.Role == adminRoleOwner && user.Site == site && user.Username != username {
+			owners++
+		}
+	}
+	return owners, err
+}
+
+func validateAdminPassword(password string) error {
+	if len(password) < adminPasswordMinLength {
+		return fmt.Errorf("the password must be at least %d characters long", adminPasswordMinLength)
+	}
+	return nil
+}
+
+// dummyPasswordHash is checked when the user does not exist, so that the response takes just as long as a wrong password
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
+// checkAdminPassword returns the user if the username and password are correct, otherwise nil
+func checkAdminPassword(username, password string) (*AdminUser, error) {
+	var user *AdminUser
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		user, err = getAdminUser(tx, username)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, nil
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return nil, nil
+	}
+	return user, nil
+}
+
+func hashSessionToken(token string) []byte {
+	return []byte(fmt.Sprintf("%x", sha256.Sum256([]byte(token))))
+}
+
+// createAdminSession also removes the sessions which have expired
+func createAdminSession(tx *bolt.Tx, username string) (string, *AdminSession, error) {
+	bucket, err := tx.CreateBucketIfNotExists([]byte("admin_sessions"))
+	if err != nil {
+		return "", nil, err
+	}
+	now := getMillisecondsSinceUnixEpoch()
+	cursor := bucket.Cursor()
+	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+		var session AdminSession
+		if json.Unmarshal(v, &session) != nil || session.Expires < now {
+			err = cursor.Delete()
+			if err != nil {
+				return "", nil, err
+			}
+		}
+	}
+
+	randomBytes := make([]byte, 32)
+	_, err = rand.Read(randomBytes)
+	if err != nil {
+		return "", nil, err
+	}
+	token := fmt.Sprintf("%x", randomBytes)
+	session := &AdminSession{
+		Username: username,
+		Created:  now,
+		Expires:  now + int64(adminSessionDuration/time.Millisecond),
+	}
+	sessionBytes, err := json.Marshal(session)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, session, bucket.Put(hashSessionToken(token), sessionBytes)
+}
+
+func deleteAdminSession(tx *bolt.Tx, token string) error {
+	bucket := tx.Bucket([]byte("admin_sessions"))
+	if bucket == nil {
+		return nil
+	}
+	return bucket.Delete(hashSessionToken(token))
+}
+
+// deleteAdminSessions logs the user out everywhere except for the session with the token keepToken
+func deleteAdminSessions(tx *bolt.Tx, username, keepToken string) error {
+	bucket := tx.Bucket([]byte("admin_sessions"))
+	if bucket == nil {
+		return nil
+	}
+	keepKey := string(hashSessionToken(keepToken))
+	cursor := bucket.Cursor()
+	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+		var session AdminSession
+		if json.Unmarshal(v, &session) == nil && session.Username == username && string(k) != keepKey {
+			err := cursor.Delete()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// getSessionUser returns the logged in admin user, or nil if the session cookie is missing, expired or its user was removed
+func getSessionUser(request *http.Request) (*AdminUser, error) {
+	cookie, err := request.Cookie(adminSessionCookie)
+	if err != nil || cookie.Value == "" {
+		return nil, nil
+	}
+	var user *AdminUser
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("admin_sessions"))
+		if bucket == nil {
+			return nil
+		}
+		sessionBytes := bucket.Get(hashSessionToken(cookie.Value))
+		if sessionBytes == nil {
+			return nil
+		}
+		var session AdminSession
+		err := json.Unmarshal(sessionBytes, &session)
+		if err != nil {
+			return err
+		}
+		if session.Expires < getMillisecondsSinceUnixEpoch() {
+			return nil
+		}
+		user, err = getAdminUser(tx, session.Username)
+		return err
+	})
+	if user != nil && user.Site != siteForRequest(request).Name {
+		return nil, err
+	}
+	return user, err
+}
+
+// withAdminUser remembers who is logged in while handling this request
+func withAdminUser(request *http.Request, user *AdminUser) *http.Request {
+	request = withAdminName(request, user.Username)
+	return request.WithContext(context.WithValue(request.Context(), adminUserContextKey{}, user))
+}
+
+// adminUserFromRequest returns the user which was added by withAdminUser
+func adminUserFromRequest(request *http.Request) *AdminUser {
+	user, _ := request.Context().Value(adminUserContextKey{}).(*AdminUser)
+	return user
+}
+
+func setAdminSessionCookie(responseWriter http.ResponseWriter, request *http.Request, token string, maxAge int) {
+	site := siteForRequest(request)
+	http.SetCookie(responseWriter, &http.Cookie{
+		Name:     adminSessionCookie,
+		Value:    token,
+		Path:     fmt.Sprintf("%s/admin/", site.BasePath()),
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(site.URL, "https://"),
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// redirectToLogin sends the browser back to the page it wanted after it logs in
+func redirectToLogin(responseWriter http.ResponseWriter, request *http.Request) {
+	loginURL := fmt.Sprintf("%s/admin/%slogin?next=%s", siteForRequest(request).BasePath(), adminPagePrefix, url.QueryEscape(request.URL.RequestURI()))
+	http.Redirect(responseWriter, request, loginURL, http.StatusSeeOther)
+}
+
+// adminLogin checks the password first. users with two-factor authentication then get a second form which asks for the
+// code, it carries a signed challenge instead of the password.
+func adminLogin(responseWriter http.ResponseWriter, request *http.Request) {
+	site := siteForRequest(request)
+	next := request.URL.Query().Get("next")
+	if !strings.HasPrefix(next, fmt.Sprintf("%s/admin/", site.BasePath())) || strings.HasPrefix(next, "//") {
+		next = fmt.Sprintf("%s/admin/", site.BasePath())
+	}
+	templateData := struct {
+		Next               string
+		Username           string
+		ChallengeExpires   int64
+		ChallengeSignature string
+		Error              string
+	}{
+		Next: next,
+	}
+
+	if request.Method == "POST" {
+		err := request.ParseForm()
+		ipAddress := getClientIP(request)
+		if wait := checkLoginLockout(ipAddress, request.PostForm.Get("username")); err == nil && wait > 0 {
+			log.Printf("admin login for '%s' from %s rejected because of a lockout\n", request.PostForm.Get("username"), ipAddress)
+			templateData.Error = fmt.Sprintf("too many failed attempts, try again in %s", wait.Round(time.Second))
+			responseWriter.WriteHeader(http.StatusTooManyRequests)
+			renderAdminTemplate(responseWriter, request, "admin-login.html.gotemplate", templateData)
+			return
+		}
+		var user *AdminUser
+		var secondFactor string
+		if err == nil && request.PostForm.Get("challengeSignature") != "" {
+			templateData.Username = request.PostForm.Get("username")
+			if !verifyLoginChallenge(templateData.Username, request.PostForm.Get("challengeExpires"), request.PostForm.Get("challengeSignature")) {
+				templateData.Username = ""
+				templateData.Error = "the login has expired, please try again"
+			} else {
+				err = db.Update(func(tx *bolt.Tx) error {
+					var err error
+					user, err = getAdminUser(tx, templateData.Username)
+					if err != nil || user == nil || user.Site != site.Name {
+						user = nil
+						return err
+					}
+					secondFactor, err = checkSecondFactor(tx, user, request.PostForm.Get("code"))
+					return err
+				})
+				if err == nil && secondFactor == "" {
+					log.Printf("admin login failed for '%s' from %s: wrong code\n", templateData.Username, ipAddress)
+					recordLoginFailure(site, ipAddress, templateData.Username)
+					templateData.ChallengeExpires, _ = strconv.ParseInt(request.PostForm.Get("challengeExpires"), 10, 64)
+					templateData.ChallengeSignature = request.PostForm.Get("challengeSignature")
+					templateData.Error = "the code is wrong"
+					user = nil
+				}
+			}
+		} else if err == nil {
+			templateData.Username = request.PostForm.Get("username")
+			user, err = checkAdminPassword(templateData.Username, request.PostForm.Get("password"))
+			// users of other sites get the same answer as a wrong password, so their usernames can't be guessed
+			if user != nil && user.Site != site.Name {
+				user = nil
+			}
+			if err == nil && user == nil {
+				log.Printf("admin login failed for '%s' from %s\n", templateData.Username, ipAddress)
+				recordLoginFailure(site, ipAddress, templateData.Username)
+				templateData.Error = "wrong username or password"
+			} else if err == nil && user.TOTPSecret != "" {
+				templateData.ChallengeExpires = getMillisecondsSinceUnixEpoch() + int64(totpLoginTimeout/time.Millisecond)
+				templateData.ChallengeSignature = loginChallengeSignature(user.Username, templateData.ChallengeExpires)
+				user = nil
+			}
+		}
+		if err == nil && user != nil {
+			var token string
+			err = db.Update(func(tx *bolt.Tx) error {
+				var err error
+				token, _, err = createAdminSession(tx, user.Username)
+				if err != nil {
+					return err
+				}
+				auditEntry := newAuditEntry(withAdminUser(request, user), auditActionLogin)
+				auditEntry.Details = secondFactor
+				return recordAudit(tx, auditEntry)
+			})
+			if err == nil {
+				log.Printf("admin: %s logged in\n", user.Username)
+				recordLoginSuccess(ipAddress, user.Username)
+				setAdminSessionCookie(responseWriter, request, token, int(adminSessionDuration/time.Second))
+				http.Redirect(responseWriter, request, next, http.StatusSeeOther)
+				return
+			}
+		}
+		if err != nil {
+			log.Printf("admin login failed: %v\n", err)
+			responseWriter.WriteHeader(500)
+			responseWriter.Write([]byte("500 internal server error"))
+			return
+		}
+	}
+
+	renderAdminTemplate(responseWriter, request, "admin-login.html.gotemplate", templateData)
+}
+
+func adminLogout(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		responseWriter.WriteHeader(405)
+		responseWriter.Write([]byte("405 Method Not Supported"))
+		return
+	}
+	cookie, err := request.Cookie(adminSessionCookie)
+	if err == nil {
+		err = db.Update(func(tx *bolt.Tx) error {
+			err := deleteAdminSession(tx, cookie.Value)
+			if err != nil {
+				return err
+			}
+			return recordAudit(tx, newAuditEntry(request, auditActionLogout))
+		})
+		if err != nil {
+			log.Printf("admin logout failed: %v\n", err)
+		}
+	}
+	setAdminSessionCookie(responseWriter, request, "", -1)
+	http.Redirect(responseWriter, request, fmt.Sprintf("%s/admin/%slogin", siteForRequest(request).BasePath(), adminPagePrefix), http.StatusSeeOther)
+}
+
+// adminAccount lets every admin user change their own password and set up two-factor authentication
+func adminAccount(responseWriter http.ResponseWriter, request *http.Request) {
+	user := adminUserFromRequest(request)
+	templateData := accountPage{
+		User:         user,
+		TOTPRequired: adminRequireTOTPRoles[user.Role],
+	}
+
+	if request.Method == "POST" {
+		err := request.ParseForm()
+		if err == nil && request.PostForm.Get("action") != "password" {
+			err = handleAccountTOTP(request, user, &templateData)
+		} else if err == nil {
+			newPassword := request.PostForm.Get("newPassword")
+			var current *AdminUser
+			current, err = checkAdminPassword(user.Username, request.PostForm.Get("password"))
+			if err == nil && current == nil {
+				templateData.Error = "the current password is wrong"
+			} else if err == nil && newPassword != request.PostForm.Get("confirmPassword") {
+				templateData.Error = "the new passwords don't match"
+			} else if validationErr := validateAdminPassword(newPassword); err == nil && validationErr != nil {
+				templateData.Error = validationErr.Error()
+			} else if err == nil {
+				err = db.Update(func(tx *bolt.Tx) error {
+					auditEntry := newAuditEntry(request, auditActionUserPassword)
+					auditEntry.Target = current.Username
+					err := putAdminUser(tx, current, newPassword)
+					if err != nil {
+						return err
+					}
+					// a stolen session must not survive the password change, only this one stays logged in
+					cookie, _ := request.Cookie(adminSessionCookie)
+					err = deleteAdminSessions(tx, current.Username, cookie.Value)
+					if err != nil {
+						return err
+					}
+					return recordAudit(tx, auditEntry)
+				})
+				if err == nil {
+					log.Printf("admin: %s changed their password\n", current.Username)
+					templateData.Message = "your password has been changed"
+				}
+			}
+		}
+		if err != nil {
+			log.Printf("admin account page failed: %v\n", err)
+			responseWriter.WriteHeader(500)
+			responseWriter.Write([]byte("500 internal server error"))
+			return
+		}
+	}
+
+	if user.TOTPSecret == "" && user.PendingTOTPSecret != "" {
+		templateData.TOTPURI = totpURI(user.Username, user.PendingTOTPSecret)
+		var err error
+		templateData.QRCode, err = totpQRCode(templateData.TOTPURI)
+		if err != nil {
+			log.Printf("failed to render the TOTP QR code: %v\n", err)
+		}
+	}
+
+	renderAdminTemplate(responseWriter, request, "admin-account.html.gotemplate", templateData)
+}
+
+// adminUsers manages the users of the site. the owners of the default site can manage the users of every site,
+// that is how the first owner of a named site is created.
+func adminUsers(responseWriter http.ResponseWriter, request *http.Request) {
+	site := siteForRequest(request)
+	templateData := struct {
+		Users []AdminUser
+		Roles []string
+		Sites []string
+		Error string
+	}{
+		Roles: []string{adminRoleOwner, adminRoleModerator, adminRoleReadOnly},
+		Sites: []string{},
+	}
+	if site.Name == "" {
+		for name := range namedSites {
+			templateData.Sites = append(templateData.Sites, name)
+		}
+		sort.Strings(templateData.Sites)
+	}
+	canManage := func(user *AdminUser) bool {
+		return site.Name == "" || user.Site == site.Name
+	}
+
+	var err error
+	if request.Method == "POST" {
+		err = request.ParseForm()
+		action := request.PostForm.Get("action")
+		username := strings.TrimSpace(request.PostForm.Get("username"))
+		role := request.PostForm.Get("role")
+		password := request.PostForm.Get("password")
+		if err == nil && action == "totp-reset" {
+			err = db.Update(func(tx *bolt.Tx) error {
+				user, err := getAdminUser(tx, username)
+				if err != nil || user == nil || !canManage(user) {
+					return err
+				}
+				user.TOTPSecret = ""
+				user.PendingTOTPSecret = ""
+				user.TOTPLastCounter = 0
+				user.RecoveryCodes = nil
+				err = putAdminUser(tx, user, "")
+				if err != nil {
+					return err
+				}
+				auditEntry := newAuditEntry(request, auditActionTOTPReset)
+				auditEntry.Target = username
+				return recordAudit(tx, auditEntry)
+			})
+			if err == nil {
+				log.Printf("admin: reset two-factor authentication of %s\n", username)
+			}
+		} else if err == nil && (action == "remove" || action == "role") {
+			err = db.Update(func(tx *bolt.Tx) error {
+				user, err := getAdminUser(tx, username)
+				if err != nil || user == nil || !canManage(user) {
+					return err
+				}
+				otherOwners, err := countOtherOwners(tx, user.Site, username)
+				if err != nil {
+					return err
+				}
+				if otherOwners == 0 && (action == "remove" || role != adminRoleOwner) {
+					templateData.Error = "there has to be at least one owner"
+					return nil
+				}
+				if action == "role" && !validAdminRole(role) {
+					templateData.Error = fmt.Sprintf("unknown role '%s'", role)
+					return nil
+				}
+				auditEntry := newAuditEntry(request, auditActionUserRemove)
+				auditEntry.Target = username
+				auditEntry.withBefore(struct {
+					Username string `json:"username"`
+					Role     string `json:"role"`
+				}{user.Username, user.Role})
+				if action == "role" {
+					auditEntry.Action = auditActionUserRole
+					auditEntry.Details = role
+					user.Role = role
+					err = putAdminUser(tx, user, "")
+				} else {
+					err = tx.Bucket([]byte("admin_users")).Delete([]byte(username))
+					if err == nil {
+						err = deleteAdminSessions(tx, username, "")
+					}
+				}
+				if err != nil {
+					return err
+				}
+				return recordAudit(tx, auditEntry)
+			})
+			if err == nil && templateData.Error == "" {
+				log.Printf("admin: %s admin user %s\n", action, username)
+			}
+		} else if err == nil {
+			userSite := site.Name
+			if site.Name == "" {
+				userSite = request.PostForm.Get("site")
+			}
+			if username == "" {
+				templateData.Error = "username is required"
+			} else if _, has := namedSites[userSite]; userSite != "" && !has {
+				templateData.Error = fmt.Sprintf("unknown site '%s'", userSite)
+			} else if !validAdminRole(role) {
+				templateData.Error = fmt.Sprintf("unknown role '%s'", role)
+			} else if validationErr := validateAdminPassword(password); validationErr != nil {
+				templateData.Error = validationErr.Error()
+			} else {
+				err = db.Update(func(tx *bolt.Tx) error {
+					existing, err := getAdminUser(tx, username)
+					if err != nil {
+						return err
+					}
+					if existing != nil {
+						templateData.Error = fmt.Sprintf("there is already an admin user named '%s'", username)
+						return nil
+					}
+					auditEntry := newAuditEntry(request, auditActionUserAdd)
+					auditEntry.Target = username
+					auditEntry.Details = role
+					if userSite != "" {
+						auditEntry.Details = fmt.Sprintf("%s on %s", role, userSite)
+					}
+					err = putAdminUser(tx, &AdminUser{Username: username, Site: userSite, Role: role}, password)
+					if err != nil {
+						return err
+					}
+					return recordAudit(tx, auditEntry)
+				})
+				if err == nil && templateData.Error == "" {
+					log.Printf("admin: added %s admin user %s\n", role, username)
+				}
+			}
+		}
+	}
+
+	if err == nil {
+		err = db.View(func(tx *bolt.Tx) error {
+			users, err := getAdminUsers(tx)
+			for i := range users {
+				if canManage(&users[i]) {
+					templateData.Users = append(templateData.Users, users[i])
+				}
+			}
+			return err
+		})
+	}
+	if err != nil {
+		log.Printf("admin users page failed: %v\n", err)
+		responseWriter.WriteHeader(500)
+		responseWriter.Write([]byte("500 internal server error"))
+		return
+	}
+
+	sort.Slice(templateData.Users, func(i, j int) bool {
+		return templateData.Users[i].Created < templateData.Users[j].Created
+	})
+
+	renderAdminTemplate(responseWriter, request, "admin-users.html.gotemplate", templateData)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestDeleteAdminSessions(t *testing.T) {
+	db = openTestDB(t)
+	tokens := map[string]string{}
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"alice laptop", "alice phone", "bob"} {
+			username := "alice"
+			if name == "bob" {
+				username = "bob"
+			}
+			token, _, err := createAdminSession(tx, username)
+			if err != nil {
+				return err
+			}
+			tokens[name] = token
+		}
+		return deleteAdminSessions(tx, "alice", tokens["alice laptop"])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		loggedIn bool
+	}{
+		{"alice laptop", true},
+		{"alice phone", false},
+		{"bob", true},
+	}
+	db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("admin_sessions"))
+		for _, test := range tests {
+			if loggedIn := bucket.Get(hashSessionToken(tokens[test.name])) != nil; loggedIn != test.loggedIn {
+				t.Errorf("%s: expected loggedIn=%t, got %t", test.name, test.loggedIn, loggedIn)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+)
+
+// Akismet or any service that implements the same REST API, for example a self-hosted clone.
+// https://akismet.com/developers/
+var akismetAPIKey = "$COMMENTS_AKISMET_API_KEY"
+var akismetURLString = "$COMMENTS_AKISMET_URL"
+var akismetBlog = "$COMMENTS_AKISMET_BLOG"
+var akismetScoreString = "$COMMENTS_AKISMET_SCORE"
+var akismetURL *url.URL
+var akismetScore float64
+
+func initAkismet() {
+	akismetAPIKey = os.ExpandEnv(akismetAPIKey)
+	if akismetAPIKey == "" {
+		return
+	}
+	akismetURLString = os.ExpandEnv(akismetURLString)
+	if akismetURLString == "" {
+		akismetURLString = "https://rest.akismet.com/1.1"
+	}
+	var err error
+	akismetURL, err = url.Parse(akismetURLString)
+	if err != nil {
+		panic(errors.Wrapf(err, "can't parse COMMENTS_AKISMET_URL '%s' as url", akismetURLString))
+	}
+	akismetBlog = os.ExpandEnv(akismetBlog)
+	if akismetBlog == "" && len(origins) > 0 {
+		akismetBlog = origins[0]
+	}
+	if akismetBlog == "" {
+		akismetBlog = commentsURLString
+	}
+	akismetScoreString = os.ExpandEnv(akismetScoreString)
+	akismetScore = spamQueueThreshold * 2
+	if akismetScoreString != "" {
+		akismetScore, err = strconv.ParseFloat(akismetScoreString, 64)
+		if err != nil {
+			panic(errors.Wrapf(err, "can't parse COMMENTS_AKISMET_SCORE '%s' as a number", akismetScoreString))
+		}
+	}
+	log.Printf("akismet spam check enabled: %s (blog=%s)\n", akismetURL.String(), akismetBlog)
+}
+
+func checkSpamAkismet(comment *Comment) (float64, string) {
+	response, responseBody, err := akismetRequest("comment-check", comment)
+	if err != nil {
+		log.Printf("akismet comment-check failed: %v\n", err)
+		return 0, ""
+	}
+	switch responseBody {
+	case "true":
+		if response.Header.Get("X-akismet-pro-tip") == "discard" {
+			return spamRejectThreshold, "blatant spam"
+		}
+		return akismetScore, "classified as spam"
+	case "false":
+		return 0, ""
+	}
+	log.Printf("akismet comment-check returned '%s': %s\n", responseBody, response.Header.Get("X-akismet-debug-help"))
+	return 0, ""
+}
+
+// akismetSubmit tells the akismet service that it was wrong (or right) about a comment.
+// method is either submit-spam or submit-ham
+func akismetSubmit(method string, comment *Comment) {
+	if akismetAPIKey == "" {
+		return
+	}
+
+	// since this will be called in a goroutine, we need to do this in case we hit a panic()
+	defer (func() {
+		if r := recover(); r != nil {
+			fmt.Printf("akismetSubmit(): panic: %v\n", r)
+			debug.PrintStack()
+		}
+	})()
+
+	_, _, err := akismetRequest(method, comment)
+	if err != nil {
+		log.Printf("akismet %s failed for %s_%d: %v\n", method, comment.DocumentID, comment.Date, err)
+	}
+}
+
+func akismetRequest(method string, comment *Comment) (*http.Response, string, error) {
+	form := url.Values{}
+	form.Add("api_key", akismetAPIKey)
+	form.Add("blog", akismetBlog)
+	form.Add("user_ip", comment.IPAddress)
+	form.Add("user_agent", comment.UserAgent)
+	form.Add("referrer", comment.Referrer)
+	form.Add("permalink", comment.URL)
+	form.Add("comment_type", "comment")
+	form.Add("comment_author", comment.Username)
+	form.Add("comment_author_email", comment.Email)
+	form.Add("comment_content", comment.Body)
+	if comment.Date != 0 {
+		form.Add("comment_date_gmt", time.Unix(comment.Date/1000, 0).UTC().Format(time.RFC3339))
+	}
+
+	requestURL := url.URL{
+		Scheme: akismetURL.Scheme,
+		Host:   akismetURL.Host,
+		Path:   fmt.Sprintf("%s/%s", strings.TrimSuffix(akismetURL.Path, "/"), method),
+	}
+	akismetRequest, err := http.NewRequest("POST", requestURL.String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, "", err
+	}
+	akismetRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	akismetRequest.Header.Set("User-Agent", "SequentialRead Comments")
+
+	response, err := httpClient.Do(akismetRequest)
+	if err != nil {
+		return nil, "", err
+	}
+	defer response.Body.Close()
+	responseBytes, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if response.StatusCode != 200 {
+		return nil, "", fmt.Errorf("akismet %s returned http %d: %s", method, response.StatusCode, string(responseBytes))
+	}
+	return response, strings.TrimSpace(string(responseBytes)), nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const auditActionTokenCreate = "token.create"
+const auditActionTokenRevoke = "token.revoke"
+
+// the token is only shown once when it is created, the api_tokens bucket is keyed by its sha256 hash
+const apiTokenPrefix = "sqrc_"
+
+// APIToken authenticates requests to the admin API. ID is a short prefix of the hash, it is safe to display.
+type APIToken struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Created  int64  `json:"created"`
+	LastUsed int64  `json:"lastUsed,omitempty"`
+}
+
+type adminContextKey struct{}
+
+// withAdminName attributes everything done while handling this request to the given admin, see newAuditEntry
+func withAdminName(request *http.Request, admin string) *http.Request {
+	return request.WithContext(context.WithValue(request.Context(), adminContextKey{}, admin))
+}
+
+func hashAPIToken(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
+// createAPIToken returns the token itself, which is never stored
+func createAPIToken(tx *bolt.Tx, name string) (string, *APIToken, error) {
+	bucket, err := tx.CreateBucketIfNotExists([]byte("api_tokens"))
+	if err != nil {
+		return "", nil, err
+	}
+	randomBytes := make([]byte, 32)
+	_, err = rand.Read(randomBytes)
+	if err != nil {
+		return "", nil, err
+	}
+	token := fmt.Sprintf("%s%x", apiTokenPrefix, randomBytes)
+	tokenHash := hashAPIToken(token)
+	apiToken := &APIToken{
+		ID:      tokenHash[:12],
+		Name:    name,
+		Created: getMillisecondsSinceUnixEpoch(),
+	}
+	apiTokenBytes, err := json.Marshal(apiToken)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, apiToken, bucket.Put([]byte(tokenHash), apiTokenBytes)
+}
+
+func getAPITokens(tx *bolt.Tx) ([]APIToken, error) {
+	apiTokens := []APIToken{}
+	bucket := tx.Bucket([]byte("api_tokens"))
+	if bucket == nil {
+		return apiTokens, nil
+	}
+	err := bucket.ForEach(func(k, v []byte) error {
+		var apiToken APIToken
+		err := json.Unmarshal(v, &apiToken)
+		if err != nil {
+			return err
+		}
+		apiTokens = append(apiTokens, apiToken)
+		return nil
+	})
+	return apiTokens, err
+}
+
+// revokeAPIToken returns the revoked token, or nil if there was no token with this id
+func revokeAPIToken(tx *bolt.Tx, id string) (*APIToken, error) {
+	bucket := tx.Bucket([]byte("api_tokens"))
+	if bucket == nil || id == "" {
+		return nil, nil
+	}
+	cursor := bucket.Cursor()
+	for k, v := cursor.Seek([]byte(id)); k != nil && strings.HasPrefix(string(k), id); k, v = cursor.Next() {
+		var apiToken APIToken
+		err := json.Unmarshal(v, &apiToken)
+		if err != nil {
+			return nil, err
+		}
+		if apiToken.ID == id {
+			return &apiToken, cursor.Delete()
+		}
+	}
+	return nil, nil
+}
+
+// authenticateAPIToken returns nil if the token is unknown or was revoked
+func authenticateAPIToken(token string) (*APIToken, error) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return nil, nil
+	}
+	tokenHash := []byte(hashAPIToken(token))
+	var apiToken *APIToken
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("api_tokens"))
+		if bucket == nil {
+			return nil
+		}
+		apiTokenBytes := bucket.Get(tokenHash)
+		if apiTokenBytes == nil {
+			return nil
+		}
+		apiToken = &APIToken{}
+		err := json.Unmarshal(apiTokenBytes, apiToken)
+		if err != nil {
+			return err
+		}
+		// only write LastUsed once a minute so that scripts don't turn every read into a write
+		now := getMillisecondsSinceUnixEpoch()
+		if now-apiToken.LastUsed < int64(time.Minute/time.Millisecond) {
+			return nil
+		}
+		apiToken.LastUsed = now
+		apiTokenBytes, err = json.Marshal(apiToken)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(tokenHash, apiTokenBytes)
+	})
+	return apiToken, err
+}
+
+func adminTokens(responseWriter http.ResponseWriter, request *http.Request) {
+	templateData := struct {
+		Tokens   []APIToken
+		NewToken string
+		Error    string
+	}{}
+
+	var err error
+	if request.Method == "POST" {
+		err = request.ParseForm()
+		if err == nil && request.Form.Get("action") == "revoke" {
+			id := request.Form.Get("id")
+			err = db.Update(func(tx *bolt.Tx) error {
+				revoked, err := revokeAPIToken(tx, id)
+				if err != nil || revoked == nil {
+					return err
+				}
+				auditEntry := newAuditEntry(request, auditActionTokenRevoke).withBefore(revoked)
+				auditEntry.Target = id
+				return recordAudit(tx, auditEntry)
+			})
+			if err == nil {
+				log.Printf("admin: revoked api token %s\n", id)
+			}
+		} else if err == nil {
+			name := strings.TrimSpace(request.Form.Get("name"))
+			if name == "" {
+				templateData.Error = "name is required"
+			} else {
+				err = db.Update(func(tx *bolt.Tx) error {
+					token, apiToken, err := createAPIToken(tx, name)
+					if err != nil {
+						return err
+					}
+					templateData.NewToken = token
+					auditEntry := newAuditEntry(request, auditActionTokenCreate)
+					auditEntry.Target = apiToken.ID
+					auditEntry.Details = name
+					return recordAudit(tx, auditEntry)
+				})
+				if err == nil {
+					log.Printf("admin: created api token '%s'\n", name)
+				}
+			}
+		}
+	}
+
+	if err == nil {
+		err = db.View(func(tx *bolt.Tx) error {
+			templateData.Tokens, err = getAPITokens(tx)
+			return err
+		})
+	}
+	if err != nil {
+		log.Printf("admin tokens page failed: %v\n", err)
+		responseWriter.WriteHeader(500)
+		responseWriter.Write([]byte("500 internal server error"))
+		return
+	}
+
+	sort.Slice(templateData.Tokens, func(i, j int) bool {
+		return templateData.Tokens[i].Created > templateData.Tokens[j].Created
+	})
+
+	renderAdminTemplate(responseWriter, request, "admin-tokens.html.gotemplate", templateData)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const auditActionDocumentState = "document.state"
+const auditActionBanAdd = "ban.add"
+const auditActionBanRemove = "ban.remove"
+const auditActionBayesRetrain = "bayes.retrain"
+
+// AuditEntry records a single admin action. entries are only ever appended to the audit_log bucket,
+// keyed by a sequence number, and they are written in the same transaction as the action itself.
+type AuditEntry struct {
+	Date        int64           `json:"date"`
+	Admin       string          `json:"admin"`
+	IPAddress   string          `json:"ipAddress,omitempty"`
+	Action      string          `json:"action"`
+	DocumentID  string          `json:"documentId,omitempty"`
+	CommentDate int64           `json:"commentDate,omitempty"`
+	Target      string          `json:"target,omitempty"`
+	Details     string          `json:"details,omitempty"`
+	Before      json.RawMessage `json:"before,omitempty"`
+}
+
+// commentAuditAction is the audit action for a moderation action like approve or delete
+func commentAuditAction(moderationAction string) string {
+	return fmt.Sprintf("comment.%s", moderationAction)
+}
+
+// newAuditEntry fills in who did it and when. requests are attributed to the logged in admin user or the name of the
+// API token, requests which did not log in, like the signed moderation links, are attributed to "email link".
+func newAuditEntry(request *http.Request, action string) *AuditEntry {
+	admin, ok := request.Context().Value(adminContextKey{}).(string)
+	if !ok {
+		admin = "email link"
+	}
+	return &AuditEntry{
+		Date:      getMillisecondsSinceUnixEpoch(),
+		Admin:     admin,
+		IPAddress: getClientIP(request),
+		Action:    action,
+	}
+}
+
+// withBefore stores the state of whatever was changed, as it was before the change
+func (entry *AuditEntry) withBefore(before interface{}) *AuditEntry {
+	beforeBytes, err := json.Marshal(before)
+	if err == nil && string(beforeBytes) != "null" {
+		entry.Before = beforeBytes
+	}
+	return entry
+}
+
+func (entry *AuditEntry) withComment(comment *Comment) *AuditEntry {
+	entry.DocumentID = comment.DocumentID
+	entry.CommentDate = comment.Date
+	return entry.withBefore(comment)
+}
+
+func recordAudit(tx *bolt.Tx, entry *AuditEntry) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte("audit_log"))
+	if err != nil {
+		return err
+	}
+	sequence, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+	entryBytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(fmt.Sprintf("%015d", sequence)), entryBytes)
+}
+
+type auditFilter struct {
+	Admin      string
+	Action     string
+	DocumentID string
+	From       string
+	To         string
+}
+
+func (filter *auditFilter) matches(entry *AuditEntry, from, to int64) bool {
+	if filter.Admin != "" && entry.Admin != filter.Admin {
+		return false
+	}
+	if filter.Action != "" && !strings.HasPrefix(entry.Action, filter.Action) {
+		return false
+	}
+	if filter.DocumentID != "" && entry.DocumentID != filter.DocumentID {
+		return false
+	}
+	if from != 0 && entry.Date < from {
+		return false
+	}
+	if to != 0 && entry.Date > to {
+		return false
+	}
+	return true
+}
+
+// getAuditLog returns the matching entries, newest first. limit <= 0 means no limit.
+func getAuditLog(tx *bolt.Tx, filter *auditFilter, limit int) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	// the date range was already validated by the caller
+	dateFilter := commentFilter{From: filter.From, To: filter.To}
+	from, to, _ := dateFilter.dateRange()
+	bucket := tx.Bucket([]byte("audit_log"))
+	if bucket == nil {
+		return entries, nil
+	}
+	cursor := bucket.Cursor()
+	for k, v := cursor.Last(); k != nil && (limit <= 0 || len(entries) < limit); k, v = cursor.Prev() {
+		var entry AuditEntry
+		err := json.Unmarshal(v, &entry)
+		if err != nil {
+			return entries, err
+		}
+		if filter.matches(&entry, from, to) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func adminAudit(responseWriter http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	filter := auditFilter{
+		Admin:      strings.TrimSpace(query.Get("admin")),
+		Action:     strings.TrimSpace(query.Get("action")),
+		DocumentID: strings.TrimSpace(query.Get("documentId")),
+		From:       strings.TrimSpace(query.Get("from")),
+		To:         strings.TrimSpace(query.Get("to")),
+	}
+	export := query.Get("format") == "jsonl"
+	limit := 500
+	if export {
+		limit = 0
+	}
+
+	templateData := struct {
+		Filter  auditFilter
+		Entries []AuditEntry
+		Error   string
+	}{
+		Filter: filter,
+	}
+	dateFilter := commentFilter{From: filter.From, To: filter.To}
+	_, _, err := dateFilter.dateRange()
+	if err != nil {
+		templateData.Error = err.Error()
+		templateData.Entries = []AuditEntry{}
+		err = nil
+	} else {
+		err = db.View(func(tx *bolt.Tx) error {
+			var err error
+			templateData.Entries, err = getAuditLog(tx, &filter, limit)
+			return err
+		})
+	}
+	if err != nil {
+		log.Printf("admin audit log page failed: %v\n", err)
+		responseWriter.WriteHeader(500)
+		responseWriter.Write([]byte("500 internal server error"))
+		return
+	}
+
+	if export {
+		responseWriter.Header().Set("Content-Type", "application/x-ndjson")
+		responseWriter.Header().Set(
+			"Content-Disposition",
+			fmt.Sprintf("attachment; filename=\"audit-log-%s.jsonl\"", time.Now().UTC().Format("2006-01-02")),
+		)
+		// oldest first, like the log itself
+		for i := len(templateData.Entries) - 1; i >= 0; i-- {
+			entryBytes, _ := json.Marshal(templateData.Entries[i])
+			responseWriter.Write(entryBytes)
+			responseWriter.Write([]byte("\n"))
+		}
+		return
+	}
+
+	renderAdminTemplate(responseWriter, request, "admin-audit.html.gotemplate", templateData)
+}
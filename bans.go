@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const banTypeIdentity = "identity"
+const banTypeEmail = "email"
+const banTypeIP = "ip"
+
+// Ban prevents someone from posting comments. Value is an AvatarHash, the hashed email address or an IP address / CIDR.
+// a Shadow ban lets them keep posting, but hides their comments from everyone else.
+type Ban struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Value   string `json:"value"`
+	Reason  string `json:"reason,omitempty"`
+	Created int64  `json:"created"`
+	Expires int64  `json:"expires,omitempty"`
+	Shadow  bool   `json:"shadow,omitempty"`
+}
+
+func (ban *Ban) isExpired(now int64) bool {
+	return ban.Expires != 0 && ban.Expires < now
+}
+
+func (ban *Ban) matches(comment *Comment) bool {
+	switch ban.Type {
+	case banTypeIdentity:
+		return comment.AvatarHash != "" && comment.AvatarHash == ban.Value
+	case banTypeEmail:
+		return comment.EmailHash != "" && comment.EmailHash == ban.Value
+	case banTypeIP:
+		ip := net.ParseIP(comment.IPAddress)
+		if ip == nil {
+			return false
+		}
+		if strings.Contains(ban.Value, "/") {
+			_, ipNet, err := net.ParseCIDR(ban.Value)
+			return err == nil && ipNet.Contains(ip)
+		}
+		banIP := net.ParseIP(ban.Value)
+		return banIP != nil && banIP.Equal(ip)
+	}
+	return false
+}
+
+// hashEmail is what gets stored in the ban list and on comments instead of the email address itself
+func hashEmail(email string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%s%s", strings.ToLower(strings.TrimSpace(email)), hashSalt))))
+}
+
+func validateBan(ban *Ban) error {
+	ban.Value = strings.TrimSpace(ban.Value)
+	if ban.Value == "" {
+		return fmt.Errorf("ban value is required")
+	}
+	switch ban.Type {
+	case banTypeIdentity:
+	case banTypeEmail:
+		// admins can paste an email address, which gets hashed before it is stored
+		if strings.Contains(ban.Value, "@") {
+			ban.Value = hashEmail(ban.Value)
+		}
+	case banTypeIP:
+		if strings.Contains(ban.Value, "/") {
+			_, ipNet, err := net.ParseCIDR(ban.Value)
+			if err != nil {
+				return fmt.Errorf("'%s' is not a valid CIDR range", ban.Value)
+			}
+			ban.Value = ipNet.String()
+		} else if net.ParseIP(ban.Value) == nil {
+			return fmt.Errorf("'%s' is not a valid IP address", ban.Value)
+		}
+	default:
+		return fmt.Errorf("unknown ban type '%s'", ban.Type)
+	}
+	ban.ID = fmt.Sprintf("%s:%s", ban.Type, ban.Value)
+	return nil
+}
+
+// addBan is called inside a transaction, the ban must already be validated
+func addBan(tx *bolt.Tx, ban *Ban) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte("bans"))
+	if err != nil {
+		return err
+	}
+	if ban.Created == 0 {
+		ban.Created = getMillisecondsSinceUnixEpoch()
+	}
+	banBytes, err := json.Marshal(ban)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(ban.ID), banBytes)
+}
+
+// getBan returns nil if there is no ban with this id
+func getBan(tx *bolt.Tx, id string) *Ban {
+	bucket := tx.Bucket([]byte("bans"))
+	if bucket == nil {
+		return nil
+	}
+	banBytes := bucket.Get([]byte(id))
+	if banBytes == nil {
+		return nil
+	}
+	var ban Ban
+	if json.Unmarshal(banBytes, &ban) != nil {
+		return nil
+	}
+	return &ban
+}
+
+func removeBan(tx *bolt.Tx, id string) error {
+	bucket := tx.Bucket([]byte("bans"))
+	if bucket == nil {
+		return nil
+	}
+	return bucket.Delete([]byte(id))
+}
+
+func getBans(tx *bolt.Tx) ([]Ban, error) {
+	bans := []Ban{}
+	bucket := tx.Bucket([]byte("bans"))
+	if bucket == nil {
+		return bans, nil
+	}
+	err := bucket.ForEach(func(k, v []byte) error {
+		var ban Ban
+		err := json.Unmarshal(v, &ban)
+		if err != nil {
+			return err
+		}
+		bans = append(bans, ban)
+		return nil
+	})
+	return bans, err
+}
+
+// findBan returns the first ban which applies to the comment, or nil if the author is not banned.
+// a shadow ban is only returned if there is no regular ban which also applies.
+func findBan(comment *Comment) (*Ban, error) {
+	var found *Ban
+	now := getMillisecondsSinceUnixEpoch()
+	err := db.View(func(tx *bolt.Tx) error {
+		bans, err := getBans(tx)
+		if err != nil {
+			return err
+		}
+		for i := range bans {
+			if !bans[i].isExpired(now) && bans[i].matches(comment) {
+				found = &bans[i]
+				if !found.Shadow {
+					return nil
+				}
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+// banAuthor bans every identifying piece of information we have about the author of a comment
+func banAuthor(tx *bolt.Tx, comment *Comment, reason string, expires int64) error {
+	values := map[string]string{
+		banTypeIdentity: comment.AvatarHash,
+		banTypeEmail:    comment.EmailHash,
+		banTypeIP:       comment.IPAddress,
+	}
+	for banType, value := range values {
+		if value == "" {
+			continue
+		}
+		ban := Ban{Type: banType, Value: value, Reason: reason, Expires: expires}
+		err := validateBan(&ban)
+		if err != nil {
+			return err
+		}
+		err = addBan(tx, &ban)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func adminBans(responseWriter http.ResponseWriter, request *http.Request) {
+	templateData := struct {
+		Bans  []Ban
+		Now   int64
+		Error string
+	}{
+		Now: getMillisecondsSinceUnixEpoch(),
+	}
+
+	var err error
+	if request.Method == "POST" {
+		err = request.ParseForm()
+		if err == nil && request.Form.Get("action") == "remove" {
+			id := request.Form.Get("id")
+			err = db.Update(func(tx *bolt.Tx) error {
+				auditEntry := newAuditEntry(request, auditActionBanRemove).withBefore(getBan(tx, id))
+				auditEntry.Target = id
+				err := removeBan(tx, id)
+				if err != nil {
+					return err
+				}
+				return recordAudit(tx, auditEntry)
+			})
+			if err == nil {
+				log.Printf("admin: removed ban %s\n", id)
+			}
+		} else if err == nil {
+			ban := Ban{
+				Type:   request.Form.Get("type"),
+				Value:  request.Form.Get("value"),
+				Reason: request.Form.Get("reason"),
+				Shadow: request.Form.Get("shadow") != "",
+			}
+			if days := request.Form.Get("days"); days != "" {
+				daysInt, parseErr := strconv.Atoi(days)
+				if parseErr != nil || daysInt < 0 {
+					templateData.Error = fmt.Sprintf("'%s' is not a valid number of days", days)
+				} else if daysInt > 0 {
+					ban.Expires = time.Now().Add(time.Hour*24*time.Duration(daysInt)).UnixNano() / int64(time.Millisecond)
+				}
+			}
+			if templateData.Error == "" {
+				validationErr := validateBan(&ban)
+				if validationErr != nil {
+					templateData.Error = validationErr.Error()
+				} else {
+					err = db.Update(func(tx *bolt.Tx) error {
+						auditEntry := newAuditEntry(request, auditActionBanAdd).withBefore(getBan(tx, ban.ID))
+						auditEntry.Target = ban.ID
+						auditEntry.Details = ban.Reason
+						err := addBan(tx, &ban)
+						if err != nil {
+							return err
+						}
+						return recordAudit(tx, auditEntry)
+					})
+					if err == nil {
+						log.Printf("admin: added ban %s\n", ban.ID)
+					}
+				}
+			}
+		}
+	}
+
+	if err == nil {
+		err = db.View(func(tx *bolt.Tx) error {
+			templateData.Bans, err = getBans(tx)
+			return err
+		})
+	}
+	if err != nil {
+		log.Printf("admin bans page failed: %v\n", err)
+		responseWriter.WriteHeader(500)
+		responseWriter.Write([]byte("500 internal server error"))
+		return
+	}
+
+	sort.Slice(templateData.Bans, func(i, j int) bool {
+		return templateData.Bans[i].Created > templateData.Bans[j].Created
+	})
+
+	renderAdminTemplate(responseWriter, request, "admin-bans.html.gotemplate", templateData)
+}
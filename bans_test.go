@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestBanMatches(t *testing.T) {
+	hashSalt = "test salt"
+	tests := []struct {
+		banType string
+		value   string
+		comment Comment
+		matches bool
+	}{
+		{banTypeIdentity, "abc123", Comment{AvatarHash: "abc123"}, true},
+		{banTypeIdentity, "abc123", Comment{AvatarHash: "def456"}, false},
+		{banTypeIdentity, "abc123", Comment{}, false},
+		{banTypeEmail, "Spammer@Example.com ", Comment{EmailHash: hashEmail("spammer@example.com")}, true},
+		{banTypeEmail, "spammer@example.com", Comment{EmailHash: hashEmail("someone@example.com")}, false},
+		{banTypeEmail, hashEmail("spammer@example.com"), Comment{EmailHash: hashEmail("SPAMMER@example.com")}, true},
+		{banTypeIP, "203.0.113.7", Comment{IPAddress: "203.0.113.7"}, true},
+		{banTypeIP, "203.0.113.7", Comment{IPAddress: "203.0.113.8"}, false},
+		{banTypeIP, "203.0.113.0/24", Comment{IPAddress: "203.0.113.200"}, true},
+		{banTypeIP, "203.0.113.77/24", Comment{IPAddress: "203.0.113.1"}, true},
+		{banTypeIP, "203.0.113.0/24", Comment{IPAddress: "203.0.114.1"}, false},
+		{banTypeIP, "203.0.113.0/24", Comment{IPAddress: "::ffff:203.0.113.5"}, true},
+		{banTypeIP, "203.0.113.0/24", Comment{IPAddress: "not an ip"}, false},
+		{banTypeIP, "203.0.113.0/24", Comment{}, false},
+		{banTypeIP, "2001:db8::1", Comment{IPAddress: "2001:db8:0:0:0:0:0:1"}, true},
+		{banTypeIP, "2001:db8::1", Comment{IPAddress: "2001:db8::2"}, false},
+		{banTypeIP, "2001:db8:abcd::/48", Comment{IPAddress: "2001:db8:abcd:12::1"}, true},
+		{banTypeIP, "2001:db8:abcd::/48", Comment{IPAddress: "2001:db8:abce::1"}, false},
+		{banTypeIP, "2001:db8:abcd::/48", Comment{IPAddress: "203.0.113.5"}, false},
+	}
+	for _, test := range tests {
+		ban := Ban{Type: test.banType, Value: test.value}
+		err := validateBan(&ban)
+		if err != nil {
+			t.Errorf("validateBan(%s, %q) failed: %v", test.banType, test.value, err)
+			continue
+		}
+		if got := ban.matches(&test.comment); got != test.matches {
+			t.Errorf("%s ban %q on %+v: expected %t, got %t", test.banType, test.value, test.comment, test.matches, got)
+		}
+	}
+}
+
+func TestValidateBan(t *testing.T) {
+	tests := []struct {
+		banType string
+		value   string
+		id      string
+		valid   bool
+	}{
+		{banTypeIP, "203.0.113.77/24", "ip:203.0.113.0/24", true},
+		{banTypeIP, " 2001:db8::1 ", "ip:2001:db8::1", true},
+		{banTypeIP, "2001:db8:abcd:1::/48", "ip:2001:db8:abcd::/48", true},
+		{banTypeIP, "203.0.113.0/33", "", false},
+		{banTypeIP, "example.com", "", false},
+		{banTypeIdentity, "abc123", "identity:abc123", true},
+		{banTypeIdentity, "  ", "", false},
+		{"username", "bob", "", false},
+	}
+	for _, test := range tests {
+		ban := Ban{Type: test.banType, Value: test.value}
+		err := validateBan(&ban)
+		if (err == nil) != test.valid {
+			t.Errorf("validateBan(%s, %q): expected valid=%t, got %v", test.banType, test.value, test.valid, err)
+		}
+		if err == nil && ban.ID != test.id {
+			t.Errorf("validateBan(%s, %q): expected the id %s, got %s", test.banType, test.value, test.id, ban.ID)
+		}
+	}
+}
+
+func TestFindBan(t *testing.T) {
+	db = openTestDB(t)
+	now := getMillisecondsSinceUnixEpoch()
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, ban := range []Ban{
+			{Type: banTypeIP, Value: "198.51.100.0/24"},
+			{Type: banTypeIP, Value: "2001:db8::/32", Expires: now - 1000},
+			{Type: banTypeIdentity, Value: "abc123", Expires: now + 60000},
+		} {
+			if err := validateBan(&ban); err != nil {
+				return err
+			}
+			if err := addBan(tx, &ban); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		comment Comment
+		banID   string
+	}{
+		{Comment{IPAddress: "198.51.100.23"}, "ip:198.51.100.0/24"},
+		{Comment{IPAddress: "2001:db8::5"}, ""},
+		{Comment{IPAddress: "192.0.2.1", AvatarHash: "abc123"}, "identity:abc123"},
+		{Comment{IPAddress: "192.0.2.1", AvatarHash: "def456"}, ""},
+	}
+	for _, test := range tests {
+		ban, err := findBan(&test.comment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		banID := ""
+		if ban != nil {
+			banID = ban.ID
+		}
+		if banID != test.banID {
+			t.Errorf("findBan(%+v): expected '%s', got '%s'", test.comment, test.banID, banID)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+	"github.com/boltdb/bolt"
+)
+
+// naive bayes spam classifier which is trained every time an admin approves a comment or marks it as spam.
+// every decision is also kept in the bayes_training bucket so the model can be rebuilt from scratch.
+
+const bayesLabelSpam = "spam"
+const bayesLabelHam = "ham"
+
+// the classifier won't say anything until it has seen at least this many of both spam and ham comments
+const bayesMinimumTrainingComments = 5
+
+// how many of the most "interesting" tokens are used to classify a comment
+const bayesInterestingTokens = 15
+
+var bayesScoreString = "$COMMENTS_BAYES_SCORE"
+var bayesScore float64
+
+var bayesTokenRegexp = regexp.MustCompile(`[\p{L}\p{N}'$-]+`)
+var bayesDomainRegexp = regexp.MustCompile(`(?i)https?://([^/\s)"'>]+)`)
+
+type bayesTokenCounts struct {
+	Spam int `json:"spam"`
+	Ham  int `json:"ham"`
+}
+
+type bayesTrainingSample struct {
+	Label      string `json:"label"`
+	Username   string `json:"username"`
+	Body       string `json:"body"`
+	DocumentID string `json:"documentId"`
+	Date       int64  `json:"date"`
+}
+
+type bayesToken struct {
+	Token       string
+	Spam        int
+	Ham         int
+	Probability float64
+}
+
+func initBayes() {
+	bayesScoreString = os.ExpandEnv(bayesScoreString)
+	bayesScore = spamQueueThreshold * 2
+	if bayesScoreString != "" {
+		var err error
+		bayesScore, err = strconv.ParseFloat(bayesScoreString, 64)
+		if err != nil {
+			panic(errors.Wrapf(err, "can't parse COMMENTS_BAYES_SCORE '%s' as a number", bayesScoreString))
+		}
+	}
+}
+
+func bayesTokenize(username, body string) []string {
+	unique := map[string]bool{}
+	for _, token := range bayesTokenRegexp.FindAllString(strings.ToLower(body), -1) {
+		if len(token) > 1 && len(token) < 40 {
+			unique[token] = true
+		}
+	}
+	for _, match := range bayesDomainRegexp.FindAllStringSubmatch(body, -1) {
+		unique[fmt.Sprintf("domain:%s", strings.ToLower(match[1]))] = true
+	}
+	if username != "" {
+		unique[fmt.Sprintf("username:%s", strings.ToLower(username))] = true
+	}
+	tokens := []string{}
+	for token := range unique {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+// trainBayes is called inside the transaction where an admin made a moderation decision about a comment.
+// if the comment was already trained with the opposite label, the old training is undone first.
+func trainBayes(tx *bolt.Tx, comment *Comment, label string) error {
+	trainingBucket, err := tx.CreateBucketIfNotExists([]byte("bayes_training"))
+	if err != nil {
+		return err
+	}
+	key := commentKey(comment.DocumentID, comment.Date)
+	previousBytes := trainingBucket.Get(key)
+	if previousBytes != nil {
+		var previous bayesTrainingSample
+		err = json.Unmarshal(previousBytes, &previous)
+		if err != nil {
+			return err
+		}
+		if previous.Label == label {
+			return nil
+		}
+		err = bayesAddSample(tx, &previous, -1)
+		if err != nil {
+			return err
+		}
+	}
+
+	sample := bayesTrainingSample{
+		Label:      label,
+		Username:   comment.Username,
+		Body:       comment.Body,
+		DocumentID: comment.DocumentID,
+		Date:       comment.Date,
+	}
+	sampleBytes, err := json.Marshal(sample)
+	if err != nil {
+		return err
+	}
+	err = trainingBucket.Put(key, sampleBytes)
+	if err != nil {
+		return err
+	}
+	return bayesAddSample(tx, &sample, 1)
+}
+
+// bayesAddSample adds (delta = 1) or removes (delta = -1) a sample from the token counts
+func bayesAddSample(tx *bolt.Tx, sample *bayesTrainingSample, delta int) error {
+	tokensBucket, err := tx.CreateBucketIfNotExists([]byte("bayes_tokens"))
+	if err != nil {
+		return err
+	}
+	metaBucket, err := tx.CreateBucketIfNotExists([]byte("bayes_meta"))
+	if err != nil {
+		return err
+	}
+
+	for _, token := range bayesTokenize(sample.Username, sample.Body) {
+		var counts bayesTokenCounts
+		countsBytes := tokensBucket.Get([]byte(token))
+		if countsBytes != nil {
+			err = json.Unmarshal(countsBytes, &counts)
+			if err != nil {
+				return err
+			}
+		}
+		if sample.Label == bayesLabelSpam {
+			counts.Spam = maxInt(0, counts.Spam+delta)
+		} else {
+			counts.Ham = maxInt(0, counts.Ham+delta)
+		}
+		if counts.Spam == 0 && counts.Ham == 0 {
+			err = tokensBucket.Delete([]byte(token))
+		} else {
+			countsBytes, err = json.Marshal(counts)
+			if err == nil {
+				err = tokensBucket.Put([]byte(token), countsBytes)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	metaKey := []byte(fmt.Sprintf("%s_comments", sample.Label))
+	count, _ := strconv.Atoi(string(metaBucket.Get(metaKey)))
+	return metaBucket.Put(metaKey, []byte(strconv.Itoa(maxInt(0, count+delta))))
+}
+
+func getBayesTrainingCounts(tx *bolt.Tx) (int, int) {
+	metaBucket := tx.Bucket([]byte("bayes_meta"))
+	if metaBucket == nil {
+		return 0, 0
+	}
+	spamComments, _ := strconv.Atoi(string(metaBucket.Get([]byte("spam_comments"))))
+	hamComments, _ := strconv.Atoi(string(metaBucket.Get([]byte("ham_comments"))))
+	return spamComments, hamComments
+}
+
+// bayesTokenProbability is the probability that a comment containing this token is spam,
+// smoothed towards 0.5 for tokens that have not been seen very often (Robinson's method)
+func bayesTokenProbability(counts bayesTokenCounts, spamComments, hamComments int) float64 {
+	spamFrequency := float64(counts.Spam) / float64(maxInt(1, spamComments))
+	hamFrequency := float64(counts.Ham) / float64(maxInt(1, hamComments))
+	probability := 0.5
+	if spamFrequency+hamFrequency > 0 {
+		probability = spamFrequency / (spamFrequency + hamFrequency)
+	}
+	seen := float64(counts.Spam + counts.Ham)
+	const strength = 1.0
+	return (strength*0.5 + seen*probability) / (strength + seen)
+}
+
+// classifyBayes returns the probability that the comment is spam, or -1 if the classifier is not trained enough yet
+func classifyBayes(comment *Comment) (float64, error) {
+	probability := float64(-1)
+	err := db.View(func(tx *bolt.Tx) error {
+		spamComments, hamComments := getBayesTrainingCounts(tx)
+		tokensBucket := tx.Bucket([]byte("bayes_tokens"))
+		if tokensBucket == nil || spamComments < bayesMinimumTrainingComments || hamComments < bayesMinimumTrainingComments {
+			return nil
+		}
+
+		tokenProbabilities := []float64{}
+		for _, token := range bayesTokenize(comment.Username, comment.Body) {
+			countsBytes := tokensBucket.Get([]byte(token))
+			if countsBytes == nil {
+				continue
+			}
+			var counts bayesTokenCounts
+			err := json.Unmarshal(countsBytes, &counts)
+			if err != nil {
+				return err
+			}
+			tokenProbabilities = append(tokenProbabilities, bayesTokenProbability(counts, spamComments, hamComments))
+		}
+
+		sort.Slice(tokenProbabilities, func(i, j int) bool {
+			return math.Abs(tokenProbabilities[i]-0.5) > math.Abs(tokenProbabilities[j]-0.5)
+		})
+		if len(tokenProbabilities) > bayesInterestingTokens {
+			tokenProbabilities = tokenProbabilities[:bayesInterestingTokens]
+		}
+
+		// combine the probabilities in log space so we don't underflow
+		logSpam := float64(0)
+		logHam := float64(0)
+		for _, p := range tokenProbabilities {
+			p = math.Min(math.Max(p, 0.01), 0.99)
+			logSpam += math.Log(p)
+			logHam += math.Log(1 - p)
+		}
+		probability = 1 / (1 + math.Exp(logHam-logSpam))
+		return nil
+	})
+	return probability, err
+}
+
+func checkSpamBayes(comment *Comment) (float64, string) {
+	probability, err := classifyBayes(comment)
+	if err != nil {
+		log.Printf("bayes classifier failed: %v\n", err)
+		return 0, ""
+	}
+	comment.SpamProbability = probability
+	if probability <= 0.5 {
+		return 0, ""
+	}
+	return bayesScore * (probability - 0.5) * 2, fmt.Sprintf("spam probability %.0f%%", probability*100)
+}
+
+// retrainBayes throws away the token counts and rebuilds them from the bayes_training history
+func retrainBayes(auditEntry *AuditEntry) (int, error) {
+	trained := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"bayes_tokens", "bayes_meta"} {
+			if tx.Bucket([]byte(name)) != nil {
+				err := tx.DeleteBucket([]byte(name))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		trainingBucket := tx.Bucket([]byte("bayes_training"))
+		if trainingBucket != nil {
+			err := trainingBucket.ForEach(func(k, v []byte) error {
+				var sample bayesTrainingSample
+				err := json.Unmarshal(v, &sample)
+				if err != nil {
+					return err
+				}
+				trained++
+				return bayesAddSample(tx, &sample, 1)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		auditEntry.Details = fmt.Sprintf("retrained from %d comments", trained)
+		return recordAudit(tx, auditEntry)
+	})
+	return trained, err
+}
+
+// getBayesTopTokens returns the tokens which are most indicative of spam and of ham
+func getBayesTopTokens(limit int) ([]bayesToken, []bayesToken, int, int, error) {
+	tokens := []bayesToken{}
+	var spamComments, hamComments int
+	err := db.View(func(tx *bolt.Tx) error {
+		spamComments, hamComments = getBayesTrainingCounts(tx)
+		tokensBucket := tx.Bucket([]byte("bayes_tokens"))
+		if tokensBucket == nil {
+			return nil
+		}
+		return tokensBucket.ForEach(func(k, v []byte) error {
+			var counts bayesTokenCounts
+			err := json.Unmarshal(v, &counts)
+			if err != nil {
+				return err
+			}
+			// tokens which were only seen once don't tell us much
+			if counts.Spam+counts.Ham < 2 {
+				return nil
+			}
+			tokens = append(tokens, bayesToken{
+				Token:       string(k),
+				Spam:        counts.Spam,
+				Ham:         counts.Ham,
+				Probability: bayesTokenProbability(counts, spamComments, hamComments),
+			})
+			return nil
+		})
+	})
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Probability > tokens[j].Probability
+	})
+	spamTokens := []bayesToken{}
+	hamTokens := []bayesToken{}
+	for i := 0; i < len(tokens) && i < limit && tokens[i].Probability > 0.5; i++ {
+		spamTokens = append(spamTokens, tokens[i])
+	}
+	for i := len(tokens) - 1; i >= 0 && len(tokens)-1-i < limit && tokens[i].Probability < 0.5; i-- {
+		hamTokens = append(hamTokens, tokens[i])
+	}
+	return spamTokens, hamTokens, spamComments, hamComments, err
+}
+
+func adminBayes(responseWriter http.ResponseWriter, request *http.Request) {
+	templateData := struct {
+		SpamComments int
+		HamComments  int
+		Minimum      int
+		SpamTokens   []bayesToken
+		HamTokens    []bayesToken
+		Message      string
+	}{
+		Minimum: bayesMinimumTrainingComments,
+	}
+
+	if request.Method == "POST" {
+		trained, err := retrainBayes(newAuditEntry(request, auditActionBayesRetrain))
+		if err != nil {
+			log.Printf("failed to retrain bayes classifier: %v\n", err)
+			responseWriter.WriteHeader(500)
+			responseWriter.Write([]byte("500 internal server error"))
+			return
+		}
+		log.Printf("admin: retrained bayes classifier from %d comments\n", trained)
+		templateData.Message = fmt.Sprintf("retrained from %d moderation decisions", trained)
+	}
+
+	var err error
+	templateData.SpamTokens, templateData.HamTokens, templateData.SpamComments, templateData.HamComments, err = getBayesTopTokens(50)
+	if err != nil {
+		log.Printf("failed to read bayes tokens: %v\n", err)
+		responseWriter.WriteHeader(500)
+		responseWriter.Write([]byte("500 internal server error"))
+		return
+	}
+
+	renderAdminTemplate(responseWriter, request, "admin-bayes.html.gotemplate", templateData)
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// commentFilter selects comments across all documents for the admin bulk actions page
+type commentFilter struct {
+	AvatarHash string
+	Username   string
+	Email      string
+	From       string
+	To         string
+}
+
+func (filter *commentFilter) isEmpty() bool {
+	return filter.AvatarHash == "" && filter.Username == "" && filter.Email == "" && filter.From == "" && filter.To == ""
+}
+
+// dateRange parses From and To (YYYY-MM-DD, both inclusive) into milliseconds since the unix epoch
+func (filter *commentFilter) dateRange() (int64, int64, error) {
+	from := int64(0)
+	to := int64(0)
+	if filter.From != "" {
+		fromTime, err := time.Parse("2006-01-02", filter.From)
+		if err != nil {
+			return 0, 0, fmt.Errorf("'%s' is not a valid date, expected YYYY-MM-DD", filter.From)
+		}
+		from = fromTime.UnixNano() / int64(time.Millisecond)
+	}
+	if filter.To != "" {
+		toTime, err := time.Parse("2006-01-02", filter.To)
+		if err != nil {
+			return 0, 0, fmt.Errorf("'%s' is not a valid date, expected YYYY-MM-DD", filter.To)
+		}
+		to = toTime.Add(time.Hour*24).UnixNano()/int64(time.Millisecond) - 1
+	}
+	return from, to, nil
+}
+
+func (filter *commentFilter) matches(comment *Comment, from, to int64) bool {
+	if filter.AvatarHash != "" && comment.AvatarHash != filter.AvatarHash {
+		return false
+	}
+	if filter.Username != "" && !strings.Contains(strings.ToLower(comment.Username), strings.ToLower(filter.Username)) {
+		return false
+	}
+	if filter.Email != "" && comment.Email != strings.ToLower(filter.Email) && comment.EmailHash != hashEmail(filter.Email) {
+		return false
+	}
+	if from != 0 && comment.Date < from {
+		return false
+	}
+	if to != 0 && comment.Date > to {
+		return false
+	}
+	return true
+}
+
+// findComments returns every comment in every document which matches the filter
+func findComments(tx *bolt.Tx, filter *commentFilter) ([]Comment, error) {
+	found := []Comment{}
+	from, to, err := filter.dateRange()
+	if err != nil {
+		return found, err
+	}
+	index := tx.Bucket([]byte("posts_index"))
+	if index == nil {
+		return found, nil
+	}
+	err = index.ForEach(func(postID, v []byte) error {
+		bucket := tx.Bucket([]byte(fmt.Sprintf("posts/%s", string(postID))))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var comment Comment
+			err := json.Unmarshal(v, &comment)
+			if err != nil {
+				return err
+			}
+			if filter.matches(&comment, from, to) {
+				found = append(found, comment)
+			}
+			return nil
+		})
+	})
+	return found, err
+}
+
+func adminBulk(responseWriter http.ResponseWriter, request *http.Request) {
+	err := request.ParseForm()
+	if err != nil {
+		responseWriter.WriteHeader(400)
+		responseWriter.Write([]byte("400 bad request"))
+		return
+	}
+
+	filter := commentFilter{
+		AvatarHash: strings.TrimSpace(request.Form.Get("avatarHash")),
+		Username:   strings.TrimSpace(request.Form.Get("username")),
+		Email:      strings.TrimSpace(request.Form.Get("email")),
+		From:       strings.TrimSpace(request.Form.Get("from")),
+		To:         strings.TrimSpace(request.Form.Get("to")),
+	}
+	templateData := struct {
+		Filter   commentFilter
+		Comments []Comment
+		Action   string
+		Confirm  []Comment
+		Summary  []string
+		Error    string
+	}{
+		Filter:   filter,
+		Comments: []Comment{},
+	}
+
+	if request.Method == "POST" {
+		action := request.Form.Get("action")
+		keys := request.Form["comment"]
+		if action != moderationActionDelete && action != moderationActionApprove && action != moderationActionBan {
+			templateData.Error = fmt.Sprintf("unknown action '%s'", action)
+		} else if len(keys) == 0 {
+			templateData.Error = "no comments were selected"
+		} else if request.Form.Get("confirm") != "yes" {
+			// show what is about to happen before doing it
+			templateData.Action = action
+			err = db.View(func(tx *bolt.Tx) error {
+				for _, key := range keys {
+					postID, date, err := parseCommentKey(key)
+					if err != nil {
+						return err
+					}
+					comment, err := getComment(tx, postID, date)
+					if err == nil {
+						templateData.Confirm = append(templateData.Confirm, *comment)
+					}
+				}
+				return nil
+			})
+		} else {
+			templateData.Summary, err = executeBulkAction(request, action, keys)
+		}
+	}
+
+	if err == nil && templateData.Confirm == nil && !filter.isEmpty() {
+		err = db.View(func(tx *bolt.Tx) error {
+			var findErr error
+			templateData.Comments, findErr = findComments(tx, &filter)
+			if findErr != nil {
+				templateData.Error = findErr.Error()
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		log.Printf("admin bulk actions page failed: %v\n", err)
+		responseWriter.WriteHeader(500)
+		responseWriter.Write([]byte("500 internal server error"))
+		return
+	}
+
+	renderAdminTemplate(responseWriter, request, "admin-bulk.html.gotemplate", templateData)
+}
+
+// executeBulkAction moderates all of the comments in a single transaction, so either all of them are moderated or none are
+func executeBulkAction(request *http.Request, action string, keys []string) ([]string, error) {
+	moderated := []*Comment{}
+	summary := []string{}
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, key := range keys {
+			postID, date, err := parseCommentKey(key)
+			if err != nil {
+				return err
+			}
+			comment, err := moderateComment(tx, postID, date, action)
+			if err == errCommentNotFound || err == errBucketNotFound {
+				summary = append(summary, fmt.Sprintf("%s: comment not found, skipped", key))
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			auditEntry := newAuditEntry(request, commentAuditAction(action)).withComment(comment)
+			auditEntry.Details = "bulk"
+			err = recordAudit(tx, auditEntry)
+			if err != nil {
+				return err
+			}
+			moderated = append(moderated, comment)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, comment := range moderated {
+		log.Printf("admin: bulk %s comment %s_%d\n", action, comment.DocumentID, comment.Date)
+		afterModeration(comment, action)
+	}
+	summary = append([]string{fmt.Sprintf("%s: %d comments", action, len(moderated))}, summary...)
+	return summary, nil
+}
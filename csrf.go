@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+)
+
+// every admin form which changes something carries a CSRF token. the token is derived from the session cookie,
+// so it does not need to be stored, and it stops working when the session ends.
+const csrfFormField = "csrf"
+
+func csrfToken(request *http.Request) string {
+	cookie, err := request.Cookie(adminSessionCookie)
+	if err != nil || cookie.Value == "" {
+		return ""
+	}
+	return fmt.Sprintf("%x", serverSignature("csrf", cookie.Value))
+}
+
+// csrfField is available as {{ csrfField }} in the admin templates, it goes inside every POST form
+func csrfField(request *http.Request) template.HTML {
+	token := csrfToken(request)
+	if token == "" {
+		return ""
+	}
+	return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s"/>`, csrfFormField, token))
+}
+
+func validCSRFToken(request *http.Request) bool {
+	token := csrfToken(request)
+	if token == "" || request.ParseForm() != nil {
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(request.PostForm.Get(csrfFormField)))
+}
+
+// checkSameOrigin rejects requests which were sent from another site. browsers send the Origin header with every POST,
+// older ones only send the Referer. requests with neither are rejected too.
+func checkSameOrigin(request *http.Request) error {
+	if request.Header.Get("Sec-Fetch-Site") == "cross-site" {
+		return fmt.Errorf("Sec-Fetch-Site is cross-site")
+	}
+	origin := request.Header.Get("Origin")
+	if origin == "" {
+		origin = request.Header.Get("Referer")
+	}
+	if origin == "" {
+		return fmt.Errorf("the request has no Origin or Referer header")
+	}
+	originURL, err := url.Parse(origin)
+	if err != nil || originURL.Host == "" {
+		return fmt.Errorf("the Origin or Referer '%s' is not a URL", origin)
+	}
+	if originURL.Host == request.Host {
+		return nil
+	}
+	// behind a reverse proxy, the Host header may not be the public host name
+	commentsURL, err := url.Parse(siteForRequest(request).URL)
+	if err == nil && commentsURL.Host != "" && originURL.Scheme == commentsURL.Scheme && originURL.Host == commentsURL.Host {
+		return nil
+	}
+	return fmt.Errorf("the Origin or Referer '%s' is not this site", origin)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCSRFToken(t *testing.T) {
+	serverSecret = []byte("test secret")
+	request := httptest.NewRequest("POST", "/admin/", nil)
+	if token := csrfToken(request); token != "" {
+		t.Errorf("a request without a session should not get a CSRF token, got %s", token)
+	}
+
+	request.Header.Set("Cookie", adminSessionCookie+"=session-a")
+	token := csrfToken(request)
+	if token == "" {
+		t.Fatal("a request with a session should get a CSRF token")
+	}
+
+	other := httptest.NewRequest("POST", "/admin/", nil)
+	other.Header.Set("Cookie", adminSessionCookie+"=session-b")
+	if csrfToken(other) == token {
+		t.Error("every session should get its own CSRF token")
+	}
+
+	serverSecret = []byte("another secret")
+	if csrfToken(request) == token {
+		t.Error("the CSRF token should depend on the server secret")
+	}
+}
+
+func TestValidCSRFToken(t *testing.T) {
+	serverSecret = []byte("test secret")
+	session := httptest.NewRequest("POST", "/admin/", nil)
+	session.Header.Set("Cookie", adminSessionCookie+"=session-a")
+	token := csrfToken(session)
+
+	tests := []struct {
+		name   string
+		cookie string
+		form   string
+		valid  bool
+	}{
+		{"right token", "session-a", "csrf=" + token, true},
+		{"no token", "session-a", "action=delete", false},
+		{"wrong token", "session-a", "csrf=" + strings.Repeat("0", len(token)), false},
+		{"token of another session", "session-b", "csrf=" + token, false},
+		{"no session", "", "csrf=" + token, false},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("POST", "/admin/", strings.NewReader(test.form))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.cookie != "" {
+			request.Header.Set("Cookie", adminSessionCookie+"="+test.cookie)
+		}
+		if got := validCSRFToken(request); got != test.valid {
+			t.Errorf("%s: expected %t, got %t", test.name, test.valid, got)
+		}
+	}
+}
+
+func TestCheckSameOrigin(t *testing.T) {
+	defaultSite = &Site{URL: "https://comments.example.com"}
+	tests := []struct {
+		name    string
+		host    string
+		headers map[string]string
+		allowed bool
+	}{
+		{"same origin", "comments.example.com", map[string]string{"Origin": "https://comments.example.com"}, true},
+		{"referer only", "comments.example.com", map[string]string{"Referer": "https://comments.example.com/admin/"}, true},
+		{"behind a proxy", "127.0.0.1:2370", map[string]string{"Origin": "https://comments.example.com"}, true},
+		{"other site", "comments.example.com", map[string]string{"Origin": "https://evil.example"}, false},
+		{"no headers", "comments.example.com", map[string]string{}, false},
+		{"cross-site fetch", "comments.example.com", map[string]string{"Origin": "https://comments.example.com", "Sec-Fetch-Site": "cross-site"}, false},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("POST", "/admin/", nil)
+		request.Host = test.host
+		for name, value := range test.headers {
+			request.Header.Set(name, value)
+		}
+		if err := checkSameOrigin(request); (err == nil) != test.allowed {
+			t.Errorf("%s: expected allowed=%t, got %v", test.name, test.allowed, err)
+		}
+	}
+}
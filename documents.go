@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+	"github.com/boltdb/bolt"
+)
+
+// open documents accept new comments, closed documents don't, and archived documents are read-only:
+// no new comments, no flags and no notifications.
+const documentStateOpen = "open"
+const documentStateClosed = "closed"
+const documentStateArchived = "archived"
+
+var errDocumentArchived = errors.New("document is archived")
+
+var autoCloseDaysString = "$COMMENTS_AUTO_CLOSE_DAYS"
+var autoCloseDays = 0
+
+// DocumentSettings are set by the admin for a single document. an empty State means the document is
+// open until it is automatically closed COMMENTS_AUTO_CLOSE_DAYS after the first comment.
+// PinnedComment is the Date of the comment which is returned first.
+type DocumentSettings struct {
+	State         string `json:"state,omitempty"`
+	PinnedComment int64  `json:"pinnedComment,omitempty"`
+}
+
+func initDocuments() {
+	autoCloseDaysString = os.ExpandEnv(autoCloseDaysString)
+	if autoCloseDaysString != "" {
+		var err error
+		autoCloseDays, err = strconv.Atoi(autoCloseDaysString)
+		if err != nil {
+			panic(errors.Wrapf(err, "can't parse COMMENTS_AUTO_CLOSE_DAYS '%s' as int", autoCloseDaysString))
+		}
+	}
+}
+
+func getDocumentSettings(tx *bolt.Tx, postID string) (DocumentSettings, error) {
+	var settings DocumentSettings
+	bucket := tx.Bucket([]byte("document_settings"))
+	if bucket == nil {
+		return settings, nil
+	}
+	settingsBytes := bucket.Get([]byte(postID))
+	if settingsBytes == nil {
+		return settings, nil
+	}
+	err := json.Unmarshal(settingsBytes, &settings)
+	return settings, err
+}
+
+func putDocumentSettings(tx *bolt.Tx, postID string, settings DocumentSettings) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte("document_settings"))
+	if err != nil {
+		return err
+	}
+	settingsBytes, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(postID), settingsBytes)
+}
+
+// getDocumentState returns the effective state of the document, taking COMMENTS_AUTO_CLOSE_DAYS into account
+func getDocumentState(tx *bolt.Tx, postID string) (string, error) {
+	settings, err := getDocumentSettings(tx, postID)
+	if err != nil {
+		return "", err
+	}
+	if settings.State != "" {
+		return settings.State, nil
+	}
+	if autoCloseDays > 0 {
+		bucket := tx.Bucket([]byte(fmt.Sprintf("posts/%s", postID)))
+		if bucket != nil {
+			firstKey, _ := bucket.Cursor().First()
+			firstCommentDate, err := strconv.ParseInt(string(firstKey), 10, 64)
+			closeDate := time.Unix(firstCommentDate/1000, 0).Add(time.Hour * 24 * time.Duration(autoCloseDays))
+			if err == nil && time.Now().After(closeDate) {
+				return documentStateClosed, nil
+			}
+		}
+	}
+	return documentStateOpen, nil
+}
+
+func validDocumentState(state string) bool {
+	return state == "" || state == documentStateOpen || state == documentStateClosed || state == documentStateArchived
+}
+
+// adminSetDocumentState handles the documentState form on the admin page of a document
+func adminSetDocumentState(request *http.Request, postID string) error {
+	state := request.Form.Get("documentState")
+	if !validDocumentState(state) {
+		return fmt.Errorf("invalid document state '%s'", state)
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		settings, err := getDocumentSettings(tx, postID)
+		if err != nil {
+			return err
+		}
+		auditEntry := newAuditEntry(request, auditActionDocumentState).withBefore(settings)
+		auditEntry.DocumentID = postID
+		auditEntry.Details = state
+		settings.State = state
+		err = putDocumentSettings(tx, postID, settings)
+		if err != nil {
+			return err
+		}
+		return recordAudit(tx, auditEntry)
+	})
+	if err == nil {
+		log.Printf("admin: set state of %s to '%s'\n", postID, state)
+	}
+	return err
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+	"github.com/boltdb/bolt"
+)
+
+const auditActionCommentEdit = "comment.edit"
+
+const redactedText = "[redacted]"
+
+var errEmptyEdit = errors.New("the comment body can't be empty")
+
+// CommentEdit is the username and body of a comment before an admin edited it. the edit history is kept in the
+// comment_edits bucket, keyed by commentKey, so it is only ever visible to admins.
+type CommentEdit struct {
+	Date     int64  `json:"date"`
+	Admin    string `json:"admin"`
+	Username string `json:"username"`
+	Body     string `json:"body"`
+}
+
+// redact replaces every occurrence of span in text with [redacted]
+func redact(text, span string) string {
+	if strings.TrimSpace(span) == "" {
+		return text
+	}
+	return strings.ReplaceAll(text, span, redactedText)
+}
+
+func getCommentEdits(tx *bolt.Tx, postID string, date int64) ([]CommentEdit, error) {
+	edits := []CommentEdit{}
+	bucket := tx.Bucket([]byte("comment_edits"))
+	if bucket == nil {
+		return edits, nil
+	}
+	editsBytes := bucket.Get(commentKey(postID, date))
+	if editsBytes == nil {
+		return edits, nil
+	}
+	err := json.Unmarshal(editsBytes, &edits)
+	return edits, err
+}
+
+func deleteCommentEdits(tx *bolt.Tx, postID string, date int64) error {
+	bucket := tx.Bucket([]byte("comment_edits"))
+	if bucket == nil {
+		return nil
+	}
+	return bucket.Delete(commentKey(postID, date))
+}
+
+// editComment replaces the username and body of a comment, after redacting the given span from both of them.
+// the previous version goes into the edit history. it returns the comment as it was before the edit,
+// or nil if nothing changed.
+func editComment(tx *bolt.Tx, request *http.Request, postID string, date int64, username, body, redactSpan string) (*Comment, error) {
+	comment, err := getComment(tx, postID, date)
+	if err != nil {
+		return nil, err
+	}
+	username = redact(strings.TrimSpace(username), redactSpan)
+	body = redact(body, redactSpan)
+	if regexp.MustCompile(`^[\s\t\n\r]*$`).MatchString(body) {
+		return nil, errEmptyEdit
+	}
+	if username == comment.Username && body == comment.Body {
+		return nil, nil
+	}
+
+	before := *comment
+	auditEntry := newAuditEntry(request, auditActionCommentEdit).withComment(&before)
+	if redactSpan != "" {
+		auditEntry.Details = "redacted"
+	}
+
+	edits, err := getCommentEdits(tx, postID, date)
+	if err != nil {
+		return nil, err
+	}
+	edits = append(edits, CommentEdit{
+		Date:     auditEntry.Date,
+		Admin:    auditEntry.Admin,
+		Username: comment.Username,
+		Body:     comment.Body,
+	})
+	editsBytes, err := json.Marshal(edits)
+	if err != nil {
+		return nil, err
+	}
+	bucket, err := tx.CreateBucketIfNotExists([]byte("comment_edits"))
+	if err != nil {
+		return nil, err
+	}
+	err = bucket.Put(commentKey(postID, date), editsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	// the search index is keyed by the words in the comment, so the old words have to be removed first
+	err = unindexComment(tx, comment)
+	if err != nil {
+		return nil, err
+	}
+	comment.Username = username
+	comment.Body = body
+	comment.Edited = auditEntry.Date
+	err = putComment(tx, comment)
+	if err != nil {
+		return nil, err
+	}
+	err = indexComment(tx, comment)
+	if err != nil {
+		return nil, err
+	}
+	return &before, recordAudit(tx, auditEntry)
+}
+
+// adminEditComment handles the edit form on the admin page of a document
+func adminEditComment(request *http.Request, postID string) error {
+	dateInt, err := strconv.ParseInt(request.Form.Get("date"), 10, 64)
+	if err != nil {
+		return err
+	}
+	var before *Comment
+	err = db.Update(func(tx *bolt.Tx) error {
+		before, err = editComment(tx, request, postID, dateInt, request.Form.Get("username"), request.Form.Get("body"), request.Form.Get("redact"))
+		return err
+	})
+	if err == errCommentNotFound {
+		return nil
+	}
+	if err == nil && before != nil {
+		log.Printf("admin: edited comment %s_%d\n", postID, dateInt)
+	}
+	return err
+}
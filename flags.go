@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+	"github.com/boltdb/bolt"
+)
+
+// comments which were flagged by enough readers are hidden until an admin reviews them
+const commentStatusFlagged = "flagged"
+
+var flagReasons = []string{"spam", "abuse", "off-topic", "other"}
+
+var flagHideThresholdString = "$COMMENTS_FLAG_HIDE_THRESHOLD"
+var flagHideThreshold = 3
+var flagRateLimiter *rateLimiter
+
+// CommentFlag is a report from a reader. the reporter is identified only by a salted hash of their IP address,
+// which is used to make sure every reader can only flag a given comment once.
+type CommentFlag struct {
+	Reason       string `json:"reason"`
+	Details      string `json:"details,omitempty"`
+	Date         int64  `json:"date"`
+	ReporterHash string `json:"reporterHash"`
+}
+
+type flagRequest struct {
+	Date    int64  `json:"date"`
+	Reason  string `json:"reason"`
+	Details string `json:"details"`
+}
+
+func initFlags() {
+	flagHideThresholdString = os.ExpandEnv(flagHideThresholdString)
+	if flagHideThresholdString != "" {
+		var err error
+		flagHideThreshold, err = strconv.Atoi(flagHideThresholdString)
+		if err != nil {
+			panic(errors.Wrapf(err, "can't parse COMMENTS_FLAG_HIDE_THRESHOLD '%s' as int", flagHideThresholdString))
+		}
+		if flagHideThreshold < 1 {
+			panic(fmt.Errorf("COMMENTS_FLAG_HIDE_THRESHOLD must be at least 1, got '%s'", flagHideThresholdString))
+		}
+	}
+	flagRateLimiter = newRateLimiterFromEnv("flag", "$COMMENTS_RATE_LIMIT_FLAG", "10/1h")
+}
+
+func flagComment(response http.ResponseWriter, request *http.Request) {
+	addCORSHeaders(response, request)
+
+	if request.Method == "OPTIONS" {
+		response.WriteHeader(200)
+		return
+	}
+	if request.Method != "POST" {
+		response.Header().Add("Allow", "POST")
+		response.Header().Add("Allow", "OPTIONS")
+		writeFlagResponse(response, 405, "405 Method Not Supported")
+		return
+	}
+
+	pathElements := splitNonEmpty(request.URL.Path, "/")
+	var postID string
+	if len(pathElements) >= 2 {
+		postID = siteForRequest(request).DocumentID(pathElements[len(pathElements)-1])
+	}
+	if postID == "" {
+		writeFlagResponse(response, 404, "404 Not Found; postID is required")
+		return
+	}
+
+	clientIP := getClientIP(request)
+	if allowed, wait := flagRateLimiter.take(clientIP); !allowed {
+		response.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())))
+		writeFlagResponse(response, http.StatusTooManyRequests, fmt.Sprintf("you are flagging too quickly, please try again in %s", wait.String()))
+		return
+	}
+
+	var flag flagRequest
+	requestBody, err := ioutil.ReadAll(request.Body)
+	if err == nil {
+		err = json.Unmarshal(requestBody, &flag)
+	}
+	if err != nil {
+		log.Printf("bad request: error reading posted flag: %v\n", err)
+		writeFlagResponse(response, 400, "bad request: malformed json")
+		return
+	}
+	validReason := false
+	for _, reason := range flagReasons {
+		validReason = validReason || reason == flag.Reason
+	}
+	if !validReason {
+		writeFlagResponse(response, 400, fmt.Sprintf("reason must be one of %s", strings.Join(flagReasons, ", ")))
+		return
+	}
+	if utf8.RuneCountInString(flag.Details) > 1000 {
+		flag.Details = string([]rune(flag.Details)[:1000])
+	}
+
+	newFlag := CommentFlag{
+		Reason:       flag.Reason,
+		Details:      flag.Details,
+		Date:         getMillisecondsSinceUnixEpoch(),
+		ReporterHash: fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%s%s", clientIP, hashSalt)))),
+	}
+	var flaggedComment *Comment
+	hidden := false
+	alreadyFlagged := false
+	err = db.Update(func(tx *bolt.Tx) error {
+		documentState, err := getDocumentState(tx, postID)
+		if err != nil {
+			return err
+		}
+		if documentState == documentStateArchived {
+			return errDocumentArchived
+		}
+		comment, err := getComment(tx, postID, flag.Date)
+		if err != nil {
+			return err
+		}
+		for _, existingFlag := range comment.Flags {
+			if existingFlag.ReporterHash == newFlag.ReporterHash {
+				alreadyFlagged = true
+				return nil
+			}
+		}
+		comment.Flags = append(comment.Flags, newFlag)
+		if comment.Status == "" && len(comment.Flags) >= flagHideThreshold {
+			comment.Status = commentStatusFlagged
+			hidden = true
+			queue, err := tx.CreateBucketIfNotExists([]byte("moderation_queue"))
+			if err != nil {
+				return err
+			}
+			err = queue.Put(commentKey(postID, comment.Date), []byte(""))
+			if err != nil {
+				return err
+			}
+		}
+		flaggedComment = comment
+		return putComment(tx, comment)
+	})
+	if err == errDocumentArchived {
+		writeFlagResponse(response, 403, "this document is archived")
+		return
+	}
+	if err == errCommentNotFound || err == errBucketNotFound {
+		writeFlagResponse(response, 404, "404 comment not found")
+		return
+	}
+	if err != nil {
+		log.Printf("boltdb error on flag comment: %v\n", err)
+		writeFlagResponse(response, 500, "database error")
+		return
+	}
+
+	if alreadyFlagged {
+		writeFlagResponse(response, 200, "")
+		return
+	}
+
+	log.Printf("comment %s_%d was flagged as %s (%d flags, hidden=%t)\n", postID, flag.Date, flag.Reason, len(flaggedComment.Flags), hidden)
+	queueFlagNotification(flaggedComment, &newFlag, hidden)
+	queueWebhookEvent(webhookEventCommentFlagged, flaggedComment, "", &newFlag)
+
+	writeFlagResponse(response, 200, "")
+}
+
+func writeFlagResponse(response http.ResponseWriter, statusCode int, errorMessage string) {
+	responseBytes, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{
+		Error: errorMessage,
+	})
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(statusCode)
+	response.Write(responseBytes)
+}
+
+func queueFlagNotification(comment *Comment, flag *CommentFlag, hidden bool) {
+	site := siteForDocument(comment.DocumentID)
+	if emailNotificationsDisabled || site.NotificationTarget == "" {
+		return
+	}
+
+	hiddenMessage := ""
+	if hidden {
+		hiddenMessage = fmt.Sprintf("The comment has been flagged %d times, so it is now hidden until you review it.", len(comment.Flags))
+	}
+	adminLink := fmt.Sprintf("%s/admin/%s", site.URL, comment.DocumentID)
+	htmlEscapedBody := strings.ReplaceAll(comment.Body, "<", "&lt;")
+	htmlEscapedBody = strings.ReplaceAll(htmlEscapedBody, ">", "&gt;")
+	htmlEscapedDetails := strings.ReplaceAll(flag.Details, "<", "&lt;")
+	htmlEscapedDetails = strings.ReplaceAll(htmlEscapedDetails, ">", "&gt;")
+
+	bodyPlain := softWrapString(fmt.Sprintf(
+		`A reader flagged a comment by %s on '%s' as %s.
+
+%s
+
+%s
+
+---------------------------------------------------------------------
+
+%s
+
+Review it at: %s
+`, comment.Username, comment.DocumentTitle, flag.Reason, flag.Details, comment.Body, hiddenMessage, adminLink), 72)
+
+	bodyHTML := fmt.Sprintf(
+		`A reader flagged a comment by %s on <a href="%s">%s</a> as <b>%s</b>.<br/>
+<br/>
+%s<br/>
+<br/>
+<div style="padding:2em; border-top: 1px solid #aaa;">
+%s<br/>
+</div>
+<br/>
+%s<br/>
+<br/>
+<a href="%s">review it on the admin panel</a>
+`, html.EscapeString(comment.Username), html.EscapeString(comment.URL), html.EscapeString(comment.DocumentTitle), flag.Reason, htmlEscapedDetails, htmlEscapedBody, hiddenMessage, adminLink)
+
+	// every flag is announced once
+	key := fmt.Sprintf("%s flag/%s %s", commentKey(comment.DocumentID, comment.Date), flag.ReporterHash[:12], site.NotificationTarget)
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := queueEmail(tx, key, site.EmailFrom, site.NotificationTarget, fmt.Sprintf("Comment flagged on '%s'", comment.DocumentTitle), bodyPlain, bodyHTML)
+		return err
+	})
+	if err != nil {
+		log.Printf("couldn't queue the flag notification for %s: %v\n", site.NotificationTarget, err)
+		return
+	}
+	wakeEmailWorker()
+}
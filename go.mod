@@ -8,5 +8,7 @@ require (
 	github.com/gomarkdown/markdown v0.0.0-20210208175418-bda154fe17d8 // indirect
 	github.com/sym01/htmlsanitizer v1.0.1 // indirect
 	github.com/xhit/go-simple-mail v2.2.2+incompatible // indirect
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 	golang.org/x/sys v0.0.0-20210309074719-68d13333faf2 // indirect
+	rsc.io/qr v0.2.0
 )
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// loginGuard counts failed admin logins per key (client IP or username) in memory. after Attempts failures in a row,
+// the key is locked out for Lockout, and every further failure doubles the lockout, up to loginLockoutMax.
+// a successful login resets the count.
+type loginGuard struct {
+	Name     string
+	Attempts int
+	Lockout  time.Duration
+	failures map[string]*loginFailures
+	mutex    *sync.Mutex
+}
+
+type loginFailures struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+const loginLockoutMax = time.Hour * 24
+
+// failures are forgotten after this long without another one
+const loginFailuresExpire = time.Hour * 24
+
+var adminLockoutString = "$COMMENTS_ADMIN_LOCKOUT"
+var adminUsernameLockoutString = "$COMMENTS_ADMIN_USERNAME_LOCKOUT"
+var loginIPGuard *loginGuard
+var loginUsernameGuard *loginGuard
+
+func initLoginGuards() {
+	loginIPGuard = newLoginGuard("ip", "COMMENTS_ADMIN_LOCKOUT", os.ExpandEnv(adminLockoutString), "5/1m")
+	// anyone can lock out a username by guessing wrong passwords for it, so the username needs more failures before it
+	// is locked out. the lockout is longer, because guesses for one username may come from many IP addresses.
+	loginUsernameGuard = newLoginGuard("username", "COMMENTS_ADMIN_USERNAME_LOCKOUT", os.ExpandEnv(adminUsernameLockoutString), "10/15m")
+
+	go (func() {
+		for {
+			time.Sleep(time.Minute)
+			loginIPGuard.cleanup()
+			loginUsernameGuard.cleanup()
+		}
+	})()
+}
+
+// newLoginGuard parses the <attempts>/<duration> setting, it returns nil when the setting is "off"
+func newLoginGuard(name, settingName, setting, defaultSetting string) *loginGuard {
+	if setting == "" {
+		setting = defaultSetting
+	}
+	if setting == "off" {
+		log.Printf("admin login lockout per %s is turned off\n", name)
+		return nil
+	}
+	split := strings.Split(setting, "/")
+	if len(split) != 2 {
+		panic(fmt.Errorf("can't parse %s '%s': expected <attempts>/<duration>, for example %s", settingName, setting, defaultSetting))
+	}
+	attempts, err := strconv.Atoi(split[0])
+	if err != nil || attempts < 1 {
+		panic(fmt.Errorf("can't parse %s '%s': attempts must be a number >= 1", settingName, setting))
+	}
+	lockout, err := time.ParseDuration(split[1])
+	if err != nil || lockout <= 0 {
+		panic(fmt.Errorf("can't parse %s '%s': '%s' is not a valid duration", settingName, setting, split[1]))
+	}
+	log.Printf("admin logins are locked out per %s for %s after %d failed attempts\n", name, lockout, attempts)
+
+	return &loginGuard{Name: name, Attempts: attempts, Lockout: lockout, failures: map[string]*loginFailures{}, mutex: &sync.Mutex{}}
+}
+
+// lockedOut returns how long the key is still locked out, or 0. a nil loginGuard never locks anyone out.
+func (guard *loginGuard) lockedOut(key string) time.Duration {
+	if guard == nil || key == "" {
+		return 0
+	}
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+
+	failures, has := guard.failures[key]
+	if !has {
+		return 0
+	}
+	if wait := time.Until(failures.lockedUntil); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// fail counts a failed login and returns true if this failure started a new lockout
+func (guard *loginGuard) fail(key string) bool {
+	if guard == nil || key == "" {
+		return false
+	}
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+
+	failures, has := guard.failures[key]
+	if !has {
+		failures = &loginFailures{}
+		guard.failures[key] = failures
+	}
+	failures.count++
+	failures.lastFailure = time.Now()
+	if failures.count < guard.Attempts {
+		return false
+	}
+	lockout := guard.Lockout
+	for i := guard.Attempts; i < failures.count && lockout < loginLockoutMax; i++ {
+		lockout *= 2
+	}
+	if lockout > loginLockoutMax {
+		lockout = loginLockoutMax
+	}
+	failures.lockedUntil = failures.lastFailure.Add(lockout)
+	return failures.count == guard.Attempts
+}
+
+func (guard *loginGuard) succeed(key string) {
+	if guard == nil || key == "" {
+		return
+	}
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	delete(guard.failures, key)
+}
+
+func (guard *loginGuard) cleanup() {
+	if guard == nil {
+		return
+	}
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+
+	now := time.Now()
+	for key, failures := range guard.failures {
+		if now.After(failures.lockedUntil) && now.Sub(failures.lastFailure) > loginFailuresExpire {
+			delete(guard.failures, key)
+		}
+	}
+}
+
+// checkLoginLockout returns how long the client has to wait before it may try to log in again, or 0
+func checkLoginLockout(ipAddress, username string) time.Duration {
+	wait := loginIPGuard.lockedOut(ipAddress)
+	if usernameWait := loginUsernameGuard.lockedOut(strings.ToLower(username)); usernameWait > wait {
+		wait = usernameWait
+	}
+	return wait
+}
+
+// recordLoginFailure is called for every wrong password, code or API token. username is empty for API tokens.
+// site is the site whose admin panel was used to log in.
+func recordLoginFailure(site *Site, ipAddress, username string) {
+	lockedIP := loginIPGuard.fail(ipAddress)
+	lockedUsername := loginUsernameGuard.fail(strings.ToLower(username))
+	if lockedIP || lockedUsername {
+		log.Printf("admin login locked out: ip %s (%t), username '%s' (%t)\n", ipAddress, lockedIP, username, lockedUsername)
+		queueLockoutNotification(site, ipAddress, username, lockedIP, lockedUsername)
+	}
+}
+
+func recordLoginSuccess(ipAddress, username string) {
+	loginIPGuard.succeed(ipAddress)
+	loginUsernameGuard.succeed(strings.ToLower(username))
+}
+
+// lockoutDescription describes a lockout which just started with the attempts and lockout of the guard which tripped
+func lockoutDescription(guard *loginGuard, locked string) string {
+	return fmt.Sprintf("%s is locked out for %s after %d failed attempts in a row", locked, guard.Lockout, guard.Attempts)
+}
+
+// lockoutSite is the site of the admin user with the username, or the site of the login page if there is no such user
+func lockoutSite(site *Site, username string) *Site {
+	var user *AdminUser
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		user, err = getAdminUser(tx, username)
+		return err
+	})
+	if err != nil {
+		log.Printf("failed to find the site of the admin user '%s': %v\n", username, err)
+	}
+	if user == nil {
+		return site
+	}
+	if user.Site == "" {
+		return defaultSite
+	}
+	if userSite, has := namedSites[user.Site]; has {
+		return userSite
+	}
+	return site
+}
+
+func queueLockoutNotification(site *Site, ipAddress, username string, lockedIP, lockedUsername bool) {
+	if emailNotificationsDisabled {
+		return
+	}
+	if username != "" {
+		site = lockoutSite(site, username)
+	}
+	if site.NotificationTarget == "" {
+		return
+	}
+
+	locked := []string{}
+	if lockedIP {
+		locked = append(locked, lockoutDescription(loginIPGuard, fmt.Sprintf("the IP address %s", ipAddress)))
+	}
+	if lockedUsername {
+		locked = append(locked, lockoutDescription(loginUsernameGuard, fmt.Sprintf("the username '%s'", username)))
+	}
+	lockedString := strings.Join(locked, " and ")
+	lockedString = fmt.Sprintf("%s%s", strings.ToUpper(lockedString[:1]), lockedString[1:])
+
+	bodyPlain := softWrapString(fmt.Sprintf(
+		`Someone failed to log in to the comments admin panel too many times, the last attempt came from %s. %s. The lockout doubles with every further failed attempt.
+
+If this was not you, someone may be trying to guess an admin password.
+`, ipAddress, lockedString), 72)
+
+	bodyHTML := fmt.Sprintf(
+		`Someone failed to log in to the comments admin panel too many times, the last attempt came from %s. %s. The lockout doubles with every further failed attempt.<br/>
+<br/>
+If this was not you, someone may be trying to guess an admin password.
+`, ipAddress, html.EscapeString(lockedString))
+
+	// every lockout is announced once
+	key := fmt.Sprintf("lockout/%d %s", getMillisecondsSinceUnixEpoch(), site.NotificationTarget)
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := queueEmail(tx, key, site.EmailFrom, site.NotificationTarget, "Comments admin login locked out", bodyPlain, bodyHTML)
+		return err
+	})
+	if err != nil {
+		log.Printf("couldn't queue the lockout notification for %s: %v\n", site.NotificationTarget, err)
+		return
+	}
+	wakeEmailWorker()
+}
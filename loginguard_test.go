@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func newTestLoginGuard(name string) *loginGuard {
+	return &loginGuard{Name: name, Attempts: 3, Lockout: time.Minute, failures: map[string]*loginFailures{}, mutex: &sync.Mutex{}}
+}
+
+func TestLoginGuardLocksOutAfterAttempts(t *testing.T) {
+	guard := newTestLoginGuard("ip")
+	for i := 1; i < guard.Attempts; i++ {
+		if guard.fail("1.2.3.4") {
+			t.Fatalf("failure %d should not start a lockout", i)
+		}
+		if wait := guard.lockedOut("1.2.3.4"); wait != 0 {
+			t.Fatalf("failure %d should not lock out yet, got %s", i, wait)
+		}
+	}
+	if !guard.fail("1.2.3.4") {
+		t.Fatal("the last allowed failure should start a lockout")
+	}
+	if wait := guard.lockedOut("1.2.3.4"); wait <= 0 || wait > guard.Lockout {
+		t.Errorf("expected a lockout of up to %s, got %s", guard.Lockout, wait)
+	}
+	if wait := guard.lockedOut("5.6.7.8"); wait != 0 {
+		t.Errorf("other keys should not be locked out, got %s", wait)
+	}
+}
+
+func TestLoginGuardLockoutDoubles(t *testing.T) {
+	guard := newTestLoginGuard("ip")
+	for i := 0; i < guard.Attempts+2; i++ {
+		guard.fail("1.2.3.4")
+	}
+	if wait := guard.lockedOut("1.2.3.4"); wait <= guard.Lockout*2 || wait > guard.Lockout*4 {
+		t.Errorf("two more failures should double the lockout twice, got %s", wait)
+	}
+
+	for i := 0; i < 100; i++ {
+		guard.fail("1.2.3.4")
+	}
+	if wait := guard.lockedOut("1.2.3.4"); wait > loginLockoutMax {
+		t.Errorf("the lockout should never be longer than %s, got %s", loginLockoutMax, wait)
+	}
+}
+
+func TestLoginGuardSuccessResets(t *testing.T) {
+	guard := newTestLoginGuard("ip")
+	for i := 0; i < guard.Attempts; i++ {
+		guard.fail("1.2.3.4")
+	}
+	guard.succeed("1.2.3.4")
+	if wait := guard.lockedOut("1.2.3.4"); wait != 0 {
+		t.Errorf("a successful login should end the lockout, got %s", wait)
+	}
+}
+
+func TestNilLoginGuardNeverLocksOut(t *testing.T) {
+	var guard *loginGuard
+	if guard.fail("1.2.3.4") || guard.lockedOut("1.2.3.4") != 0 {
+		t.Error("a nil guard means the lockout is turned off")
+	}
+}
+
+func TestWrongPasswordsLockOutTheUsername(t *testing.T) {
+	emailNotificationsDisabled = true
+	loginIPGuard = newTestLoginGuard("ip")
+	loginUsernameGuard = &loginGuard{Name: "username", Attempts: 5, Lockout: time.Hour, failures: map[string]*loginFailures{}, mutex: &sync.Mutex{}}
+	defer (func() {
+		loginIPGuard = nil
+		loginUsernameGuard = nil
+	})()
+
+	// every guess comes from another IP address, so only the count per username adds up
+	for i := 0; i < loginUsernameGuard.Attempts; i++ {
+		recordLoginFailure(defaultSite, fmt.Sprintf("10.0.0.%d", i), "Admin")
+	}
+	if wait := checkLoginLockout("10.0.0.99", "admin"); wait <= loginIPGuard.Lockout || wait > loginUsernameGuard.Lockout {
+		t.Errorf("the username should be locked out with its own, longer lockout, got %s", wait)
+	}
+	if wait := checkLoginLockout("10.0.0.99", "someone-else"); wait != 0 {
+		t.Errorf("other usernames should not be locked out, got %s", wait)
+	}
+
+	recordLoginSuccess("10.0.0.99", "admin")
+	if wait := checkLoginLockout("10.0.0.99", "admin"); wait != 0 {
+		t.Errorf("a successful login should end the lockout of the username, got %s", wait)
+	}
+}
+
+func TestNewLoginGuard(t *testing.T) {
+	tests := []struct {
+		setting  string
+		attempts int
+		lockout  time.Duration
+		valid    bool
+	}{
+		{"", 5, time.Minute, true},
+		{"10/15m", 10, 15 * time.Minute, true},
+		{"off", 0, 0, true},
+		{"0/1m", 0, 0, false},
+		{"5", 0, 0, false},
+		{"5/soon", 0, 0, false},
+	}
+	for _, test := range tests {
+		var guard *loginGuard
+		panicked := (func() (panicked bool) {
+			defer (func() { panicked = recover() != nil })()
+			guard = newLoginGuard("ip", "COMMENTS_ADMIN_LOCKOUT", test.setting, "5/1m")
+			return false
+		})()
+		if panicked == test.valid {
+			t.Errorf("%q: expected valid=%t", test.setting, test.valid)
+			continue
+		}
+		if !test.valid {
+			continue
+		}
+		if test.setting == "off" {
+			if guard != nil {
+				t.Error("off should turn the lockout off")
+			}
+			continue
+		}
+		if guard.Attempts != test.attempts || guard.Lockout != test.lockout {
+			t.Errorf("%q: expected %d/%s, got %d/%s", test.setting, test.attempts, test.lockout, guard.Attempts, guard.Lockout)
+		}
+	}
+}
+
+func TestLockoutDescription(t *testing.T) {
+	guard := &loginGuard{Name: "username", Attempts: 10, Lockout: 15 * time.Minute}
+	expected := "the username 'admin' is locked out for 15m0s after 10 failed attempts in a row"
+	if got := lockoutDescription(guard, "the username 'admin'"); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestLockoutSite(t *testing.T) {
+	db = openTestDB(t)
+	defaultSite = &Site{NotificationTarget: "admin@example.com"}
+	blog := &Site{Name: "blog", NotificationTarget: "blog@example.com"}
+	namedSites = map[string]*Site{"blog": blog}
+	defer (func() { namedSites = map[string]*Site{} })()
+	err := db.Update(func(tx *bolt.Tx) error {
+		if err := putAdminUser(tx, &AdminUser{Username: "forest"}, ""); err != nil {
+			return err
+		}
+		return putAdminUser(tx, &AdminUser{Username: "blogger", Site: "blog"}, "")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		loginSite *Site
+		username  string
+		expected  *Site
+	}{
+		{defaultSite, "blogger", blog},
+		{blog, "forest", defaultSite},
+		{blog, "blogger", blog},
+		{blog, "nobody", blog},
+	}
+	for _, test := range tests {
+		if got := lockoutSite(test.loginSite, test.username); got != test.expected {
+			t.Errorf("lockoutSite(%s, %q): expected the %s site, got the %s site", test.loginSite.DisplayName(), test.username, test.expected.DisplayName(), got.DisplayName())
+		}
+	}
+}
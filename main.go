@@ -20,11 +20,9 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
-	"runtime/debug"
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	errors "git.sequentialread.com/forest/pkg-errors"
@@ -36,21 +34,35 @@ import (
 )
 
 type Comment struct {
-	URL              string     `json:"url,omitempty"`
-	DocumentTitle    string     `json:"documentTitle,omitempty"`
-	AvatarType       string     `json:"avatarType,omitempty"`
-	NotifyOfReplies  string     `json:"notifyOfReplies,omitempty"`
-	Email            string     `json:"email,omitempty"`
-	Username         string     `json:"username"`
-	Body             string     `json:"body"`
-	BodyHTML         string     `json:"bodyHTML,omitempty"`
-	AvatarHash       string     `json:"avatarHash"`
-	DocumentID       string     `json:"documentId"`
-	InReplyTo        string     `json:"inReplyTo,omitempty"`
-	Date             int64      `json:"date"`
-	CaptchaChallenge string     `json:"captchaChallenge,omitempty"`
-	CaptchaNonce     string     `json:"captchaNonce,omitempty"`
-	Replies          []*Comment `json:"replies,omitempty"`
+	URL              string        `json:"url,omitempty"`
+	DocumentTitle    string        `json:"documentTitle,omitempty"`
+	AvatarType       string        `json:"avatarType,omitempty"`
+	NotifyOfReplies  string        `json:"notifyOfReplies,omitempty"`
+	Email            string        `json:"email,omitempty"`
+	Username         string        `json:"username"`
+	Body             string        `json:"body"`
+	BodyHTML         string        `json:"bodyHTML,omitempty"`
+	AvatarHash       string        `json:"avatarHash"`
+	DocumentID       string        `json:"documentId"`
+	InReplyTo        string        `json:"inReplyTo,omitempty"`
+	Date             int64         `json:"date"`
+	CaptchaChallenge string        `json:"captchaChallenge,omitempty"`
+	CaptchaNonce     string        `json:"captchaNonce,omitempty"`
+	Replies          []*Comment    `json:"replies,omitempty"`
+	Status           string        `json:"status,omitempty"`
+	SpamScore        float64       `json:"spamScore,omitempty"`
+	SpamReasons      []string      `json:"spamReasons,omitempty"`
+	IPAddress        string        `json:"ipAddress,omitempty"`
+	UserAgent        string        `json:"userAgent,omitempty"`
+	Referrer         string        `json:"referrer,omitempty"`
+	SpamProbability  float64       `json:"spamProbability,omitempty"`
+	EmailHash        string        `json:"emailHash,omitempty"`
+	Flags            []CommentFlag `json:"flags,omitempty"`
+	IsAuthor         bool          `json:"isAuthor,omitempty"`
+	Pinned           bool          `json:"pinned,omitempty"`
+	PosterID         string        `json:"posterId,omitempty"`
+	AdminAuthor      string        `json:"adminAuthor,omitempty"`
+	Edited           int64         `json:"edited,omitempty"`
 }
 
 type CommentedDocument struct {
@@ -71,12 +83,6 @@ var commentsURLString = "$COMMENTS_BASE_URL"
 // Note that every difficulty level is 16x more difficult than the last.
 // Recommended difficulty level = 3
 var captchaDifficultyLevelString = "$COMMENTS_CAPTCHA_DIFFICULTY_LEVEL"
-var captchaDifficultyLevel int
-var captchaAPIURL *url.URL
-var captchaPublicURL *url.URL
-var loadCaptchaChallengesMutex *sync.Mutex
-var captchaChallengesMutex *sync.Mutex
-var loadCaptchaChallengesMutexIsProbablyLocked = false
 var emailHost = "$COMMENTS_EMAIL_HOST"
 var emailPort int
 var emailUsername = "$COMMENTS_EMAIL_USER"
@@ -84,12 +90,47 @@ var emailPassword = "$COMMENTS_EMAIL_PASSWORD"
 var adminEmailNotificationTarget = "$COMMENTS_NOTIFICATION_TARGET"
 var emailNotificationsDisabled = false
 var adminPassword = "$COMMENTS_ADMIN_PASSWORD"
+var adminEnabled bool
 var hashSalt = "$COMMENTS_HASH_SALT"
 
-var captchaChallenges []string
 var db *bolt.DB
 var httpClient *http.Client
 
+// admin pages other than the index and the document pages are served under /admin/_/, so they can't collide with
+// a DocumentID. they are keyed by the path after the prefix.
+const adminPagePrefix = "_/"
+
+var adminPages = map[string]func(http.ResponseWriter, *http.Request){
+	"bayes":    adminBayes,
+	"bans":     adminBans,
+	"bulk":     adminBulk,
+	"audit":    adminAudit,
+	"owners":   adminOwners,
+	"search":   adminSearch,
+	"tokens":   adminTokens,
+	"users":    adminUsers,
+	"webhooks": adminWebhooks,
+	"emails":   adminEmails,
+}
+
+// the forms which are posted to the admin page of a document, keyed by their action field.
+// every other action moderates a single comment, see adminModerateComment.
+var documentActions = map[string]func(request *http.Request, postID string) error{
+	"documentState": adminSetDocumentState,
+	"pin":           adminPinComment,
+	"unpin":         adminPinComment,
+	"reply":         adminReplyComment,
+	"edit":          adminEditComment,
+}
+
+// documentActionErrors are shown on the admin page of the document instead of failing the request
+var documentActionErrors = map[error]bool{
+	errEmptyReply:                 true,
+	errEmptyEdit:                  true,
+	errDocumentArchived:           true,
+	errModerationActionNotAllowed: true,
+}
+
 var markdownRenderer *markdown_to_html.Renderer
 var errBucketNotFound = errors.New("bucket not found")
 
@@ -119,27 +160,11 @@ func main() {
 	origins = splitNonEmpty(originsCSV, ",")
 	log.Printf("Allowed CORS Origins: [\n%s\n]\n", strings.Join(origins, "\n"))
 
+	// the captcha settings are parsed by initSites, every site may have its own
 	captchaAPIToken = os.ExpandEnv(captchaAPIToken)
-
 	captchaAPIURLString = os.ExpandEnv(captchaAPIURLString)
-	captchaAPIURL, err = url.Parse(captchaAPIURLString)
-	if err != nil || captchaAPIURLString == "" {
-		panic(errors.Wrapf(err, "can't parse COMMENTS_CAPTCHA_API_URL '%s' as url", captchaAPIURLString))
-	}
-
 	captchaPublicURLString = os.ExpandEnv(captchaPublicURLString)
-	captchaPublicURL, err = url.Parse(captchaPublicURLString)
-	if err != nil || captchaPublicURLString == "" {
-		panic(errors.Wrapf(err, "can't parse COMMENTS_CAPTCHA_PUBLIC_URL '%s' as url", captchaPublicURLString))
-	}
-
 	captchaDifficultyLevelString = os.ExpandEnv(captchaDifficultyLevelString)
-	captchaDifficultyLevel, err = strconv.Atoi(captchaDifficultyLevelString)
-	if err != nil {
-		panic(errors.Wrapf(err, "can't parse COMMENTS_CAPTCHA_DIFFICULTY_LEVEL '%s' as int", captchaDifficultyLevelString))
-	}
-	loadCaptchaChallengesMutex = &sync.Mutex{}
-	captchaChallengesMutex = &sync.Mutex{}
 
 	emailHost = os.ExpandEnv(emailHost)
 	emailPortString := os.ExpandEnv("$COMMENTS_EMAIL_PORT")
@@ -173,6 +198,16 @@ func main() {
 		hashSalt = "983q4gh_8778g4ilb.sDkjg09834goj4p9-023u0_mjpmodsmg"
 	}
 	adminPassword = os.ExpandEnv(adminPassword)
+	initSites()
+	initSpamFilters()
+	initRateLimits()
+	initLoginGuards()
+	initFlags()
+	initDocuments()
+	initModerationLinks()
+	initSearch()
+	initModeration()
+	initTOTP()
 
 	db, err = bolt.Open("data/comments.db", 0600, nil)
 	if err != nil {
@@ -180,37 +215,67 @@ func main() {
 	}
 	defer db.Close()
 
+	initServerSecret()
+	loadModerationLinkKey()
+	initSearchIndex()
+	initCommentStats()
+	initAdminUsers()
+	go purgeDeletedCommentsForever()
+	go deliverWebhooksForever()
+	go sendEmailsForever()
+
 	httpClient = &http.Client{
 		Timeout: time.Second * time.Duration(20),
 	}
 
-	err = loadCaptchaChallenges()
-	if err != nil {
-		panic(errors.Wrap(err, "could not loadCaptchaChallenges():"))
+	for _, site := range allSites() {
+		err = site.Captcha.loadChallenges()
+		if err != nil {
+			panic(errors.Wrapf(err, "could not load the captcha challenges for the %s site:", site.DisplayName()))
+		}
 	}
 
 	markdownRenderer = markdown_to_html.NewRenderer(markdown_to_html.RendererOptions{
 		Flags: markdown_to_html.CommonFlags | markdown_to_html.HrefTargetBlank,
 	})
 
-	http.HandleFunc(fmt.Sprintf("%s/api/", commentsBasePath), comments)
-
-	if adminPassword == "" {
-		log.Println("WARNING: COMMENTS_ADMIN_PASSWORD environment variable was not set. The admin API will be turned off.")
+	if !adminEnabled {
+		log.Println("WARNING: there are no admin users and the COMMENTS_ADMIN_PASSWORD environment variable was not set. The admin panel and the admin API will be turned off.")
 	} else {
-		http.HandleFunc(fmt.Sprintf("%s/admin/", commentsBasePath), admin)
+		// API tokens are not tied to a site, so the admin API is only served at the base path
+		http.HandleFunc(fmt.Sprintf("%s/admin-api/", commentsBasePath), adminAPI)
 	}
 
-	http.HandleFunc(fmt.Sprintf("%s/avatar/", commentsBasePath), serveAvatar)
+	// sites which are selected by their host name are served at the base path too
+	basePaths := map[string]bool{}
+	for _, site := range allSites() {
+		basePaths[site.BasePath()] = true
+	}
+	for basePath := range basePaths {
+		http.HandleFunc(fmt.Sprintf("%s/api/", basePath), comments)
 
-	http.HandleFunc(fmt.Sprintf("%s/disable/", commentsBasePath), disableNotification)
+		if adminEnabled {
+			http.HandleFunc(fmt.Sprintf("%s/admin/", basePath), admin)
+			http.HandleFunc(fmt.Sprintf("%s/moderate/", basePath), moderateFromLink)
+		}
 
-	http.HandleFunc(fmt.Sprintf("%s/unsubscribe/", commentsBasePath), unsubscribeNotification)
+		http.HandleFunc(fmt.Sprintf("%s/flag/", basePath), flagComment)
 
-	//http.HandleFunc(fmt.Sprintf("%s/import/", commentsBasePath), importComments)
+		if publicSearchEnabled {
+			http.HandleFunc(fmt.Sprintf("%s/search/", basePath), publicSearch)
+		}
 
-	staticPath := fmt.Sprintf("%s/static/", commentsBasePath)
-	http.Handle(staticPath, http.StripPrefix(staticPath, http.FileServer(http.Dir("./static/"))))
+		http.HandleFunc(fmt.Sprintf("%s/avatar/", basePath), serveAvatar)
+
+		http.HandleFunc(fmt.Sprintf("%s/disable/", basePath), disableNotification)
+
+		http.HandleFunc(fmt.Sprintf("%s/unsubscribe/", basePath), unsubscribeNotification)
+
+		//http.HandleFunc(fmt.Sprintf("%s/import/", basePath), importComments)
+
+		staticPath := fmt.Sprintf("%s/static/", basePath)
+		http.Handle(staticPath, http.StripPrefix(staticPath, http.FileServer(http.Dir("./static/"))))
+	}
 
 	log.Printf(" 💬   SequentialRead Comments listening on ':%d', base path '%s'\n", portNumber, commentsBasePath)
 
@@ -229,17 +294,24 @@ func comments(response http.ResponseWriter, request *http.Request) {
 	}
 
 	pathElements := splitNonEmpty(request.URL.Path, "/")
-	if len(pathElements) < 2 {
+	var postID string
+	if len(pathElements) >= 2 {
+		postID = siteForRequest(request).DocumentID(pathElements[len(pathElements)-1])
+	}
+	if postID == "" {
 		response.WriteHeader(404)
 		response.Write([]byte("404 Not Found; postID is required"))
 		return
 	}
-	postID := pathElements[len(pathElements)-1]
 	if request.Method == "GET" {
-		returnCommentsList(response, postID, "")
+		viewerIdentity := identityFromToken(request.URL.Query().Get("identity"))
+		returnCommentsList(response, postID, postCommentResult{Identity: viewerIdentity})
 	} else if request.Method == "POST" {
-		couldNotPostReason := postComment(response, request, postID)
-		returnCommentsList(response, postID, couldNotPostReason)
+		result := postComment(response, request, postID)
+		if result.Identity == "" {
+			result.Identity = identityFromToken(request.URL.Query().Get("identity"))
+		}
+		returnCommentsList(response, postID, result)
 	} else {
 		response.Header().Add("Allow", "GET")
 		response.Header().Add("Allow", "POST")
@@ -249,32 +321,119 @@ func comments(response http.ResponseWriter, request *http.Request) {
 	}
 }
 
+// adminSubPath is the part of the path after <base path>/admin/. sites which are selected by their host name
+// are served at the base path too.
+func adminSubPath(request *http.Request) string {
+	for _, basePath := range []string{siteForRequest(request).BasePath(), commentsBasePath} {
+		prefix := fmt.Sprintf("%s/admin/", basePath)
+		if strings.HasPrefix(request.URL.Path, prefix) {
+			return strings.TrimPrefix(request.URL.Path, prefix)
+		}
+	}
+	return ""
+}
+
 func admin(responseWriter http.ResponseWriter, request *http.Request) {
-	username, password, ok := request.BasicAuth()
-	if !ok || username != "admin" || password != adminPassword {
-		log.Printf("admin api auth fail: '%s:******', ok=%t\n", username, ok)
+	// adminPath is empty for the index, otherwise it is a page under the prefix or a DocumentID
+	adminPath := strings.Trim(adminSubPath(request), "/")
+	page := ""
+	if strings.HasPrefix(adminPath, adminPagePrefix) {
+		page = strings.TrimPrefix(adminPath, adminPagePrefix)
+	}
+	if request.Method != "GET" && request.Method != "HEAD" {
+		err := checkSameOrigin(request)
+		if err != nil {
+			log.Printf("admin: rejected cross-site %s %s from %s: %v\n", request.Method, request.URL.Path, getClientIP(request), err)
+			responseWriter.WriteHeader(403)
+			responseWriter.Write([]byte("403 forbidden: cross-site request"))
+			return
+		}
+	}
+	if page == "login" {
+		adminLogin(responseWriter, request)
+		return
+	}
+
+	user, err := getSessionUser(request)
+	if err != nil {
+		log.Printf("failed to check the admin session: %v\n", err)
+		responseWriter.WriteHeader(500)
+		responseWriter.Write([]byte("500 internal server error"))
+		return
+	}
+	if user == nil {
+		redirectToLogin(responseWriter, request)
+		return
+	}
+	request = withAdminUser(request, user)
+	if request.Method == "POST" && !validCSRFToken(request) {
+		log.Printf("admin: rejected %s %s by %s with a missing or wrong CSRF token\n", request.Method, request.URL.Path, user.Username)
+		responseWriter.WriteHeader(403)
+		responseWriter.Write([]byte("403 forbidden: the form has expired, please reload the page and try again"))
+		return
+	}
 
-		responseWriter.Header().Set("WWW-Authenticate", "Basic realm=\"comments admin\"")
-		responseWriter.WriteHeader(401)
-		responseWriter.Write([]byte("401 unauthorized"))
+	if page == "logout" {
+		adminLogout(responseWriter, request)
+		return
+	}
+	if page == "account" {
+		adminAccount(responseWriter, request)
+		return
+	}
+	if requiresTOTPEnrolment(user) {
+		http.Redirect(responseWriter, request, fmt.Sprintf("%s/admin/%saccount", siteForRequest(request).BasePath(), adminPagePrefix), http.StatusSeeOther)
+		return
+	}
+	if (ownerOnlyAdminPages[page] && user.Role != adminRoleOwner) || (defaultSiteAdminPages[page] && user.Site != "") ||
+		(request.Method == "POST" && user.Role == adminRoleReadOnly) {
+		log.Printf("admin: %s (%s) is not allowed to %s %s\n", user.Username, user.Role, request.Method, request.URL.Path)
+		responseWriter.WriteHeader(403)
+		responseWriter.Write([]byte("403 forbidden"))
+		return
+	}
+
+	if handleAdminPage, has := adminPages[page]; has {
+		handleAdminPage(responseWriter, request)
+		return
+	}
+	if page != "" {
+		responseWriter.WriteHeader(404)
+		responseWriter.Write([]byte("404 Not Found"))
 		return
 	}
 
-	pathSplit := splitNonEmpty(request.URL.Path, "/")
-	var err error
 	var templateBytes []byte
 	var htmlTemplate *template.Template
 	templateData := struct {
-		Documents     []CommentedDocument
-		DocumentTitle string
-		Comments      []Comment
+		User                 *AdminUser
+		Documents            []CommentedDocument
+		DocumentID           string
+		DocumentTitle        string
+		DocumentState        string
+		DocumentStateSetting string
+		AutoCloseDays        int
+		Comments             []adminComment
+		CommentCount         int
+		Page                 int
+		Pages                int
+		PendingComments      []Comment
+		PinnedComment        int64
+		OwnerIdentities      []Owner
+		Edits                map[int64][]CommentEdit
+		Stats                *adminStats
+		Error                string
 	}{
-		Documents: []CommentedDocument{},
-		Comments:  []Comment{},
+		User:            user,
+		AutoCloseDays:   autoCloseDays,
+		Documents:       []CommentedDocument{},
+		Comments:        []adminComment{},
+		PendingComments: []Comment{},
+		Edits:           map[int64][]CommentEdit{},
 	}
 	templateBytes, err = ioutil.ReadFile("admin.html.gotemplate")
 	if err == nil {
-		htmlTemplate, err = template.New("admin").Parse(string(templateBytes))
+		htmlTemplate, err = template.New("admin").Funcs(adminTemplateFuncs).Funcs(requestTemplateFuncs(request)).Parse(string(templateBytes))
 	}
 	if err != nil {
 		log.Printf("failed to load admin.html.gotemplate: %v\n", err)
@@ -283,13 +442,17 @@ func admin(responseWriter http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if pathSplit[len(pathSplit)-1] == "admin" {
+	site := siteForRequest(request)
+	if adminPath == "" {
 		err = db.Update(func(tx *bolt.Tx) error {
 			bucket, err := tx.CreateBucketIfNotExists([]byte("posts_index"))
 			if err != nil {
 				return err
 			}
 			err = bucket.ForEach(func(k, v []byte) error {
+				if !site.CanAdminister(string(k)) {
+					return nil
+				}
 				var document CommentedDocument
 				err = json.Unmarshal(v, &document)
 				if err != nil {
@@ -301,26 +464,38 @@ func admin(responseWriter http.ResponseWriter, request *http.Request) {
 			if err != nil {
 				return err
 			}
-			return nil
+			pendingComments, err := getModerationQueue(tx)
+			if err != nil {
+				return err
+			}
+			for _, comment := range pendingComments {
+				if site.CanAdminister(comment.DocumentID) {
+					templateData.PendingComments = append(templateData.PendingComments, comment)
+				}
+			}
+			templateData.Stats, err = getAdminStats(tx, site)
+			return err
 		})
 	} else {
-		postID := pathSplit[len(pathSplit)-1]
+		postID := adminPath
+		templateData.DocumentID = postID
+		if !site.CanAdminister(postID) {
+			responseWriter.WriteHeader(404)
+			responseWriter.Write([]byte("404 bucket not found"))
+			return
+		}
 
 		if request.Method == "POST" {
 			err = request.ParseForm()
 			if err == nil {
-				date := request.Form.Get("date")
-				var dateInt int64
-				dateInt, err = strconv.ParseInt(date, 10, 64)
-				if err == nil {
-					err = db.Update(func(tx *bolt.Tx) error {
-						bucket := tx.Bucket([]byte(fmt.Sprintf("posts/%s", postID)))
-						if bucket == nil {
-							return errBucketNotFound
-						}
-						bucket.Delete([]byte(fmt.Sprintf("%015d", dateInt)))
-						return nil
-					})
+				handleAction, has := documentActions[request.Form.Get("action")]
+				if !has {
+					handleAction = adminModerateComment
+				}
+				err = handleAction(request, postID)
+				if documentActionErrors[err] {
+					templateData.Error = fmt.Sprintf("could not %s: %s", request.Form.Get("action"), err)
+					err = nil
 				}
 			}
 		}
@@ -330,6 +505,27 @@ func admin(responseWriter http.ResponseWriter, request *http.Request) {
 				if bucket == nil {
 					return errBucketNotFound
 				}
+				settings, err := getDocumentSettings(tx, postID)
+				if err != nil {
+					return err
+				}
+				templateData.DocumentStateSetting = settings.State
+				templateData.PinnedComment = settings.PinnedComment
+				owners, err := getOwners(tx, siteForDocument(postID))
+				if err != nil {
+					return err
+				}
+				for _, owner := range owners {
+					templateData.OwnerIdentities = append(templateData.OwnerIdentities, owner)
+				}
+				sort.Slice(templateData.OwnerIdentities, func(i, j int) bool {
+					return templateData.OwnerIdentities[i].Created < templateData.OwnerIdentities[j].Created
+				})
+				templateData.DocumentState, err = getDocumentState(tx, postID)
+				if err != nil {
+					return err
+				}
+				comments := map[string]*Comment{}
 				err = bucket.ForEach(func(k, v []byte) error {
 					var comment Comment
 					err = json.Unmarshal(v, &comment)
@@ -339,13 +535,24 @@ func admin(responseWriter http.ResponseWriter, request *http.Request) {
 					if templateData.DocumentTitle == "" {
 						templateData.DocumentTitle = comment.DocumentTitle
 					}
-					templateData.Comments = append(templateData.Comments, comment)
+					comment.IsAuthor = isAuthor(owners, &comment)
+					if comment.Edited != 0 {
+						templateData.Edits[comment.Date], err = getCommentEdits(tx, postID, comment.Date)
+						if err != nil {
+							return err
+						}
+					}
+					comments[fmt.Sprintf("%s_%d", comment.DocumentID, comment.Date)] = &comment
 					return nil
 				})
 				if err != nil {
 					return err
 				}
-				return nil
+				templateData.CommentCount = len(comments)
+				rootComments := buildCommentTree(comments, settings.PinnedComment, true)
+				rootComments, templateData.Page, templateData.Pages = paginateThreads(rootComments, request.URL.Query().Get("page"))
+				templateData.Comments, err = flattenThreads(rootComments, comments)
+				return err
 			})
 		}
 	}
@@ -371,11 +578,57 @@ func admin(responseWriter http.ResponseWriter, request *http.Request) {
 	responseWriter.Write(buffer.Bytes())
 }
 
+var adminTemplateFuncs = template.FuncMap{
+	"formatDate": func(milliseconds int64) string {
+		return time.Unix(milliseconds/1000, 0).UTC().Format("2006-01-02 15:04 MST")
+	},
+	"commentKey": func(postID string, date int64) string {
+		return string(commentKey(postID, date))
+	},
+	"add": func(a, b int) int {
+		return a + b
+	},
+}
+
+// requestTemplateFuncs are the template functions which depend on the request
+func requestTemplateFuncs(request *http.Request) template.FuncMap {
+	return template.FuncMap{
+		"csrfField": func() template.HTML {
+			return csrfField(request)
+		},
+	}
+}
+
+func renderAdminTemplate(responseWriter http.ResponseWriter, request *http.Request, templateName string, templateData interface{}) {
+	var htmlTemplate *template.Template
+	templateBytes, err := ioutil.ReadFile(templateName)
+	if err == nil {
+		htmlTemplate, err = template.New(templateName).Funcs(adminTemplateFuncs).Funcs(requestTemplateFuncs(request)).Parse(string(templateBytes))
+	}
+	if err != nil {
+		log.Printf("failed to load %s: %v\n", templateName, err)
+		responseWriter.WriteHeader(500)
+		responseWriter.Write([]byte("500 internal server error"))
+		return
+	}
+
+	var buffer bytes.Buffer
+	err = htmlTemplate.Execute(&buffer, templateData)
+	if err != nil {
+		log.Printf("failed to render %s: %v\n", templateName, err)
+		responseWriter.WriteHeader(500)
+		responseWriter.Write([]byte("500 internal server error"))
+		return
+	}
+
+	responseWriter.Write(buffer.Bytes())
+}
+
 func addCORSHeaders(response http.ResponseWriter, request *http.Request) {
 
 	requestOrigin := request.Header.Get("Origin")
 
-	for _, allowed := range origins {
+	for _, allowed := range siteForRequest(request).Origins {
 		if allowed == requestOrigin {
 			response.Header().Add("Access-Control-Allow-Origin", requestOrigin)
 			for _, v := range request.Header.Values("access-control-request-method") {
@@ -390,25 +643,68 @@ func addCORSHeaders(response http.ResponseWriter, request *http.Request) {
 
 }
 
-func postComment(response http.ResponseWriter, request *http.Request, postID string) string {
+// postCommentResult is returned to the commenter along with the list of comments.
+// CouldNotPostReason is displayed as an error, Notice is displayed as an informational message.
+type postCommentResult struct {
+	CouldNotPostReason string
+	Notice             string
+	StatusCode         int
+	RetryAfter         time.Duration
+	Identity           string
+}
+
+func postComment(response http.ResponseWriter, request *http.Request, postID string) postCommentResult {
 	var postedComment Comment
 	requestBody, err := ioutil.ReadAll(request.Body)
 	if err != nil {
 		log.Printf("http read error on post comment: %v\n", err)
-		return "internal server error"
+		return postCommentResult{CouldNotPostReason: "internal server error"}
 	}
 	err = json.Unmarshal(requestBody, &postedComment)
 	if err != nil {
 		log.Printf("bad request: error reading posted comment: %v\n", err)
-		return "bad request: malformed json"
+		return postCommentResult{CouldNotPostReason: "bad request: malformed json"}
+	}
+	// the avatar hash identifies the author, so it is only ever derived from the email address below
+	postedComment.AvatarHash = ""
+	// a commenter who already has an identity token keeps their PosterID, everyone else gets a new one
+	postedComment.PosterID = identityFromToken(request.URL.Query().Get("identity"))
+	if postedComment.PosterID == "" {
+		postedComment.PosterID, err = newPosterID()
+		if err != nil {
+			log.Printf("generating a poster id failed: %v\n", err)
+			return postCommentResult{CouldNotPostReason: "internal server error"}
+		}
+	}
+	var documentState string
+	err = db.View(func(tx *bolt.Tx) error {
+		documentState, err = getDocumentState(tx, postID)
+		return err
+	})
+	if err != nil {
+		log.Printf("boltdb error on post comment: %v\n", err)
+		return postCommentResult{CouldNotPostReason: "database error"}
+	}
+	if documentState != documentStateOpen {
+		return postCommentResult{CouldNotPostReason: "comments are closed on this document", StatusCode: http.StatusForbidden}
 	}
-	err = validateCaptcha(postedComment.CaptchaChallenge, postedComment.CaptchaNonce)
+
+	err = siteForDocument(postID).Captcha.validate(postedComment.CaptchaChallenge, postedComment.CaptchaNonce)
 	if err != nil {
-		log.Printf("validateCaptcha failed: %v\n", err)
-		return "proof of work captcha failed"
+		log.Printf("validating the captcha failed: %v\n", err)
+		return postCommentResult{CouldNotPostReason: "proof of work captcha failed"}
 	}
 	if regexp.MustCompile(`^[\s\t\n\r]*$`).MatchString(postedComment.Body) {
-		return "comment body is required"
+		return postCommentResult{CouldNotPostReason: "comment body is required"}
+	}
+
+	// the rate limits are only spent on comments that passed the captcha, so nobody can drain them for free
+	clientIP := getClientIP(request)
+	if allowed, wait := ipRateLimiter.take(clientIP); !allowed {
+		return rateLimitedResult(ipRateLimiter, wait)
+	}
+	if allowed, wait := documentRateLimiter.take(postID); !allowed {
+		return rateLimitedResult(documentRateLimiter, wait)
 	}
 
 	var avatarBytes []byte
@@ -435,83 +731,196 @@ func postComment(response http.ResponseWriter, request *http.Request, postID str
 		}
 	}
 
-	postedCommentDate := getMillisecondsSinceUnixEpoch()
+	// the spam filters need to know who posted the comment
+	if sha256Hash != "" {
+		postedComment.AvatarHash = sha256Hash[:6]
+	}
+	postedComment.Status = ""
+	postedComment.AdminAuthor = ""
+	postedComment.IPAddress = clientIP
+	postedComment.UserAgent = request.UserAgent()
+	postedComment.Referrer = request.Referer()
+	postedComment.EmailHash = ""
+	if postedComment.Email != "" {
+		postedComment.EmailHash = hashEmail(postedComment.Email)
+	}
+
+	ban, err := findBan(&postedComment)
+	if err != nil {
+		log.Printf("boltdb error on ban check: %v\n", err)
+		return postCommentResult{CouldNotPostReason: "database error"}
+	}
+	shadowbanned := ban != nil && ban.Shadow
+	if ban != nil && !shadowbanned {
+		log.Printf("rejected comment on %s because of ban %s\n", postID, ban.ID)
+		return postCommentResult{CouldNotPostReason: "you have been banned from commenting"}
+	}
+	if allowed, wait := identityRateLimiter.take(sha256Hash); !allowed {
+		return rateLimitedResult(identityRateLimiter, wait)
+	}
+
+	// shadowbanned comments are invisible anyways, rejecting them would tell the author that they are banned
+	if shadowbanned {
+		log.Printf("comment on %s is shadowbanned because of ban %s\n", postID, ban.ID)
+	} else {
+		runSpamFilters(&postedComment)
+	}
+	if postedComment.SpamScore >= spamRejectThreshold {
+		log.Printf("rejected comment on %s as spam (score %.2f): %s\n", postID, postedComment.SpamScore, strings.Join(postedComment.SpamReasons, "; "))
+		return postCommentResult{CouldNotPostReason: "your comment was rejected by the spam filter"}
+	}
+	if postedComment.SpamScore >= spamQueueThreshold {
+		postedComment.Status = commentStatusPending
+	}
+
+	postedComment.DocumentID = postID
 	err = db.Update(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists([]byte(fmt.Sprintf("posts/%s", postID)))
-		if err != nil {
-			return err
-		}
-		// fields that are computed on read
-		postedComment.Replies = nil
-		postedComment.BodyHTML = ""
-
-		// metadata fields
-		postedComment.AvatarType = ""
-		postedComment.CaptchaChallenge = ""
-		postedComment.CaptchaNonce = ""
-		splitOnHash := strings.Split(postedComment.URL, "#")
-		postedComment.URL = splitOnHash[0]
-		// only save the email if the user requested it
-		if postedComment.NotifyOfReplies == "" || postedComment.NotifyOfReplies == "off" {
-			postedComment.Email = ""
-		}
+		return storeComment(tx, &postedComment, avatarBytes, avatarContentType)
+	})
+	if err != nil {
+		log.Printf("boltdb error on post comment: %v\n", err)
+		return postCommentResult{CouldNotPostReason: "database error"}
+	}
 
-		// fields that are computed on write
-		if sha256Hash != "" {
-			postedComment.AvatarHash = sha256Hash[:6]
-		}
-		if postedComment.Username == "" {
-			postedComment.Username = "Person Who Leaves Username Field Blank"
+	// shadowbanned comments are only visible to their author, so they aren't announced anywhere
+	if !shadowbanned {
+		queueWebhookEvent(webhookEventCommentCreated, &postedComment, "", nil)
+	}
+	if postedComment.Status == commentStatusPending {
+		// the repliers will be notified once the comment is approved
+		sendNotifications(&postedComment, false, true)
+		return postCommentResult{
+			Notice:   "your comment is awaiting moderation and will appear once it is approved",
+			Identity: postedComment.PosterID,
 		}
-		postedComment.DocumentID = postID
-		postedComment.Date = postedCommentDate
-		postedBytes, err := json.Marshal(postedComment)
+	}
+
+	sendNotifications(&postedComment, true, true)
+	return postCommentResult{Identity: postedComment.PosterID}
+}
+
+// storeComment saves a new comment on postedComment.DocumentID, it is used by postComment and by admin replies.
+// the caller is responsible for sending the notifications after the transaction has been committed.
+func storeComment(tx *bolt.Tx, postedComment *Comment, avatarBytes []byte, avatarContentType string) error {
+	postID := postedComment.DocumentID
+	postedCommentDate := getMillisecondsSinceUnixEpoch()
+	bucket, err := tx.CreateBucketIfNotExists([]byte(fmt.Sprintf("posts/%s", postID)))
+	if err != nil {
+		return err
+	}
+	// fields that are computed on read
+	postedComment.Replies = nil
+	postedComment.BodyHTML = ""
+	postedComment.IsAuthor = false
+	postedComment.Pinned = false
+
+	// metadata fields
+	postedComment.AvatarType = ""
+	postedComment.CaptchaChallenge = ""
+	postedComment.CaptchaNonce = ""
+	splitOnHash := strings.Split(postedComment.URL, "#")
+	postedComment.URL = splitOnHash[0]
+	// only save the email if the user requested it
+	if postedComment.NotifyOfReplies == "" || postedComment.NotifyOfReplies == "off" {
+		postedComment.Email = ""
+	}
+
+	// fields that are computed on write
+	if postedComment.Username == "" {
+		postedComment.Username = "Person Who Leaves Username Field Blank"
+	}
+	postedComment.DocumentID = postID
+	postedComment.Date = postedCommentDate
+	postedComment.Edited = 0
+	postedBytes, err := json.Marshal(postedComment)
+	if err != nil {
+		return err
+	}
+	err = bucket.Put([]byte(fmt.Sprintf("%015d", postedComment.Date)), postedBytes)
+	if err != nil {
+		return err
+	}
+
+	bucket, err = tx.CreateBucketIfNotExists([]byte("posts_index"))
+	if err != nil {
+		return err
+	}
+	err = bucket.Put([]byte(postID), postedBytes)
+	if err != nil {
+		return err
+	}
+
+	err = rememberCommentForSpamFilters(tx, postedComment)
+	if err != nil {
+		return err
+	}
+	err = indexComment(tx, postedComment)
+	if err != nil {
+		return err
+	}
+	err = recordCommentStats(tx, postedComment)
+	if err != nil {
+		return err
+	}
+	if postedComment.Status == commentStatusPending {
+		bucket, err = tx.CreateBucketIfNotExists([]byte("moderation_queue"))
 		if err != nil {
 			return err
 		}
-		err = bucket.Put([]byte(fmt.Sprintf("%015d", postedComment.Date)), postedBytes)
+		err = bucket.Put(commentKey(postID, postedComment.Date), []byte(""))
 		if err != nil {
 			return err
 		}
+	}
 
-		bucket, err = tx.CreateBucketIfNotExists([]byte("posts_index"))
+	if avatarBytes != nil && len(avatarBytes) > 0 {
+		bucket, err = tx.CreateBucketIfNotExists([]byte("avatars"))
 		if err != nil {
 			return err
 		}
-		err = bucket.Put([]byte(postID), postedBytes)
+
+		err = bucket.Put([]byte(postedComment.AvatarHash), avatarBytes)
 		if err != nil {
 			return err
 		}
-
-		if avatarBytes != nil && len(avatarBytes) > 0 {
-			bucket, err = tx.CreateBucketIfNotExists([]byte("avatars"))
-			if err != nil {
-				return err
-			}
-
-			err = bucket.Put([]byte(postedComment.AvatarHash), avatarBytes)
-			if err != nil {
-				return err
-			}
-			err = bucket.Put([]byte(fmt.Sprintf("%s_content-type", postedComment.AvatarHash)), []byte(avatarContentType))
-		}
-		return err
-	})
-	if err != nil {
-		log.Printf("boltdb error on post comment: %v\n", err)
-		return "database error"
+		err = bucket.Put([]byte(fmt.Sprintf("%s_content-type", postedComment.AvatarHash)), []byte(avatarContentType))
 	}
+	return err
+}
 
+// sendNotifications emails everyone who asked to be notified about replies in the thread the comment was posted in,
+// as well as the admin notification target.
+func sendNotifications(postedComment *Comment, notifyRepliers, notifyAdmin bool) {
 	if emailNotificationsDisabled {
 		log.Printf("skipping notifications because emailNotificationsDisabled == true\n")
-		return ""
+		return
+	}
+	ban, err := findBan(postedComment)
+	if err != nil {
+		log.Printf("skipping notifications because of boltdb error on ban check: %v\n", err)
+		return
+	}
+	if ban != nil && ban.Shadow {
+		log.Printf("skipping notifications because the author is shadowbanned\n")
+		return
 	}
 
+	postID := postedComment.DocumentID
+	notificationTarget := siteForDocument(postID).NotificationTarget
 	emailNotifications := map[string]*Comment{}
 
-	err = db.Update(func(tx *bolt.Tx) error {
+	db.Update(func(tx *bolt.Tx) error {
+		documentState, err := getDocumentState(tx, postID)
+		if err != nil {
+			return err
+		}
+		if documentState == documentStateArchived {
+			log.Printf("skipping notifications because %s is archived\n", postID)
+			return nil
+		}
+
 		bucket := tx.Bucket([]byte(fmt.Sprintf("posts/%s", postID)))
-		if bucket != nil {
+		if bucket != nil && notifyRepliers {
 			comments := map[string]*Comment{}
 			rootComments := []*Comment{}
 			bucket.ForEach(func(k, v []byte) error {
@@ -557,7 +966,12 @@ func postComment(response http.ResponseWriter, request *http.Request, postID str
 			for _, comment := range notify {
 				// dont notify the comment that was just posted about itself being posted!
 				// don't notify users about thier own comments!
-				if comment.Date == postedCommentDate || comment.AvatarHash == postedComment.AvatarHash {
+				if comment.Date == postedComment.Date || comment.AvatarHash == postedComment.AvatarHash {
+					continue
+				}
+
+				// comments that are waiting for moderation or hidden don't get notifications
+				if comment.Status != "" {
 					continue
 				}
 
@@ -582,8 +996,8 @@ func postComment(response http.ResponseWriter, request *http.Request, postID str
 			}
 		}
 
-		if len(emailNotifications) == 0 && adminEmailNotificationTarget == "" {
-			log.Printf("skipping notifications because len(emailNotifications) == 0 && adminEmailNotificationTarget == \"\"\n")
+		if len(emailNotifications) == 0 && (notificationTarget == "" || !notifyAdmin) {
+			log.Printf("skipping notifications because len(emailNotifications) == 0 && notificationTarget == \"\"\n")
 			return nil
 		}
 
@@ -626,24 +1040,30 @@ func postComment(response http.ResponseWriter, request *http.Request, postID str
 				continue
 			}
 
-			go sendEmailNotification(email, &postedComment, notifiedComment, unsubID, muteDocumentID)
+			err = queueEmailNotification(tx, email, postedComment, notifiedComment, unsubID, muteDocumentID, nil)
+			if err != nil {
+				log.Printf("couldn't send email notification to %s because couldn't queue it: %v\n", email, err)
+			}
 		}
 
-		_, adminEmailIsAlreadyNotified := emailNotifications[adminEmailNotificationTarget]
-		if adminEmailNotificationTarget != "" && !adminEmailIsAlreadyNotified {
+		_, adminEmailIsAlreadyNotified := emailNotifications[notificationTarget]
+		if notifyAdmin && notificationTarget != "" && !adminEmailIsAlreadyNotified {
 			fakeAdminNotifiedComment := Comment{
 				URL:           postedComment.URL,
 				DocumentTitle: postedComment.DocumentTitle,
 				Username:      "Admin",
 			}
 
-			go sendEmailNotification(adminEmailNotificationTarget, &postedComment, &fakeAdminNotifiedComment, "admin_notification", "admin_notification")
+			moderationLinks := getModerationLinks(postedComment)
+			err = queueEmailNotification(tx, notificationTarget, postedComment, &fakeAdminNotifiedComment, "admin_notification", "admin_notification", moderationLinks)
+			if err != nil {
+				log.Printf("couldn't send email notification to %s because couldn't queue it: %v\n", notificationTarget, err)
+			}
 		}
 
 		return nil
 	})
-
-	return ""
+	wakeEmailWorker()
 }
 
 var errAvatarNotFound = errors.New("avatar not found")
@@ -688,25 +1108,104 @@ func serveAvatar(response http.ResponseWriter, request *http.Request) {
 	response.Write(avatarBytes)
 }
 
-func returnCommentsList(response http.ResponseWriter, postID, couldNotPostReason string) {
+// stripPrivateFields removes the moderation fields, which are only visible to the admin, and renders the body
+func stripPrivateFields(comment *Comment) error {
+	comment.Status = ""
+	comment.SpamScore = 0
+	comment.SpamReasons = nil
+	comment.SpamProbability = 0
+	comment.IPAddress = ""
+	comment.UserAgent = ""
+	comment.Referrer = ""
+	comment.EmailHash = ""
+	comment.Flags = nil
+	comment.PosterID = ""
+	comment.AdminAuthor = ""
+
+	bodyHTML, err := renderCommentBody(comment)
+	if err != nil {
+		return err
+	}
+	comment.BodyHTML = bodyHTML
+	return nil
+}
+
+// renderCommentBody renders the markdown body of the comment to sanitized HTML
+func renderCommentBody(comment *Comment) (string, error) {
+	bodyHTML := string(markdown.ToHTML([]byte(comment.Body), nil, markdownRenderer))
+	return htmlsanitizer.SanitizeString(bodyHTML)
+}
+
+// buildCommentTree sorts the comments into threads, oldest first, with the pinned comment at the top.
+// the comments are keyed by <DocumentID>_<Date>, which is what InReplyTo refers to.
+// replies to comments which are not in the map are dropped, unless includeOrphans is set; then they become threads of their own.
+func buildCommentTree(comments map[string]*Comment, pinnedComment int64, includeOrphans bool) []*Comment {
+	rootComments := []*Comment{}
+	for _, comment := range comments {
+		parentComment, has := comments[comment.InReplyTo]
+		if has {
+			parentComment.Replies = append(parentComment.Replies, comment)
+		}
+		if comment.InReplyTo == "" || comment.InReplyTo == "root" || (!has && includeOrphans) {
+			rootComments = append(rootComments, comment)
+		}
+	}
+	sortCommentSlice := func(slice []*Comment) {
+		sort.Slice(slice, func(i, j int) bool {
+			return slice[i].Date < slice[j].Date
+		})
+	}
+	for _, comment := range comments {
+		sortCommentSlice(comment.Replies)
+	}
+	sortCommentSlice(rootComments)
+	return pinFirst(rootComments, pinnedComment)
+}
+
+func returnCommentsList(response http.ResponseWriter, postID string, result postCommentResult) {
 	comments := map[string]*Comment{}
+	var documentState string
+	var pinnedComment int64
 	err := db.Update(func(tx *bolt.Tx) error {
 		bucket, err := tx.CreateBucketIfNotExists([]byte(fmt.Sprintf("posts/%s", postID)))
 		if err != nil {
 			return err
 		}
+		documentState, err = getDocumentState(tx, postID)
+		if err != nil {
+			return err
+		}
+		shadowBans, err := getShadowBans(tx)
+		if err != nil {
+			return err
+		}
+		owners, err := getOwners(tx, siteForDocument(postID))
+		if err != nil {
+			return err
+		}
+		settings, err := getDocumentSettings(tx, postID)
+		if err != nil {
+			return err
+		}
+		pinnedComment = settings.PinnedComment
 		bucket.ForEach(func(k, v []byte) error {
 			var comment Comment
 			err := json.Unmarshal(v, &comment)
 			if err != nil {
 				return err
 			}
-			bodyHTML := string(markdown.ToHTML([]byte(comment.Body), nil, markdownRenderer))
-			bodyHTML, err = htmlsanitizer.SanitizeString(bodyHTML)
+			if comment.Status == commentStatusPending || comment.Status == commentStatusFlagged {
+				return nil
+			}
+			if isHiddenByShadowBan(shadowBans, &comment, result.Identity) {
+				return nil
+			}
+
+			comment.IsAuthor = isAuthor(owners, &comment)
+			err = stripPrivateFields(&comment)
 			if err != nil {
 				return err
 			}
-			comment.BodyHTML = bodyHTML
 			comments[fmt.Sprintf("%s_%d", comment.DocumentID, comment.Date)] = &comment
 			return nil
 		})
@@ -719,57 +1218,35 @@ func returnCommentsList(response http.ResponseWriter, postID, couldNotPostReason
 		return
 	}
 
-	rootComments := []*Comment{}
-	for _, comment := range comments {
-		parentComment, has := comments[comment.InReplyTo]
-		if has {
-			parentComment.Replies = append(parentComment.Replies, comment)
-		}
-		if comment.InReplyTo == "" || comment.InReplyTo == "root" {
-			rootComments = append(rootComments, comment)
-		}
-	}
-	sortCommentSlice := func(slice []*Comment) {
-		sort.Slice(slice, func(i, j int) bool {
-			return slice[i].Date < slice[j].Date
-		})
-	}
-	for _, comment := range comments {
-		sortCommentSlice(comment.Replies)
-	}
-	sortCommentSlice(rootComments)
-
-	// if it looks like we will run out of challenges soon & not currently busy getting them,
-	// then kick off a goroutine to go get them in the background.
-	if len(captchaChallenges) > 0 && len(captchaChallenges) < 5 && !loadCaptchaChallengesMutexIsProbablyLocked {
-		go loadCaptchaChallenges()
-	}
+	rootComments := buildCommentTree(comments, pinnedComment, false)
 
-	if captchaChallenges == nil || len(captchaChallenges) == 0 {
-		err = loadCaptchaChallenges()
-		if err != nil {
-			log.Printf("loading captcha challenges failed: %v\n", err)
-			response.WriteHeader(500)
-			response.Write([]byte("captcha api error"))
-			return
-		}
+	captcha := siteForDocument(postID).Captcha
+	challenge, err := captcha.takeChallenge()
+	if err != nil {
+		log.Printf("loading captcha challenges failed: %v\n", err)
+		response.WriteHeader(500)
+		response.Write([]byte("captcha api error"))
+		return
 	}
-	var challenge string
-	captchaChallengesMutex.Lock()
-	challenge = captchaChallenges[0]
-	captchaChallenges = captchaChallenges[1:]
-	captchaChallengesMutex.Unlock()
 
 	commentsData := struct {
 		CaptchaURL       string     `json:"captchaURL"`
 		CaptchaChallenge string     `json:"captchaChallenge"`
 		Comments         []*Comment `json:"comments"`
 		Error            string     `json:"error"`
+		Notice           string     `json:"notice,omitempty"`
+		DocumentState    string     `json:"documentState"`
+		IdentityToken    string     `json:"identityToken,omitempty"`
 	}{
-		CaptchaURL:       captchaPublicURL.String(),
+		CaptchaURL:       captcha.PublicURL.String(),
 		CaptchaChallenge: challenge,
 		Comments:         rootComments,
-		Error:            couldNotPostReason,
+		Error:            result.CouldNotPostReason,
+		Notice:           result.Notice,
+		DocumentState:    documentState,
+	}
+	if result.Identity != "" {
+		commentsData.IdentityToken = identityToken(result.Identity)
 	}
 
 	responseBytes, err := json.Marshal(commentsData)
@@ -780,27 +1257,58 @@ func returnCommentsList(response http.ResponseWriter, postID, couldNotPostReason
 		return
 	}
 
+	statusCode := 200
+	if result.StatusCode != 0 {
+		statusCode = result.StatusCode
+	}
+	if result.RetryAfter != 0 {
+		response.Header().Set("Retry-After", strconv.Itoa(int(result.RetryAfter.Seconds())))
+	}
 	response.Header().Set("Content-Type", "application/json")
-	response.WriteHeader(200)
+	response.WriteHeader(statusCode)
 	response.Write(responseBytes)
 }
 
-func loadCaptchaChallenges() error {
+// takeChallenge returns a captcha challenge from the pool, and refills the pool when it runs low
+func (captcha *captchaSettings) takeChallenge() (string, error) {
+	// if it looks like we will run out of challenges soon & not currently busy getting them,
+	// then kick off a goroutine to go get them in the background.
+	if len(captcha.challenges) > 0 && len(captcha.challenges) < 5 && !captcha.loadMutexIsProbablyLocked {
+		go captcha.loadChallenges()
+	}
+
+	if captcha.challenges == nil || len(captcha.challenges) == 0 {
+		err := captcha.loadChallenges()
+		if err != nil {
+			return "", err
+		}
+	}
+	captcha.challengesMutex.Lock()
+	defer captcha.challengesMutex.Unlock()
+	if len(captcha.challenges) == 0 {
+		return "", errors.New("ran out of captcha challenges")
+	}
+	challenge := captcha.challenges[0]
+	captcha.challenges = captcha.challenges[1:]
+	return challenge, nil
+}
+
+func (captcha *captchaSettings) loadChallenges() error {
 	// make sure we only call this function once at a time.
-	loadCaptchaChallengesMutex.Lock()
-	loadCaptchaChallengesMutexIsProbablyLocked = true
+	captcha.loadMutex.Lock()
+	captcha.loadMutexIsProbablyLocked = true
 	defer (func() {
-		loadCaptchaChallengesMutexIsProbablyLocked = false
-		loadCaptchaChallengesMutex.Unlock()
+		captcha.loadMutexIsProbablyLocked = false
+		captcha.loadMutex.Unlock()
 	})()
 
 	query := url.Values{}
-	query.Add("difficultyLevel", strconv.Itoa(captchaDifficultyLevel))
+	query.Add("difficultyLevel", strconv.Itoa(captcha.DifficultyLevel))
 
 	loadURL := url.URL{
-		Scheme:   captchaAPIURL.Scheme,
-		Host:     captchaAPIURL.Host,
-		Path:     filepath.Join(captchaAPIURL.Path, "GetChallenges"),
+		Scheme:   captcha.APIURL.Scheme,
+		Host:     captcha.APIURL.Host,
+		Path:     filepath.Join(captcha.APIURL.Path, "GetChallenges"),
 		RawQuery: query.Encode(),
 	}
 
@@ -808,7 +1316,7 @@ func loadCaptchaChallenges() error {
 	if err != nil {
 		return err
 	}
-	captchaRequest.Header.Set("Authorization", fmt.Sprintf("Bearer %s", captchaAPIToken))
+	captchaRequest.Header.Set("Authorization", fmt.Sprintf("Bearer %s", captcha.APIToken))
 
 	response, err := httpClient.Do(captchaRequest)
 	if err != nil {
@@ -827,28 +1335,32 @@ func loadCaptchaChallenges() error {
 		)
 	}
 
-	err = json.Unmarshal(responseBytes, &captchaChallenges)
+	var challenges []string
+	err = json.Unmarshal(responseBytes, &challenges)
 	if err != nil {
 		return err
 	}
 
-	if len(captchaChallenges) == 0 {
+	if len(challenges) == 0 {
 		return errors.New("proof of work captcha challenges api returned empty array")
 	}
 
+	captcha.challengesMutex.Lock()
+	captcha.challenges = challenges
+	captcha.challengesMutex.Unlock()
 	return nil
 }
 
-func validateCaptcha(challenge, nonce string) error {
+func (captcha *captchaSettings) validate(challenge, nonce string) error {
 	query := url.Values{}
 	query.Add("challenge", challenge)
 	query.Add("nonce", nonce)
-	query.Add("token", captchaAPIToken)
+	query.Add("token", captcha.APIToken)
 
 	verifyURL := url.URL{
-		Scheme:   captchaAPIURL.Scheme,
-		Host:     captchaAPIURL.Host,
-		Path:     filepath.Join(captchaAPIURL.Path, "Verify"),
+		Scheme:   captcha.APIURL.Scheme,
+		Host:     captcha.APIURL.Host,
+		Path:     filepath.Join(captcha.APIURL.Path, "Verify"),
 		RawQuery: query.Encode(),
 	}
 
@@ -856,7 +1368,7 @@ func validateCaptcha(challenge, nonce string) error {
 	if err != nil {
 		return err
 	}
-	captchaRequest.Header.Set("Authorization", fmt.Sprintf("Bearer %s", captchaAPIToken))
+	captchaRequest.Header.Set("Authorization", fmt.Sprintf("Bearer %s", captcha.APIToken))
 
 	response, err := httpClient.Do(captchaRequest)
 	if err != nil {
@@ -958,20 +1470,9 @@ func unsubscribeNotification(responseWriter http.ResponseWriter, request *http.R
 	}
 }
 
-func sendEmailNotification(email string, postedComment, notifiedComment *Comment, unsubID, muteDocumentID string) {
-
-	// since this will be called in a goroutine, we need to do this in case we hit a panic(),
-	// otherwise it will fail silently...?
-	defer (func() {
-		if r := recover(); r != nil {
-			fmt.Printf("sendEmailNotification(): panic: %v\n", r)
-			debug.PrintStack()
-		}
-	})()
-
-	log.Printf("attempting to send email notification to %s because <%s,%s> replied (on '%s', unsubID=%s)\n",
-		email, postedComment.Username, postedComment.Email, notifiedComment.DocumentTitle, unsubID)
-
+// queueEmailNotification puts the notification about postedComment into the outbox, unless email was already
+// notified about it
+func queueEmailNotification(tx *bolt.Tx, email string, postedComment, notifiedComment *Comment, unsubID, muteDocumentID string, moderationLinks []moderationLink) error {
 	addressedTo := notifiedComment.Username
 	if addressedTo == "" {
 		addressedTo = "Commenter"
@@ -980,10 +1481,25 @@ func sendEmailNotification(email string, postedComment, notifiedComment *Comment
 	if other == "" {
 		addressedTo = "Someone"
 	}
-	disableArticleLink := fmt.Sprintf("%s/disable/%s", commentsURLString, muteDocumentID)
-	unsubscribeLink := fmt.Sprintf("%s/unsubscribe/%s", commentsURLString, unsubID)
+	site := siteForDocument(postedComment.DocumentID)
+	disableArticleLink := fmt.Sprintf("%s/disable/%s", site.URL, muteDocumentID)
+	unsubscribeLink := fmt.Sprintf("%s/unsubscribe/%s", site.URL, unsubID)
 	htmlEscapedBody := strings.ReplaceAll(postedComment.Body, "<", "&lt;")
 	htmlEscapedBody = strings.ReplaceAll(htmlEscapedBody, ">", "&gt;")
+
+	// the admin notification contains signed links to moderate the comment without logging in
+	moderationPlain := ""
+	moderationHTML := ""
+	if len(moderationLinks) > 0 {
+		moderationPlain = "Moderate this comment:\n\n"
+		moderationHTML = "Moderate this comment:"
+		for _, link := range moderationLinks {
+			moderationPlain += fmt.Sprintf("%s: %s\n\n", link.Action, link.URL)
+			moderationHTML += fmt.Sprintf(` <a href="%s">%s</a>`, link.URL, link.Action)
+		}
+		moderationHTML += "<br/>\n"
+	}
+
 	bodyPlain := fmt.Sprintf(
 		`%s,
 
@@ -996,7 +1512,7 @@ at: %s
 
 %s
 
----------------------------------------------------------------------
+%s---------------------------------------------------------------------
 
 To disable notifications for future comments on this article, please 
 visit the following link in your web browser:
@@ -1011,7 +1527,7 @@ the following link in your web browser:
 
 
 Powered by SequentialRead Comments: https://git.sequentialread.com/forest/sequentialread-comments
-`, addressedTo, other, notifiedComment.DocumentTitle, notifiedComment.URL, postedComment.Body, disableArticleLink, unsubscribeLink)
+`, addressedTo, other, notifiedComment.DocumentTitle, notifiedComment.URL, postedComment.Body, moderationPlain, disableArticleLink, unsubscribeLink)
 
 	bodyPlain = softWrapString(bodyPlain, 72)
 
@@ -1022,7 +1538,7 @@ Powered by SequentialRead Comments: https://git.sequentialread.com/forest/sequen
 <br/>
 %s<br/>
 <br/>
-<br/>
+%s<br/>
 <div style="padding:2em; border-top: 1px solid #aaa;">
 <span style="font-size:0.9em">If you believe you have recieved this message in error, please click the unsubscribe link below.</span><br/>
 <br/>
@@ -1034,12 +1550,20 @@ Powered by <a style="font-size:0.9em" href="https://git.sequentialread.com/fores
 </div>
 
 `, addressedTo, other, notifiedComment.URL, postedComment.DocumentID, postedComment.Date,
-		notifiedComment.URL, notifiedComment.DocumentTitle, htmlEscapedBody, disableArticleLink, unsubscribeLink)
+		notifiedComment.URL, notifiedComment.DocumentTitle, htmlEscapedBody, moderationHTML, disableArticleLink, unsubscribeLink)
 
-	err := sendEmail(email, fmt.Sprintf("New Reply on '%s'", notifiedComment.DocumentTitle), bodyPlain, bodyHTML)
+	queued, err := queueEmail(tx, commentEmailKey(postedComment, email), site.EmailFrom, email,
+		fmt.Sprintf("New Reply on '%s'", notifiedComment.DocumentTitle), bodyPlain, bodyHTML)
 	if err != nil {
-		log.Printf("email delivery issue for %s: %v\n", email, err)
+		return err
 	}
+	if queued {
+		log.Printf("queued email notification to %s because <%s,%s> replied (on '%s', unsubID=%s)\n",
+			email, postedComment.Username, postedComment.Email, notifiedComment.DocumentTitle, unsubID)
+	} else {
+		log.Printf("skipping email notification to %s about %s_%d because it was already sent\n", email, postedComment.DocumentID, postedComment.Date)
+	}
+	return nil
 }
 
 func softWrapString(text string, columns int) string {
@@ -1069,7 +1593,7 @@ func softWrapString(text string, columns int) string {
 
 }
 
-func sendEmail(to, subject, bodyPlain, bodyHTML string) error {
+func sendEmail(from, to, subject, bodyPlain, bodyHTML string) error {
 	smtpClient := mail.NewSMTPClient()
 	smtpClient.Host = emailHost
 	smtpClient.Port = emailPort
@@ -1092,7 +1616,7 @@ func sendEmail(to, subject, bodyPlain, bodyHTML string) error {
 
 	email := mail.NewMSG()
 
-	email.SetFrom(emailUsername)
+	email.SetFrom(from)
 	email.AddTo(to)
 	email.SetSubject(subject)
 	email.SetBody(mail.TextPlain, bodyPlain)
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+	"github.com/boltdb/bolt"
+)
+
+const moderationActionApprove = "approve"
+const moderationActionDelete = "delete"
+const moderationActionSpam = "spam"
+const moderationActionBan = "ban"
+
+var errCommentNotFound = errors.New("comment not found")
+var errModerationActionNotAllowed = errors.New("only the admins of the default site can mark comments as spam or ban their authors")
+
+// spam and ban change the bans, the spammer identities and the spam classifier, which are shared by all sites,
+// so only the admins of the default site may use them. siteName is empty for the default site.
+func moderationActionAllowed(siteName, action string) bool {
+	return siteName == "" || (action != moderationActionSpam && action != moderationActionBan)
+}
+
+var deletedRetentionDaysString = "$COMMENTS_DELETED_RETENTION_DAYS"
+var deletedRetentionDays = 30
+
+func initModeration() {
+	deletedRetentionDaysString = os.ExpandEnv(deletedRetentionDaysString)
+	if deletedRetentionDaysString != "" {
+		var err error
+		deletedRetentionDays, err = strconv.Atoi(deletedRetentionDaysString)
+		if err != nil {
+			panic(errors.Wrapf(err, "can't parse COMMENTS_DELETED_RETENTION_DAYS '%s' as int", deletedRetentionDaysString))
+		}
+	}
+}
+
+// purgeDeletedCommentsForever runs in its own goroutine
+func purgeDeletedCommentsForever() {
+	for {
+		purged, err := purgeDeletedComments()
+		if err != nil {
+			log.Printf("failed to purge deleted comments: %v\n", err)
+		} else if purged > 0 {
+			log.Printf("purged %d comments which were deleted more than %d days ago\n", purged, deletedRetentionDays)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// commentKey identifies a single comment across all documents, it is used as the key in buckets like moderation_queue
+func commentKey(postID string, date int64) []byte {
+	return []byte(fmt.Sprintf("%s/%015d", postID, date))
+}
+
+func parseCommentKey(key string) (string, int64, error) {
+	lastSlash := strings.LastIndex(key, "/")
+	if lastSlash == -1 {
+		return "", 0, fmt.Errorf("malformed comment key '%s'", key)
+	}
+	date, err := strconv.ParseInt(key[lastSlash+1:], 10, 64)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "malformed comment key '%s'", key)
+	}
+	return key[:lastSlash], date, nil
+}
+
+// getComment reads a single comment out of the posts/<postID> bucket
+func getComment(tx *bolt.Tx, postID string, date int64) (*Comment, error) {
+	bucket := tx.Bucket([]byte(fmt.Sprintf("posts/%s", postID)))
+	if bucket == nil {
+		return nil, errBucketNotFound
+	}
+	commentBytes := bucket.Get([]byte(fmt.Sprintf("%015d", date)))
+	if commentBytes == nil {
+		return nil, errCommentNotFound
+	}
+	var comment Comment
+	err := json.Unmarshal(commentBytes, &comment)
+	if err != nil {
+		return nil, err
+	}
+	return &comment, nil
+}
+
+// DeletedComment is kept in the deleted_comments bucket, keyed by commentKey, so it can be restored
+// until it is purged COMMENTS_DELETED_RETENTION_DAYS later.
+type DeletedComment struct {
+	Deleted int64   `json:"deleted"`
+	Comment Comment `json:"comment"`
+}
+
+// deleteComment removes a single comment from the posts/<postID> bucket and from the search index
+func deleteComment(tx *bolt.Tx, comment *Comment) error {
+	bucket := tx.Bucket([]byte(fmt.Sprintf("posts/%s", comment.DocumentID)))
+	if bucket == nil {
+		return errBucketNotFound
+	}
+	err := bucket.Delete([]byte(fmt.Sprintf("%015d", comment.Date)))
+	if err != nil {
+		return err
+	}
+	if deletedRetentionDays == 0 {
+		err = deleteCommentEmailKeys(tx, comment.DocumentID, comment.Date)
+		if err != nil {
+			return err
+		}
+	} else {
+		deletedBucket, err := tx.CreateBucketIfNotExists([]byte("deleted_comments"))
+		if err != nil {
+			return err
+		}
+		deletedBytes, err := json.Marshal(DeletedComment{Deleted: getMillisecondsSinceUnixEpoch(), Comment: *comment})
+		if err != nil {
+			return err
+		}
+		err = deletedBucket.Put(commentKey(comment.DocumentID, comment.Date), deletedBytes)
+		if err != nil {
+			return err
+		}
+	}
+	return unindexComment(tx, comment)
+}
+
+// restoreComment puts a deleted comment back where it was
+func restoreComment(tx *bolt.Tx, postID string, date int64) (*Comment, error) {
+	deletedBucket := tx.Bucket([]byte("deleted_comments"))
+	if deletedBucket == nil {
+		return nil, errCommentNotFound
+	}
+	key := commentKey(postID, date)
+	deletedBytes := deletedBucket.Get(key)
+	if deletedBytes == nil {
+		return nil, errCommentNotFound
+	}
+	var deleted DeletedComment
+	err := json.Unmarshal(deletedBytes, &deleted)
+	if err != nil {
+		return nil, err
+	}
+	err = deletedBucket.Delete(key)
+	if err != nil {
+		return nil, err
+	}
+	err = putComment(tx, &deleted.Comment)
+	if err != nil {
+		return nil, err
+	}
+	// pending and flagged comments go back to waiting for an admin
+	if deleted.Comment.Status != "" {
+		queue, err := tx.CreateBucketIfNotExists([]byte("moderation_queue"))
+		if err != nil {
+			return nil, err
+		}
+		err = queue.Put(key, []byte(""))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &deleted.Comment, indexComment(tx, &deleted.Comment)
+}
+
+func getDeletedComments(tx *bolt.Tx) ([]DeletedComment, error) {
+	deletedComments := []DeletedComment{}
+	deletedBucket := tx.Bucket([]byte("deleted_comments"))
+	if deletedBucket == nil {
+		return deletedComments, nil
+	}
+	err := deletedBucket.ForEach(func(k, v []byte) error {
+		var deleted DeletedComment
+		err := json.Unmarshal(v, &deleted)
+		if err != nil {
+			return err
+		}
+		deletedComments = append(deletedComments, deleted)
+		return nil
+	})
+	return deletedComments, err
+}
+
+// purgeDeletedComments permanently deletes the comments which were deleted more than COMMENTS_DELETED_RETENTION_DAYS ago
+func purgeDeletedComments() (int, error) {
+	purged := 0
+	cutoff := time.Now().Add(-time.Hour*24*time.Duration(deletedRetentionDays)).UnixNano() / int64(time.Millisecond)
+	err := db.Update(func(tx *bolt.Tx) error {
+		deletedBucket := tx.Bucket([]byte("deleted_comments"))
+		if deletedBucket == nil {
+			return nil
+		}
+		cursor := deletedBucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var deleted DeletedComment
+			err := json.Unmarshal(v, &deleted)
+			if err != nil {
+				return err
+			}
+			if deleted.Deleted < cutoff {
+				err = cursor.Delete()
+				if err != nil {
+					return err
+				}
+				err = deleteCommentEdits(tx, deleted.Comment.DocumentID, deleted.Comment.Date)
+				if err != nil {
+					return err
+				}
+				err = deleteCommentEmailKeys(tx, deleted.Comment.DocumentID, deleted.Comment.Date)
+				if err != nil {
+					return err
+				}
+				purged++
+			}
+		}
+		return nil
+	})
+	return purged, err
+}
+
+// putComment overwrites a single comment in the posts/<postID> bucket
+func putComment(tx *bolt.Tx, comment *Comment) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(fmt.Sprintf("posts/%s", comment.DocumentID)))
+	if err != nil {
+		return err
+	}
+	commentBytes, err := json.Marshal(comment)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(fmt.Sprintf("%015d", comment.Date)), commentBytes)
+}
+
+// moderateComment applies an admin moderation action to a comment inside the given transaction
+// and returns the comment as it was before the action was applied.
+// side effects which should only happen after the transaction commits are handled by afterModeration.
+func moderateComment(tx *bolt.Tx, postID string, date int64, action string) (*Comment, error) {
+	comment, err := getComment(tx, postID, date)
+	if err != nil {
+		return nil, err
+	}
+
+	queue, err := tx.CreateBucketIfNotExists([]byte("moderation_queue"))
+	if err != nil {
+		return nil, err
+	}
+	err = queue.Delete(commentKey(postID, date))
+	if err != nil {
+		return nil, err
+	}
+
+	switch action {
+	case moderationActionApprove:
+		err = trainBayes(tx, comment, bayesLabelHam)
+		if err != nil {
+			return nil, err
+		}
+		approved := *comment
+		approved.Status = ""
+		approved.Flags = nil
+		return comment, putComment(tx, &approved)
+	case moderationActionSpam:
+		err = markIdentityAsSpammer(tx, comment.AvatarHash)
+		if err != nil {
+			return nil, err
+		}
+		err = trainBayes(tx, comment, bayesLabelSpam)
+		if err != nil {
+			return nil, err
+		}
+		return comment, deleteComment(tx, comment)
+	case moderationActionBan:
+		err = banAuthor(tx, comment, fmt.Sprintf("author of comment %s_%d", postID, date), 0)
+		if err != nil {
+			return nil, err
+		}
+		return comment, deleteComment(tx, comment)
+	case moderationActionDelete:
+		return comment, deleteComment(tx, comment)
+	}
+	return nil, fmt.Errorf("unknown moderation action '%s'", action)
+}
+
+// afterModeration is called once the transaction containing moderateComment has been committed.
+func afterModeration(comment *Comment, action string) {
+	if action == moderationActionApprove {
+		approved := *comment
+		approved.Status = ""
+		approved.Flags = nil
+		queueWebhookEvent(webhookEventCommentApproved, &approved, action, nil)
+		if comment.Status == commentStatusPending {
+			go sendNotifications(&approved, true, false)
+			go akismetSubmit("submit-ham", &approved)
+		}
+		return
+	}
+	queueWebhookEvent(webhookEventCommentDeleted, comment, action, nil)
+	if action == moderationActionSpam {
+		go akismetSubmit("submit-spam", comment)
+	}
+}
+
+// getModerationQueue returns all the comments which are waiting for an admin to approve them
+func getModerationQueue(tx *bolt.Tx) ([]Comment, error) {
+	pending := []Comment{}
+	queue := tx.Bucket([]byte("moderation_queue"))
+	if queue == nil {
+		return pending, nil
+	}
+	err := queue.ForEach(func(k, v []byte) error {
+		postID, date, err := parseCommentKey(string(k))
+		if err != nil {
+			return err
+		}
+		comment, err := getComment(tx, postID, date)
+		if err == errCommentNotFound || err == errBucketNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		pending = append(pending, *comment)
+		return nil
+	})
+	return pending, err
+}
+
+// adminModerateComment handles the moderation forms on the admin page of a document. the action defaults to delete.
+func adminModerateComment(request *http.Request, postID string) error {
+	date, err := strconv.ParseInt(request.Form.Get("date"), 10, 64)
+	if err != nil {
+		return err
+	}
+	action := request.Form.Get("action")
+	if action == "" {
+		action = moderationActionDelete
+	}
+	if !moderationActionAllowed(adminUserFromRequest(request).Site, action) {
+		return errModerationActionNotAllowed
+	}
+	var moderatedComment *Comment
+	err = db.Update(func(tx *bolt.Tx) error {
+		moderatedComment, err = moderateComment(tx, postID, date, action)
+		if err != nil {
+			return err
+		}
+		return recordAudit(tx, newAuditEntry(request, commentAuditAction(action)).withComment(moderatedComment))
+	})
+	if err == errCommentNotFound {
+		return nil
+	}
+	if err == nil {
+		log.Printf("admin: %s comment %s_%d\n", action, postID, date)
+		afterModeration(moderatedComment, action)
+	}
+	return err
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+	"github.com/boltdb/bolt"
+)
+
+// moderation links let the admin approve, delete or ban straight from the notification email without logging in.
+// they are signed with a random key which is kept in the database.
+const moderationLinkSecretName = "moderation links"
+
+var moderationLinkHoursString = "$COMMENTS_MODERATION_LINK_HOURS"
+var moderationLinkLifetime = time.Hour * 72
+var moderationLinkKey []byte
+
+var errModerationLinkInvalid = errors.New("this link is invalid")
+var errModerationLinkExpired = errors.New("this link has expired")
+
+type moderationLink struct {
+	Action string
+	URL    string
+}
+
+func initModerationLinks() {
+	moderationLinkHoursString = os.ExpandEnv(moderationLinkHoursString)
+	if moderationLinkHoursString != "" {
+		hours, err := strconv.Atoi(moderationLinkHoursString)
+		if err != nil {
+			panic(errors.Wrapf(err, "can't parse COMMENTS_MODERATION_LINK_HOURS '%s' as int", moderationLinkHoursString))
+		}
+		moderationLinkLifetime = time.Hour * time.Duration(hours)
+	}
+}
+
+// loadModerationLinkKey is called once the database is open
+func loadModerationLinkKey() {
+	err := db.Update(func(tx *bolt.Tx) error {
+		var err error
+		moderationLinkKey, err = getSecret(tx, moderationLinkSecretName)
+		return err
+	})
+	if err != nil {
+		panic(errors.Wrapf(err, "could not load the moderation link key"))
+	}
+}
+
+func moderationLinkSignature(key, action string, expires int64) string {
+	mac := hmac.New(sha256.New, moderationLinkKey)
+	mac.Write([]byte(fmt.Sprintf("%s\n%s\n%d", key, action, expires)))
+	return fmt.Sprintf("%x", mac.Sum(nil))
+}
+
+// getModerationLinks returns no links when the admin panel is turned off or the links are turned off
+func getModerationLinks(comment *Comment) []moderationLink {
+	if !adminEnabled || moderationLinkLifetime <= 0 {
+		return []moderationLink{}
+	}
+	actions := []string{moderationActionDelete}
+	if moderationActionAllowed(siteForDocument(comment.DocumentID).Name, moderationActionBan) {
+		actions = append(actions, moderationActionBan)
+	}
+	if comment.Status != "" {
+		actions = append([]string{moderationActionApprove}, actions...)
+	}
+	key := string(commentKey(comment.DocumentID, comment.Date))
+	expires := time.Now().Add(moderationLinkLifetime).Unix()
+	links := []moderationLink{}
+	for _, action := range actions {
+		query := url.Values{}
+		query.Set("comment", key)
+		query.Set("action", action)
+		query.Set("expires", strconv.FormatInt(expires, 10))
+		query.Set("signature", moderationLinkSignature(key, action, expires))
+		links = append(links, moderationLink{
+			Action: action,
+			URL:    fmt.Sprintf("%s/moderate/?%s", siteForDocument(comment.DocumentID).URL, query.Encode()),
+		})
+	}
+	return links
+}
+
+func verifyModerationLink(query url.Values) (string, int64, string, error) {
+	key := query.Get("comment")
+	action := query.Get("action")
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return "", 0, "", errModerationLinkInvalid
+	}
+	expectedSignature := moderationLinkSignature(key, action, expires)
+	if !hmac.Equal([]byte(expectedSignature), []byte(query.Get("signature"))) {
+		return "", 0, "", errModerationLinkInvalid
+	}
+	if time.Now().Unix() > expires {
+		return "", 0, "", errModerationLinkExpired
+	}
+	postID, date, err := parseCommentKey(key)
+	if err != nil || !moderationActionAllowed(siteForDocument(postID).Name, action) {
+		return "", 0, "", errModerationLinkInvalid
+	}
+	return postID, date, action, nil
+}
+
+// moderateFromLink shows a confirmation page on GET, so link previews and email scanners can't moderate anything,
+// and only executes the action when the admin submits that page.
+func moderateFromLink(responseWriter http.ResponseWriter, request *http.Request) {
+	templateData := struct {
+		Action  string
+		Comment *Comment
+		Query   url.Values
+		Done    bool
+		Error   string
+	}{}
+
+	if request.Method == "POST" {
+		err := request.ParseForm()
+		if err != nil {
+			responseWriter.WriteHeader(400)
+			responseWriter.Write([]byte("400 bad request"))
+			return
+		}
+	}
+	// on POST, the signed parameters are posted back as hidden fields
+	query := request.URL.Query()
+	if request.Method == "POST" {
+		query = request.PostForm
+	}
+
+	postID, date, action, err := verifyModerationLink(query)
+	if err != nil {
+		templateData.Error = err.Error()
+		responseWriter.WriteHeader(403)
+		renderAdminTemplate(responseWriter, request, "moderate.html.gotemplate", templateData)
+		return
+	}
+	templateData.Action = action
+	templateData.Query = query
+
+	if request.Method == "POST" {
+		var comment *Comment
+		err = db.Update(func(tx *bolt.Tx) error {
+			var err error
+			comment, err = moderateComment(tx, postID, date, action)
+			if err != nil {
+				return err
+			}
+			return recordAudit(tx, newAuditEntry(request, commentAuditAction(action)).withComment(comment))
+		})
+		if err == nil {
+			log.Printf("admin: %s comment %s_%d from an email link\n", action, postID, date)
+			afterModeration(comment, action)
+			templateData.Comment = comment
+			templateData.Done = true
+		}
+	} else {
+		err = db.View(func(tx *bolt.Tx) error {
+			var err error
+			templateData.Comment, err = getComment(tx, postID, date)
+			return err
+		})
+	}
+	if err == errCommentNotFound || err == errBucketNotFound {
+		templateData.Error = "this comment no longer exists"
+		responseWriter.WriteHeader(404)
+		renderAdminTemplate(responseWriter, request, "moderate.html.gotemplate", templateData)
+		return
+	}
+	if err != nil {
+		log.Printf("moderate from link failed: %v\n", err)
+		responseWriter.WriteHeader(500)
+		responseWriter.Write([]byte("500 internal server error"))
+		return
+	}
+
+	renderAdminTemplate(responseWriter, request, "moderate.html.gotemplate", templateData)
+}
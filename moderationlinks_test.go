@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerifyModerationLink(t *testing.T) {
+	adminEnabled = true
+	moderationLinkKey = []byte("test key")
+	moderationLinkLifetime = time.Hour
+	defaultSite = &Site{URL: "https://comments.example.com"}
+
+	links := getModerationLinks(&Comment{DocumentID: "my-post", Date: 1600000000000, Status: commentStatusPending})
+	if len(links) != 3 {
+		t.Fatalf("expected approve, delete and ban links for a pending comment, got %d", len(links))
+	}
+	linkURL, err := url.Parse(links[0].URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := linkURL.Query()
+
+	postID, date, action, err := verifyModerationLink(valid)
+	if err != nil || postID != "my-post" || date != 1600000000000 || action != links[0].Action {
+		t.Fatalf("the link should be valid, got %s %d %s %v", postID, date, action, err)
+	}
+
+	expiredQuery := url.Values{}
+	expired := time.Now().Add(-time.Minute).Unix()
+	expiredQuery.Set("comment", valid.Get("comment"))
+	expiredQuery.Set("action", valid.Get("action"))
+	expiredQuery.Set("expires", strconv.FormatInt(expired, 10))
+	expiredQuery.Set("signature", moderationLinkSignature(valid.Get("comment"), valid.Get("action"), expired))
+
+	tests := []struct {
+		name  string
+		field string
+		value string
+	}{
+		{"other action", "action", moderationActionBan},
+		{"other comment", "comment", string(commentKey("my-post", 1600000000001))},
+		{"later expiry", "expires", strconv.FormatInt(time.Now().Add(time.Hour*24*365).Unix(), 10)},
+		{"broken expiry", "expires", "soon"},
+		{"other signature", "signature", moderationLinkSignature("x", "y", 1)},
+		{"missing signature", "signature", ""},
+	}
+	for _, test := range tests {
+		tampered := url.Values{}
+		for key, values := range valid {
+			tampered[key] = append([]string{}, values...)
+		}
+		tampered.Set(test.field, test.value)
+		if _, _, _, err := verifyModerationLink(tampered); err != errModerationLinkInvalid {
+			t.Errorf("%s: expected '%v', got '%v'", test.name, errModerationLinkInvalid, err)
+		}
+	}
+
+	if _, _, _, err := verifyModerationLink(expiredQuery); err != errModerationLinkExpired {
+		t.Errorf("expected an expired link to fail with '%v', got '%v'", errModerationLinkExpired, err)
+	}
+
+	moderationLinkKey = []byte("another key")
+	if _, _, _, err := verifyModerationLink(valid); err != errModerationLinkInvalid {
+		t.Errorf("a link signed with another key should be invalid, got '%v'", err)
+	}
+}
+
+func TestModerationLinksOfNamedSites(t *testing.T) {
+	adminEnabled = true
+	moderationLinkKey = []byte("test key")
+	moderationLinkLifetime = time.Hour
+	defaultSite = &Site{URL: "https://comments.example.com"}
+	namedSites = map[string]*Site{"blog": {Name: "blog", URL: "https://blog.example.com/comments"}}
+	defer (func() { namedSites = map[string]*Site{} })()
+
+	comment := &Comment{DocumentID: "blog~my-post", Date: 1600000000000}
+	for _, link := range getModerationLinks(comment) {
+		if link.Action == moderationActionBan {
+			t.Error("the documents of a named site should not get a ban link")
+		}
+	}
+
+	key := string(commentKey(comment.DocumentID, comment.Date))
+	expires := time.Now().Add(time.Hour).Unix()
+	query := url.Values{}
+	query.Set("comment", key)
+	query.Set("action", moderationActionBan)
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("signature", moderationLinkSignature(key, moderationActionBan, expires))
+	if _, _, _, err := verifyModerationLink(query); err != errModerationLinkInvalid {
+		t.Errorf("a signed ban link for a named site should be rejected, got '%v'", err)
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// emails are not sent right away, they are put into the email_outbox bucket and sendEmailsForever sends them.
+// the outbox is keyed by a deduplication key, so the same email is never sent twice, for example when a comment is
+// approved again. an email which could not be sent is retried after emailFirstRetry, and the wait doubles with every
+// further failure, up to emailRetryMax. after emailMaxAttempts it is given up.
+const emailStateQueued = "queued"
+const emailStateSent = "sent"
+const emailStateFailed = "failed"
+
+const emailMaxAttempts = 10
+const emailFirstRetry = time.Minute
+const emailRetryMax = time.Hour * 6
+
+// sent and failed emails stay in the outbox for this long, so they show up on the admin page. after that, the keys of
+// the emails about a comment move to the email_sent_keys bucket, so they still aren't sent again while the comment
+// exists. they are removed when the comment is deleted for good.
+const emailOutboxRetention = time.Hour * 24 * 7
+
+// the admin page only shows the most recent emails
+const adminEmailsLimit = 500
+
+const auditActionEmailRetry = "email.retry"
+const auditActionEmailDelete = "email.delete"
+
+type OutboxEmail struct {
+	Key         string `json:"key"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+	Subject     string `json:"subject"`
+	BodyPlain   string `json:"bodyPlain"`
+	BodyHTML    string `json:"bodyHTML"`
+	State       string `json:"state"`
+	Created     int64  `json:"created"`
+	Attempts    int    `json:"attempts"`
+	NextAttempt int64  `json:"nextAttempt,omitempty"`
+	LastAttempt int64  `json:"lastAttempt,omitempty"`
+	LastError   string `json:"lastError,omitempty"`
+}
+
+// emailWake is signalled after emails were queued, so they don't have to wait for the next poll
+var emailWake = make(chan bool, 1)
+
+// commentEmailKey deduplicates the notifications about a comment, every recipient gets at most one
+func commentEmailKey(comment *Comment, recipient string) string {
+	return fmt.Sprintf("%s %s", commentKey(comment.DocumentID, comment.Date), strings.ToLower(recipient))
+}
+
+// emailCommentKey returns the commentKey of the comment which the email is about, the keys of the notifications about
+// a comment start with it. it returns an empty string if the comment doesn't exist anymore or the email isn't about one.
+func emailCommentKey(tx *bolt.Tx, key string) string {
+	commentKeyString := strings.SplitN(key, " ", 2)[0]
+	postID, date, err := parseCommentKey(commentKeyString)
+	if err != nil {
+		return ""
+	}
+	if _, err := getComment(tx, postID, date); err == nil {
+		return commentKeyString
+	}
+	if deletedBucket := tx.Bucket([]byte("deleted_comments")); deletedBucket != nil && deletedBucket.Get([]byte(commentKeyString)) != nil {
+		return commentKeyString
+	}
+	return ""
+}
+
+// deleteCommentEmailKeys is called when a comment is deleted for good
+func deleteCommentEmailKeys(tx *bolt.Tx, postID string, date int64) error {
+	bucket := tx.Bucket([]byte("email_sent_keys"))
+	if bucket == nil {
+		return nil
+	}
+	prefix := append(commentKey(postID, date), ' ')
+	cursor := bucket.Cursor()
+	for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Seek(prefix) {
+		err := cursor.Delete()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queueEmail returns false if an email with the same key is already in the outbox or was sent before.
+// call wakeEmailWorker once the transaction has been committed.
+func queueEmail(tx *bolt.Tx, key, from, to, subject, bodyPlain, bodyHTML string) (bool, error) {
+	bucket, err := tx.CreateBucketIfNotExists([]byte("email_outbox"))
+	if err != nil {
+		return false, err
+	}
+	if bucket.Get([]byte(key)) != nil {
+		return false, nil
+	}
+	if sentKeys := tx.Bucket([]byte("email_sent_keys")); sentKeys != nil && sentKeys.Get([]byte(key)) != nil {
+		return false, nil
+	}
+	now := getMillisecondsSinceUnixEpoch()
+	return true, putOutboxEmail(tx, &OutboxEmail{
+		Key:         key,
+		From:        from,
+		To:          to,
+		Subject:     subject,
+		BodyPlain:   bodyPlain,
+		BodyHTML:    bodyHTML,
+		State:       emailStateQueued,
+		Created:     now,
+		NextAttempt: now,
+	})
+}
+
+func putOutboxEmail(tx *bolt.Tx, email *OutboxEmail) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte("email_outbox"))
+	if err != nil {
+		return err
+	}
+	emailBytes, err := json.Marshal(email)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(email.Key), emailBytes)
+}
+
+func getOutboxEmails(tx *bolt.Tx) ([]OutboxEmail, error) {
+	emails := []OutboxEmail{}
+	bucket := tx.Bucket([]byte("email_outbox"))
+	if bucket == nil {
+		return emails, nil
+	}
+	err := bucket.ForEach(func(k, v []byte) error {
+		var email OutboxEmail
+		err := json.Unmarshal(v, &email)
+		if err != nil {
+			return err
+		}
+		emails = append(emails, email)
+		return nil
+	})
+	return emails, err
+}
+
+func wakeEmailWorker() {
+	select {
+	case emailWake <- true:
+	default:
+	}
+}
+
+// sendEmailsForever runs in its own goroutine. emails which were still queued when the server stopped are sent
+// when it starts again.
+func sendEmailsForever() {
+	for {
+		wait := sendDueEmails()
+		select {
+		case <-emailWake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// sendDueEmails attempts every email which is due, removes the old ones,
+// and returns how long to wait until the next one is due
+func sendDueEmails() time.Duration {
+	// since this will be called in a goroutine, we need to do this in case we hit a panic()
+	defer (func() {
+		if r := recover(); r != nil {
+			fmt.Printf("sendDueEmails(): panic: %v\n", r)
+			debug.PrintStack()
+		}
+	})()
+
+	wait := time.Minute
+	now := getMillisecondsSinceUnixEpoch()
+	cutoff := now - int64(emailOutboxRetention/time.Millisecond)
+	due := []OutboxEmail{}
+	expired := []string{}
+	err := db.View(func(tx *bolt.Tx) error {
+		emails, err := getOutboxEmails(tx)
+		for _, email := range emails {
+			if email.State != emailStateQueued {
+				if email.Created < cutoff {
+					expired = append(expired, email.Key)
+				}
+			} else if email.NextAttempt <= now {
+				due = append(due, email)
+			} else if untilDue := time.Duration(email.NextAttempt-now) * time.Millisecond; untilDue < wait {
+				wait = untilDue
+			}
+		}
+		return err
+	})
+	if err != nil {
+		log.Printf("failed to read the email outbox: %v\n", err)
+		return wait
+	}
+
+	if len(expired) > 0 {
+		err = db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket([]byte("email_outbox"))
+			sentKeys, err := tx.CreateBucketIfNotExists([]byte("email_sent_keys"))
+			if err != nil {
+				return err
+			}
+			for _, key := range expired {
+				err := bucket.Delete([]byte(key))
+				if err != nil {
+					return err
+				}
+				if emailCommentKey(tx, key) == "" {
+					continue
+				}
+				err = sentKeys.Put([]byte(key), []byte(""))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("failed to remove old emails from the outbox: %v\n", err)
+		}
+	}
+
+	for _, email := range due {
+		attemptOutboxEmail(&email)
+	}
+	return wait
+}
+
+// attemptOutboxEmail sends the email once and records the result
+func attemptOutboxEmail(email *OutboxEmail) {
+	if emailNotificationsDisabled {
+		return
+	}
+	email.Attempts++
+	email.LastAttempt = getMillisecondsSinceUnixEpoch()
+	err := sendEmail(email.From, email.To, email.Subject, email.BodyPlain, email.BodyHTML)
+	email.LastError = ""
+	email.State = emailStateSent
+	email.NextAttempt = 0
+	if err != nil {
+		email.LastError = err.Error()
+		if email.Attempts < emailMaxAttempts {
+			backoff := exponentialBackoff(emailFirstRetry, emailRetryMax, email.Attempts)
+			email.State = emailStateQueued
+			email.NextAttempt = email.LastAttempt + int64(backoff/time.Millisecond)
+			log.Printf("email delivery issue for %s (attempt %d), retrying in %s: %v\n", email.To, email.Attempts, backoff, err)
+		} else {
+			email.State = emailStateFailed
+			log.Printf("email delivery issue for %s, giving up after %d attempts: %v\n", email.To, email.Attempts, err)
+		}
+	}
+	// the admin statistics show how many emails were sent and how many failed
+	if email.State != emailStateQueued {
+		recordEmailResult(err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		// an admin may have deleted the email while it was being sent
+		if tx.Bucket([]byte("email_outbox")).Get([]byte(email.Key)) == nil {
+			return nil
+		}
+		return putOutboxEmail(tx, email)
+	})
+	if err != nil {
+		log.Printf("failed to record the result of the email to %s: %v\n", email.To, err)
+	}
+}
+
+func adminEmails(responseWriter http.ResponseWriter, request *http.Request) {
+	templateData := struct {
+		Emails   []OutboxEmail
+		Total    int
+		Queued   int
+		Sent     int
+		Failed   int
+		Disabled bool
+	}{
+		Disabled: emailNotificationsDisabled,
+	}
+
+	var err error
+	if request.Method == "POST" {
+		err = request.ParseForm()
+		key := request.Form.Get("key")
+		action := request.Form.Get("action")
+		if err == nil && (action == "retry" || action == "delete") {
+			err = db.Update(func(tx *bolt.Tx) error {
+				bucket := tx.Bucket([]byte("email_outbox"))
+				if bucket == nil || bucket.Get([]byte(key)) == nil {
+					return nil
+				}
+				var email OutboxEmail
+				err := json.Unmarshal(bucket.Get([]byte(key)), &email)
+				if err != nil {
+					return err
+				}
+				// sent emails can't be sent again or discarded, that would send them again the next time they are queued
+				if email.State == emailStateSent {
+					return nil
+				}
+				// the bodies can contain signed moderation links, they don't belong in the audit log
+				before := email
+				before.BodyPlain = ""
+				before.BodyHTML = ""
+				auditEntry := newAuditEntry(request, auditActionEmailRetry).withBefore(before)
+				auditEntry.Target = key
+				auditEntry.Details = fmt.Sprintf("%s: %s", email.To, email.Subject)
+				if action == "delete" {
+					auditEntry.Action = auditActionEmailDelete
+					err = bucket.Delete([]byte(key))
+				} else {
+					if email.State == emailStateFailed {
+						email.Attempts = 0
+					}
+					email.State = emailStateQueued
+					email.NextAttempt = getMillisecondsSinceUnixEpoch()
+					err = putOutboxEmail(tx, &email)
+				}
+				if err != nil {
+					return err
+				}
+				return recordAudit(tx, auditEntry)
+			})
+			if err == nil {
+				log.Printf("admin: %s email '%s'\n", action, key)
+				wakeEmailWorker()
+			}
+		}
+	}
+
+	if err == nil {
+		err = db.View(func(tx *bolt.Tx) error {
+			templateData.Emails, err = getOutboxEmails(tx)
+			return err
+		})
+	}
+	if err != nil {
+		log.Printf("admin emails page failed: %v\n", err)
+		responseWriter.WriteHeader(500)
+		responseWriter.Write([]byte("500 internal server error"))
+		return
+	}
+
+	for _, email := range templateData.Emails {
+		switch email.State {
+		case emailStateQueued:
+			templateData.Queued++
+		case emailStateSent:
+			templateData.Sent++
+		case emailStateFailed:
+			templateData.Failed++
+		}
+	}
+	// the emails which need attention first, then the newest
+	sort.Slice(templateData.Emails, func(i, j int) bool {
+		a, b := templateData.Emails[i], templateData.Emails[j]
+		if (a.State == emailStateSent) != (b.State == emailStateSent) {
+			return b.State == emailStateSent
+		}
+		return a.Created > b.Created
+	})
+	templateData.Total = len(templateData.Emails)
+	if len(templateData.Emails) > adminEmailsLimit {
+		templateData.Emails = templateData.Emails[:adminEmailsLimit]
+	}
+
+	renderAdminTemplate(responseWriter, request, "admin-emails.html.gotemplate", templateData)
+}
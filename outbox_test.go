@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestSentEmailKeysOutliveTheOutbox(t *testing.T) {
+	db = openTestDB(t)
+	emailNotificationsDisabled = true
+	comment := &Comment{DocumentID: "my-post", Date: 1600000000000, Body: "hello"}
+	key := commentEmailKey(comment, "Reader@example.com")
+	lockoutKey := "lockout/1600000000000 admin@example.com"
+	queue := func(key string) bool {
+		var queued bool
+		err := db.Update(func(tx *bolt.Tx) error {
+			var err error
+			queued, err = queueEmail(tx, key, "comments@example.com", "reader@example.com", "subject", "body", "body")
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return queued
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		return putComment(tx, comment)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !queue(key) || !queue(lockoutKey) {
+		t.Fatal("the first emails should be queued")
+	}
+	if queue(key) {
+		t.Error("an email which is already in the outbox should not be queued again")
+	}
+
+	// both emails were sent before the retention of the outbox
+	err = db.Update(func(tx *bolt.Tx) error {
+		emails, err := getOutboxEmails(tx)
+		if err != nil {
+			return err
+		}
+		for _, email := range emails {
+			email.State = emailStateSent
+			email.Created -= int64((emailOutboxRetention + time.Hour) / time.Millisecond)
+			if err := putOutboxEmail(tx, &email); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendDueEmails()
+	db.View(func(tx *bolt.Tx) error {
+		if emails, _ := getOutboxEmails(tx); len(emails) != 0 {
+			t.Errorf("old emails should be removed from the outbox, got %d", len(emails))
+		}
+		return nil
+	})
+	if queue(key) {
+		t.Error("a notification about a comment which still exists should not be sent again")
+	}
+	if !queue(lockoutKey) {
+		t.Error("only the keys of the emails about a comment should be kept")
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		return deleteCommentEmailKeys(tx, comment.DocumentID, comment.Date)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !queue(key) {
+		t.Error("the keys should be forgotten when the comment is deleted for good")
+	}
+}
+
+func TestEmailRetryBackoff(t *testing.T) {
+	if backoff := exponentialBackoff(emailFirstRetry, emailRetryMax, 1); backoff != time.Minute {
+		t.Errorf("the first retry should be after a minute, got %s", backoff)
+	}
+	total := time.Duration(0)
+	for attempts := 1; attempts < emailMaxAttempts; attempts++ {
+		backoff := exponentialBackoff(emailFirstRetry, emailRetryMax, attempts)
+		if backoff > emailRetryMax {
+			t.Errorf("after %d attempts: the backoff %s should be capped at %s", attempts, backoff, emailRetryMax)
+		}
+		total += backoff
+	}
+	if backoff := exponentialBackoff(emailFirstRetry, emailRetryMax, 64); backoff != emailRetryMax {
+		t.Errorf("the backoff should stop doubling at %s, got %s", emailRetryMax, backoff)
+	}
+	if total > emailOutboxRetention {
+		t.Errorf("an email should be given up before it is removed from the outbox, the retries take %s", total)
+	}
+}
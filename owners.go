@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+const auditActionOwnerAdd = "owner.add"
+const auditActionOwnerRemove = "owner.remove"
+const auditActionDocumentPin = "document.pin"
+const auditActionDocumentUnpin = "document.unpin"
+
+// Owner is an identity of the site owner. comments posted by an owner get the isAuthor flag.
+// the AvatarHash is the one the server derives from the email address the owner comments with.
+// every owner belongs to one site and only gets the badge on the documents of that site, Site is empty for the default site.
+type Owner struct {
+	AvatarHash string `json:"avatarHash"`
+	Name       string `json:"name,omitempty"`
+	Site       string `json:"site,omitempty"`
+	Created    int64  `json:"created"`
+}
+
+// ownerKey is the AvatarHash on the default site and <name>~<AvatarHash> on the named sites
+func ownerKey(siteName, avatarHash string) []byte {
+	if siteName == "" {
+		return []byte(avatarHash)
+	}
+	return []byte(fmt.Sprintf("%s%s%s", siteName, siteDocumentSeparator, avatarHash))
+}
+
+// getOwners returns the owners of the site keyed by AvatarHash
+func getOwners(tx *bolt.Tx, site *Site) (map[string]Owner, error) {
+	owners := map[string]Owner{}
+	bucket := tx.Bucket([]byte("owners"))
+	if bucket == nil {
+		return owners, nil
+	}
+	err := bucket.ForEach(func(k, v []byte) error {
+		var owner Owner
+		err := json.Unmarshal(v, &owner)
+		if err != nil {
+			return err
+		}
+		if owner.Site == site.Name {
+			owners[owner.AvatarHash] = owner
+		}
+		return nil
+	})
+	return owners, err
+}
+
+func addOwner(tx *bolt.Tx, owner *Owner) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte("owners"))
+	if err != nil {
+		return err
+	}
+	if owner.Created == 0 {
+		owner.Created = getMillisecondsSinceUnixEpoch()
+	}
+	ownerBytes, err := json.Marshal(owner)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(ownerKey(owner.Site, owner.AvatarHash), ownerBytes)
+}
+
+func removeOwner(tx *bolt.Tx, site *Site, avatarHash string) error {
+	bucket := tx.Bucket([]byte("owners"))
+	if bucket == nil {
+		return nil
+	}
+	return bucket.Delete(ownerKey(site.Name, avatarHash))
+}
+
+// isAuthor is computed on read, so adding or removing an owner applies to their existing comments too.
+// comments only count when the server derived their avatar hash from an email address, which is what the
+// EmailHash records. replies posted from the admin panel are always by the author.
+func isAuthor(owners map[string]Owner, comment *Comment) bool {
+	if comment.AdminAuthor != "" {
+		return true
+	}
+	if comment.AvatarHash == "" || comment.EmailHash == "" {
+		return false
+	}
+	_, has := owners[comment.AvatarHash]
+	return has
+}
+
+// pinFirst moves the pinned comment to the front of the root comments
+func pinFirst(rootComments []*Comment, pinnedComment int64) []*Comment {
+	if pinnedComment == 0 {
+		return rootComments
+	}
+	for i, comment := range rootComments {
+		if comment.Date == pinnedComment {
+			comment.Pinned = true
+			pinned := append([]*Comment{comment}, rootComments[:i]...)
+			return append(pinned, rootComments[i+1:]...)
+		}
+	}
+	return rootComments
+}
+
+func adminOwners(responseWriter http.ResponseWriter, request *http.Request) {
+	templateData := struct {
+		Owners []Owner
+		Error  string
+	}{}
+
+	site := siteForRequest(request)
+	var err error
+	if request.Method == "POST" {
+		err = request.ParseForm()
+		if err == nil && request.Form.Get("action") == "remove" {
+			avatarHash := request.Form.Get("avatarHash")
+			err = db.Update(func(tx *bolt.Tx) error {
+				owners, err := getOwners(tx, site)
+				if err != nil {
+					return err
+				}
+				auditEntry := newAuditEntry(request, auditActionOwnerRemove)
+				auditEntry.Target = avatarHash
+				if owner, has := owners[avatarHash]; has {
+					auditEntry.withBefore(owner)
+				}
+				err = removeOwner(tx, site, avatarHash)
+				if err != nil {
+					return err
+				}
+				return recordAudit(tx, auditEntry)
+			})
+			if err == nil {
+				log.Printf("admin: removed owner %s\n", avatarHash)
+			}
+		} else if err == nil {
+			owner := Owner{
+				AvatarHash: strings.TrimSpace(request.Form.Get("avatarHash")),
+				Name:       strings.TrimSpace(request.Form.Get("name")),
+				Site:       site.Name,
+			}
+			if owner.AvatarHash == "" {
+				templateData.Error = "avatar hash is required"
+			} else {
+				err = db.Update(func(tx *bolt.Tx) error {
+					auditEntry := newAuditEntry(request, auditActionOwnerAdd)
+					auditEntry.Target = owner.AvatarHash
+					auditEntry.Details = owner.Name
+					err := addOwner(tx, &owner)
+					if err != nil {
+						return err
+					}
+					return recordAudit(tx, auditEntry)
+				})
+				if err == nil {
+					log.Printf("admin: added owner %s\n", owner.AvatarHash)
+				}
+			}
+		}
+	}
+
+	if err == nil {
+		err = db.View(func(tx *bolt.Tx) error {
+			owners, err := getOwners(tx, site)
+			for _, owner := range owners {
+				templateData.Owners = append(templateData.Owners, owner)
+			}
+			return err
+		})
+	}
+	if err != nil {
+		log.Printf("admin owners page failed: %v\n", err)
+		responseWriter.WriteHeader(500)
+		responseWriter.Write([]byte("500 internal server error"))
+		return
+	}
+
+	sort.Slice(templateData.Owners, func(i, j int) bool {
+		return templateData.Owners[i].Created < templateData.Owners[j].Created
+	})
+
+	renderAdminTemplate(responseWriter, request, "admin-owners.html.gotemplate", templateData)
+}
+
+// setPinnedComment pins a root comment to the top of the document, or unpins it when date is 0
+func setPinnedComment(tx *bolt.Tx, request *http.Request, postID string, date int64) error {
+	if date != 0 {
+		comment, err := getComment(tx, postID, date)
+		if err != nil {
+			return err
+		}
+		if comment.InReplyTo != "" && comment.InReplyTo != "root" {
+			return fmt.Errorf("only top level comments can be pinned")
+		}
+	}
+	settings, err := getDocumentSettings(tx, postID)
+	if err != nil {
+		return err
+	}
+	auditAction := auditActionDocumentPin
+	if date == 0 {
+		auditAction = auditActionDocumentUnpin
+	}
+	auditEntry := newAuditEntry(request, auditAction).withBefore(settings)
+	auditEntry.DocumentID = postID
+	auditEntry.CommentDate = date
+	settings.PinnedComment = date
+	err = putDocumentSettings(tx, postID, settings)
+	if err != nil {
+		return err
+	}
+	return recordAudit(tx, auditEntry)
+}
+
+// adminPinComment handles the pin and unpin forms on the admin page of a document
+func adminPinComment(request *http.Request, postID string) error {
+	var date int64
+	var err error
+	if request.Form.Get("action") == "pin" {
+		date, err = strconv.ParseInt(request.Form.Get("date"), 10, 64)
+		if err != nil {
+			return err
+		}
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		return setPinnedComment(tx, request, postID, date)
+	})
+	if err == nil {
+		log.Printf("admin: %s comment %s_%d\n", request.Form.Get("action"), postID, date)
+	}
+	return err
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestGetOwnersOfSites(t *testing.T) {
+	db = openTestDB(t)
+	blog := &Site{Name: "blog"}
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, owner := range []Owner{
+			{AvatarHash: "abc123", Name: "forest"},
+			{AvatarHash: "abc123", Name: "forest on the blog", Site: "blog"},
+			{AvatarHash: "def456", Site: "blog"},
+		} {
+			if err := addOwner(tx, &owner); err != nil {
+				return err
+			}
+		}
+		return removeOwner(tx, blog, "def456")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		tests := []struct {
+			site *Site
+			name string
+		}{
+			{&Site{}, "forest"},
+			{blog, "forest on the blog"},
+		}
+		for _, test := range tests {
+			owners, err := getOwners(tx, test.site)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(owners) != 1 || owners["abc123"].Name != test.name {
+				t.Errorf("getOwners(%q): expected only %q, got %+v", test.site.Name, test.name, owners)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+)
+
+// rateLimiter is an in-memory token bucket per key (client IP, email hash, DocumentID, etc).
+// each bucket holds up to Capacity tokens and refills completely over Period.
+type rateLimiter struct {
+	Name     string
+	Capacity float64
+	Period   time.Duration
+	buckets  map[string]*tokenBucket
+	mutex    *sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+var trustedProxiesString = "$COMMENTS_TRUSTED_PROXIES"
+var trustedProxies []*net.IPNet
+
+var ipRateLimiter *rateLimiter
+var identityRateLimiter *rateLimiter
+var documentRateLimiter *rateLimiter
+
+func initRateLimits() {
+	trustedProxiesString = os.ExpandEnv(trustedProxiesString)
+	trustedProxies = []*net.IPNet{}
+	for _, proxy := range splitNonEmpty(trustedProxiesString, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy = fmt.Sprintf("%s/128", proxy)
+			} else {
+				proxy = fmt.Sprintf("%s/32", proxy)
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			panic(errors.Wrapf(err, "can't parse COMMENTS_TRUSTED_PROXIES entry '%s' as an IP address or CIDR range", proxy))
+		}
+		trustedProxies = append(trustedProxies, ipNet)
+	}
+
+	ipRateLimiter = newRateLimiterFromEnv("ip", "$COMMENTS_RATE_LIMIT_IP", "5/10m")
+	identityRateLimiter = newRateLimiterFromEnv("identity", "$COMMENTS_RATE_LIMIT_IDENTITY", "5/10m")
+	documentRateLimiter = newRateLimiterFromEnv("document", "$COMMENTS_RATE_LIMIT_DOCUMENT", "30/10m")
+
+	go (func() {
+		for {
+			time.Sleep(time.Minute)
+			for _, limiter := range []*rateLimiter{ipRateLimiter, identityRateLimiter, documentRateLimiter} {
+				limiter.cleanup()
+			}
+		}
+	})()
+}
+
+// newRateLimiterFromEnv parses limits of the form <count>/<duration>, for example 5/10m.
+// "off" disables the limit, in which case nil is returned.
+func newRateLimiterFromEnv(name, envVar, defaultValue string) *rateLimiter {
+	value := os.ExpandEnv(envVar)
+	if value == "" {
+		value = defaultValue
+	}
+	if value == "off" {
+		log.Printf("rate limit per %s is turned off\n", name)
+		return nil
+	}
+	split := strings.Split(value, "/")
+	if len(split) != 2 {
+		panic(fmt.Errorf("can't parse %s '%s': expected <count>/<duration>, for example 5/10m", strings.TrimPrefix(envVar, "$"), value))
+	}
+	capacity, err := strconv.ParseFloat(split[0], 64)
+	if err != nil || capacity < 1 {
+		panic(fmt.Errorf("can't parse %s '%s': count must be a number >= 1", strings.TrimPrefix(envVar, "$"), value))
+	}
+	period, err := time.ParseDuration(split[1])
+	if err != nil || period <= 0 {
+		panic(fmt.Errorf("can't parse %s '%s': '%s' is not a valid duration", strings.TrimPrefix(envVar, "$"), value, split[1]))
+	}
+	log.Printf("rate limit per %s: %s\n", name, value)
+	return &rateLimiter{
+		Name:     name,
+		Capacity: capacity,
+		Period:   period,
+		buckets:  map[string]*tokenBucket{},
+		mutex:    &sync.Mutex{},
+	}
+}
+
+// take removes a token from the bucket for the given key. if there are no tokens left, it returns false
+// and how long the caller has to wait until a token will be available.
+// a nil rateLimiter or an empty key always allows the request.
+func (limiter *rateLimiter) take(key string) (bool, time.Duration) {
+	if limiter == nil || key == "" {
+		return true, 0
+	}
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	bucket, has := limiter.buckets[key]
+	if !has {
+		bucket = &tokenBucket{tokens: limiter.Capacity, lastRefill: now}
+		limiter.buckets[key] = bucket
+	}
+	bucket.refill(limiter, now)
+	if bucket.tokens < 1 {
+		tokensPerSecond := limiter.Capacity / limiter.Period.Seconds()
+		wait := time.Duration(math.Ceil((1-bucket.tokens)/tokensPerSecond)) * time.Second
+		return false, wait
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+func (bucket *tokenBucket) refill(limiter *rateLimiter, now time.Time) {
+	elapsed := now.Sub(bucket.lastRefill).Seconds()
+	bucket.tokens = math.Min(limiter.Capacity, bucket.tokens+elapsed*limiter.Capacity/limiter.Period.Seconds())
+	bucket.lastRefill = now
+}
+
+// cleanup forgets about buckets which have filled back up, they are the same as a brand new bucket
+func (limiter *rateLimiter) cleanup() {
+	if limiter == nil {
+		return
+	}
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	for key, bucket := range limiter.buckets {
+		bucket.refill(limiter, now)
+		if bucket.tokens >= limiter.Capacity {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// getClientIP returns the IP address of the client. the X-Forwarded-For and X-Real-IP headers are only
+// honoured when the request came from one of the COMMENTS_TRUSTED_PROXIES, otherwise anyone could spoof them.
+func getClientIP(request *http.Request) string {
+	remoteAddress, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		remoteAddress = request.RemoteAddr
+	}
+	remoteIP := net.ParseIP(remoteAddress)
+	if remoteIP == nil || !isTrustedProxy(remoteIP) {
+		return remoteAddress
+	}
+
+	// walk the X-Forwarded-For chain from the right, the first address which is not a trusted proxy is the client
+	forwardedFor := []string{}
+	for _, header := range request.Header.Values("X-Forwarded-For") {
+		forwardedFor = append(forwardedFor, strings.Split(header, ",")...)
+	}
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwardedFor[i]))
+		if ip == nil {
+			break
+		}
+		if !isTrustedProxy(ip) || i == 0 {
+			return ip.String()
+		}
+	}
+
+	realIP := net.ParseIP(strings.TrimSpace(request.Header.Get("X-Real-IP")))
+	if realIP != nil {
+		return realIP.String()
+	}
+	return remoteAddress
+}
+
+func rateLimitedResult(limiter *rateLimiter, wait time.Duration) postCommentResult {
+	log.Printf("rate limit per %s exceeded\n", limiter.Name)
+	return postCommentResult{
+		CouldNotPostReason: fmt.Sprintf("you are posting too quickly, please try again in %s", wait.String()),
+		StatusCode:         http.StatusTooManyRequests,
+		RetryAfter:         wait,
+	}
+}
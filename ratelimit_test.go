@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestRateLimiter(capacity float64, period time.Duration) *rateLimiter {
+	return &rateLimiter{Name: "test", Capacity: capacity, Period: period, buckets: map[string]*tokenBucket{}, mutex: &sync.Mutex{}}
+}
+
+func TestRateLimiterTake(t *testing.T) {
+	limiter := newTestRateLimiter(3, time.Minute)
+	for i := 0; i < 3; i++ {
+		if allowed, _ := limiter.take("1.2.3.4"); !allowed {
+			t.Fatalf("request %d should fit in the burst", i+1)
+		}
+	}
+	allowed, wait := limiter.take("1.2.3.4")
+	if allowed {
+		t.Fatal("the request after the burst should be limited")
+	}
+	if wait <= 0 || wait > 20*time.Second {
+		t.Errorf("one token refills every 20s, got a wait of %s", wait)
+	}
+	if allowed, _ := limiter.take("5.6.7.8"); !allowed {
+		t.Error("other keys have their own bucket")
+	}
+	if allowed, _ := limiter.take(""); !allowed {
+		t.Error("an empty key should never be limited")
+	}
+	var nilLimiter *rateLimiter
+	if allowed, _ := nilLimiter.take("1.2.3.4"); !allowed {
+		t.Error("a limit which is turned off should never limit")
+	}
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	limiter := newTestRateLimiter(4, time.Minute)
+	now := time.Now()
+	tests := []struct {
+		tokens  float64
+		elapsed time.Duration
+		want    float64
+	}{
+		{0, 0, 0},
+		{0, 15 * time.Second, 1},
+		{1, 30 * time.Second, 3},
+		{3, time.Hour, 4},
+	}
+	for _, test := range tests {
+		bucket := &tokenBucket{tokens: test.tokens, lastRefill: now.Add(-test.elapsed)}
+		bucket.refill(limiter, now)
+		if bucket.tokens < test.want-0.001 || bucket.tokens > test.want+0.001 {
+			t.Errorf("refilling %.0f tokens after %s: expected %.2f, got %.2f", test.tokens, test.elapsed, test.want, bucket.tokens)
+		}
+	}
+
+	limiter.buckets["full"] = &tokenBucket{tokens: 4, lastRefill: now}
+	limiter.buckets["empty"] = &tokenBucket{tokens: 0, lastRefill: now}
+	limiter.cleanup()
+	if _, has := limiter.buckets["full"]; has {
+		t.Error("cleanup should forget full buckets")
+	}
+	if _, has := limiter.buckets["empty"]; !has {
+		t.Error("cleanup should keep buckets which are still refilling")
+	}
+}
+
+func TestGetClientIP(t *testing.T) {
+	trustedProxies = []*net.IPNet{}
+	for _, cidr := range []string{"10.0.0.0/8", "fd00::/8"} {
+		_, ipNet, _ := net.ParseCIDR(cidr)
+		trustedProxies = append(trustedProxies, ipNet)
+	}
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		realIP       string
+		expectedIP   string
+	}{
+		{"no proxy", "203.0.113.7:1234", nil, "", "203.0.113.7"},
+		{"spoofed X-Forwarded-For from an untrusted client", "203.0.113.7:1234", []string{"198.51.100.1"}, "", "203.0.113.7"},
+		{"spoofed X-Real-IP from an untrusted client", "203.0.113.7:1234", nil, "198.51.100.1", "203.0.113.7"},
+		{"one trusted proxy", "10.0.0.1:80", []string{"203.0.113.7"}, "", "203.0.113.7"},
+		{"client prepends a spoofed address", "10.0.0.1:80", []string{"198.51.100.1, 203.0.113.7"}, "", "203.0.113.7"},
+		{"several trusted proxies", "10.0.0.1:80", []string{"198.51.100.1, 203.0.113.7, 10.0.0.3", "10.0.0.2"}, "", "203.0.113.7"},
+		{"only trusted proxies", "10.0.0.1:80", []string{"10.0.0.3, 10.0.0.2"}, "", "10.0.0.3"},
+		{"IPv6 client behind an IPv6 proxy", "[fd00::1]:80", []string{"2001:db8::7, fd00::2"}, "", "2001:db8::7"},
+		{"X-Real-IP from a trusted proxy", "10.0.0.1:80", nil, "203.0.113.7", "203.0.113.7"},
+		{"trusted proxy without headers", "10.0.0.1:80", nil, "", "10.0.0.1"},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("POST", "/api/doc", nil)
+		request.RemoteAddr = test.remoteAddr
+		for _, header := range test.forwardedFor {
+			request.Header.Add("X-Forwarded-For", header)
+		}
+		if test.realIP != "" {
+			request.Header.Set("X-Real-IP", test.realIP)
+		}
+		if got := getClientIP(request); got != test.expectedIP {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expectedIP, got)
+		}
+	}
+}
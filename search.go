@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// the search_index bucket is an inverted index: the keys are <token>\x00<commentKey> and the values are empty.
+// searching for a word is a prefix scan over the keys, so "moder" also finds "moderation".
+var searchTokenRegexp = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+var publicSearchString = "$COMMENTS_PUBLIC_SEARCH"
+var publicSearchEnabled = false
+
+const searchResultsLimit = 200
+
+func initSearch() {
+	publicSearchString = os.ExpandEnv(publicSearchString)
+	publicSearchEnabled = publicSearchString == "true"
+}
+
+// initSearchIndex builds the index from all of the existing comments the first time the server starts with search
+func initSearchIndex() {
+	var exists bool
+	db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket([]byte("search_index")) != nil
+		return nil
+	})
+	if exists {
+		return
+	}
+	indexed, err := rebuildSearchIndex()
+	if err != nil {
+		log.Printf("failed to build the search index: %v\n", err)
+		return
+	}
+	log.Printf("built the search index from %d comments\n", indexed)
+}
+
+func searchTokenize(text string) []string {
+	unique := map[string]bool{}
+	for _, token := range searchTokenRegexp.FindAllString(strings.ToLower(text), -1) {
+		if len(token) > 1 && len(token) < 40 {
+			unique[token] = true
+		}
+	}
+	tokens := []string{}
+	for token := range unique {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+func searchIndexKey(token string, key []byte) []byte {
+	return append([]byte(fmt.Sprintf("%s\x00", token)), key...)
+}
+
+// indexComment is called inside the transaction which writes the comment
+func indexComment(tx *bolt.Tx, comment *Comment) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte("search_index"))
+	if err != nil {
+		return err
+	}
+	key := commentKey(comment.DocumentID, comment.Date)
+	for _, token := range searchTokenize(fmt.Sprintf("%s %s", comment.Username, comment.Body)) {
+		err = bucket.Put(searchIndexKey(token, key), []byte(""))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexComment is called inside the transaction which deletes the comment
+func unindexComment(tx *bolt.Tx, comment *Comment) error {
+	bucket := tx.Bucket([]byte("search_index"))
+	if bucket == nil {
+		return nil
+	}
+	key := commentKey(comment.DocumentID, comment.Date)
+	for _, token := range searchTokenize(fmt.Sprintf("%s %s", comment.Username, comment.Body)) {
+		err := bucket.Delete(searchIndexKey(token, key))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func rebuildSearchIndex() (int, error) {
+	indexed := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("search_index")) != nil {
+			err := tx.DeleteBucket([]byte("search_index"))
+			if err != nil {
+				return err
+			}
+		}
+		_, err := tx.CreateBucket([]byte("search_index"))
+		if err != nil {
+			return err
+		}
+		comments, err := findComments(tx, &commentFilter{})
+		if err != nil {
+			return err
+		}
+		for i := range comments {
+			err = indexComment(tx, &comments[i])
+			if err != nil {
+				return err
+			}
+			indexed++
+		}
+		return nil
+	})
+	return indexed, err
+}
+
+// searchComments returns the comments which contain every word in the query, newest first.
+// if postID is not empty, only comments on that document are returned.
+func searchComments(tx *bolt.Tx, query, postID string, limit int) ([]Comment, error) {
+	results := []Comment{}
+	bucket := tx.Bucket([]byte("search_index"))
+	tokens := searchTokenize(query)
+	if bucket == nil || len(tokens) == 0 {
+		return results, nil
+	}
+
+	var matching map[string]bool
+	for _, token := range tokens {
+		tokenMatches := map[string]bool{}
+		prefix := []byte(token)
+		cursor := bucket.Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			separator := bytes.IndexByte(k, 0)
+			key := string(k[separator+1:])
+			if postID != "" && !strings.HasPrefix(key, fmt.Sprintf("%s/", postID)) {
+				continue
+			}
+			if matching == nil || matching[key] {
+				tokenMatches[key] = true
+			}
+		}
+		matching = tokenMatches
+		if len(matching) == 0 {
+			return results, nil
+		}
+	}
+
+	for key := range matching {
+		documentID, date, err := parseCommentKey(key)
+		if err != nil {
+			return results, err
+		}
+		comment, err := getComment(tx, documentID, date)
+		if err == errCommentNotFound || err == errBucketNotFound {
+			continue
+		}
+		if err != nil {
+			return results, err
+		}
+		results = append(results, *comment)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Date > results[j].Date
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+func adminSearch(responseWriter http.ResponseWriter, request *http.Request) {
+	templateData := struct {
+		Query    string
+		Comments []Comment
+		Message  string
+	}{
+		Query:    strings.TrimSpace(request.URL.Query().Get("q")),
+		Comments: []Comment{},
+	}
+
+	var err error
+	if request.Method == "POST" {
+		var indexed int
+		indexed, err = rebuildSearchIndex()
+		if err == nil {
+			log.Printf("admin: rebuilt the search index from %d comments\n", indexed)
+			templateData.Message = fmt.Sprintf("rebuilt the search index from %d comments", indexed)
+		}
+	}
+	if err == nil && templateData.Query != "" {
+		err = db.View(func(tx *bolt.Tx) error {
+			var err error
+			templateData.Comments, err = searchComments(tx, templateData.Query, "", searchResultsLimit)
+			return err
+		})
+	}
+	if err != nil {
+		log.Printf("admin search page failed: %v\n", err)
+		responseWriter.WriteHeader(500)
+		responseWriter.Write([]byte("500 internal server error"))
+		return
+	}
+
+	renderAdminTemplate(responseWriter, request, "admin-search.html.gotemplate", templateData)
+}
+
+// publicSearch only returns comments which are visible on the document anyways
+func publicSearch(response http.ResponseWriter, request *http.Request) {
+	addCORSHeaders(response, request)
+
+	if request.Method == "OPTIONS" {
+		response.WriteHeader(200)
+		return
+	}
+	pathElements := splitNonEmpty(request.URL.Path, "/")
+	var postID string
+	if len(pathElements) >= 2 {
+		postID = siteForRequest(request).DocumentID(pathElements[len(pathElements)-1])
+	}
+	if postID == "" {
+		response.WriteHeader(404)
+		response.Write([]byte("404 Not Found; postID is required"))
+		return
+	}
+	viewerIdentity := identityFromToken(request.URL.Query().Get("identity"))
+
+	results := []*Comment{}
+	err := db.View(func(tx *bolt.Tx) error {
+		shadowBans, err := getShadowBans(tx)
+		if err != nil {
+			return err
+		}
+		owners, err := getOwners(tx, siteForDocument(postID))
+		if err != nil {
+			return err
+		}
+		found, err := searchComments(tx, request.URL.Query().Get("q"), postID, 0)
+		if err != nil {
+			return err
+		}
+		for i := range found {
+			comment := &found[i]
+			if comment.Status != "" || isHiddenByShadowBan(shadowBans, comment, viewerIdentity) {
+				continue
+			}
+			comment.IsAuthor = isAuthor(owners, comment)
+			err = stripPrivateFields(comment)
+			if err != nil {
+				return err
+			}
+			results = append(results, comment)
+			if len(results) == searchResultsLimit {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("boltdb error on search: %v\n", err)
+		response.WriteHeader(500)
+		response.Write([]byte("boltdb read error"))
+		return
+	}
+
+	responseBytes, _ := json.Marshal(struct {
+		Comments []*Comment `json:"comments"`
+	}{
+		Comments: results,
+	})
+	response.Header().Set("Content-Type", "application/json")
+	response.Write(responseBytes)
+}
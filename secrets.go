@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+	"github.com/boltdb/bolt"
+)
+
+// the server secret signs the login challenges, the identity tokens of the commenters and the CSRF tokens of the admin
+// forms. it is generated the first time the server starts and kept in the database.
+const serverSecretName = "server"
+
+var serverSecret []byte
+
+func initServerSecret() {
+	err := db.Update(func(tx *bolt.Tx) error {
+		var err error
+		serverSecret, err = getSecret(tx, serverSecretName)
+		return err
+	})
+	if err != nil {
+		panic(errors.Wrapf(err, "could not load the server secret"))
+	}
+}
+
+// getSecret returns the secret with this name from the secrets bucket. a random one is created the first time,
+// so unlike COMMENTS_HASH_SALT a secret never has a well known default value.
+func getSecret(tx *bolt.Tx, name string) ([]byte, error) {
+	bucket, err := tx.CreateBucketIfNotExists([]byte("secrets"))
+	if err != nil {
+		return nil, err
+	}
+	// the value is only valid until the end of the transaction
+	if secret := bucket.Get([]byte(name)); secret != nil {
+		return append([]byte{}, secret...), nil
+	}
+	secret := make([]byte, 32)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+	return secret, bucket.Put([]byte(name), secret)
+}
+
+// serverSignature is the HMAC of the message with the server secret. purpose keeps the signatures for different uses apart.
+func serverSignature(purpose, message string) []byte {
+	mac := hmac.New(sha256.New, serverSecret)
+	mac.Write([]byte(fmt.Sprintf("%s:%s", purpose, message)))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"fmt"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// shadowbanned authors can keep posting, but their comments are only returned to requests which carry their
+// identity token, so they can't tell that nobody else sees them. they also never trigger any notifications.
+
+// newPosterID is a random id which the server gives to every commenter. it is stored with their comments and
+// sent to them inside of their identity token, so it works for commenters without an email address too.
+func newPosterID() (string, error) {
+	posterID := make([]byte, 16)
+	_, err := rand.Read(posterID)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", posterID), nil
+}
+
+// identityToken is returned to the commenter after they post, it proves that they are the owner of the PosterID
+func identityToken(posterID string) string {
+	return fmt.Sprintf("%s.%x", posterID, serverSignature("identity", posterID)[:16])
+}
+
+// identityFromToken returns the PosterID, or an empty string if the token is missing or was not issued by us
+func identityFromToken(token string) string {
+	split := strings.Split(token, ".")
+	if len(split) != 2 || split[0] == "" {
+		return ""
+	}
+	if !hmac.Equal([]byte(identityToken(split[0])), []byte(token)) {
+		return ""
+	}
+	return split[0]
+}
+
+// getShadowBans returns all the shadow bans which have not expired yet
+func getShadowBans(tx *bolt.Tx) ([]Ban, error) {
+	shadowBans := []Ban{}
+	bans, err := getBans(tx)
+	if err != nil {
+		return shadowBans, err
+	}
+	now := getMillisecondsSinceUnixEpoch()
+	for _, ban := range bans {
+		if ban.Shadow && !ban.isExpired(now) {
+			shadowBans = append(shadowBans, ban)
+		}
+	}
+	return shadowBans, nil
+}
+
+// isHiddenByShadowBan is true when the comment should not be shown to the viewer (a PosterID or empty string)
+func isHiddenByShadowBan(shadowBans []Ban, comment *Comment, viewerIdentity string) bool {
+	if viewerIdentity != "" && comment.PosterID == viewerIdentity {
+		return false
+	}
+	for i := range shadowBans {
+		if shadowBans[i].matches(comment) {
+			return true
+		}
+	}
+	return false
+}
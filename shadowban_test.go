@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestIdentityToken(t *testing.T) {
+	serverSecret = []byte("test secret")
+	posterID, err := newPosterID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := identityToken(posterID)
+	if got := identityFromToken(token); got != posterID {
+		t.Errorf("expected the token to carry %s, got '%s'", posterID, got)
+	}
+
+	otherPosterID, err := newPosterID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otherPosterID == posterID {
+		t.Error("every poster should get their own id")
+	}
+	forged := otherPosterID + token[len(posterID):]
+	if got := identityFromToken(forged); got != "" {
+		t.Errorf("a token with a swapped poster id should be rejected, got '%s'", got)
+	}
+	for _, broken := range []string{"", ".", posterID, "." + token, token + ".x"} {
+		if got := identityFromToken(broken); got != "" {
+			t.Errorf("the token '%s' should be rejected, got '%s'", broken, got)
+		}
+	}
+
+	serverSecret = []byte("another secret")
+	if got := identityFromToken(token); got != "" {
+		t.Errorf("a token signed with another server secret should be rejected, got '%s'", got)
+	}
+}
+
+func TestIsHiddenByShadowBan(t *testing.T) {
+	shadowBans := []Ban{{Type: banTypeIdentity, Value: "abc123", Shadow: true}}
+	tests := []struct {
+		comment        Comment
+		viewerIdentity string
+		hidden         bool
+	}{
+		{Comment{AvatarHash: "abc123", PosterID: "poster-a"}, "", true},
+		{Comment{AvatarHash: "abc123", PosterID: "poster-a"}, "poster-b", true},
+		{Comment{AvatarHash: "abc123", PosterID: "poster-a"}, "poster-a", false},
+		{Comment{AvatarHash: "def456", PosterID: "poster-b"}, "", false},
+		{Comment{AvatarHash: "abc123"}, "", true},
+	}
+	for _, test := range tests {
+		if got := isHiddenByShadowBan(shadowBans, &test.comment, test.viewerIdentity); got != test.hidden {
+			t.Errorf("comment %+v seen by '%s': expected hidden=%t, got %t", test.comment, test.viewerIdentity, test.hidden, got)
+		}
+	}
+}
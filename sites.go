@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+)
+
+// one server can host the comments of several unrelated sites. the default site is configured with the usual COMMENTS_*
+// variables. every site listed in COMMENTS_SITES is configured with COMMENTS_SITE_<NAME>_* variables, anything which is
+// not set is taken from the default site. a request belongs to the site whose host name or path prefix it matches.
+//
+// the documents of a named site are stored as <name>~<DocumentID>, so they can't collide with the documents of other sites,
+// and the site of any comment can be found from its DocumentID.
+const siteDocumentSeparator = "~"
+
+// Site is the default site when Name is empty
+type Site struct {
+	Name               string
+	Hosts              []string
+	PathPrefix         string
+	Origins            []string
+	URL                string
+	NotificationTarget string
+	EmailFrom          string
+	Captcha            *captchaSettings
+}
+
+// captchaSettings can be shared between sites, in that case they also share the pool of challenges
+type captchaSettings struct {
+	APIToken        string
+	APIURL          *url.URL
+	PublicURL       *url.URL
+	DifficultyLevel int
+
+	challenges                []string
+	challengesMutex           *sync.Mutex
+	loadMutex                 *sync.Mutex
+	loadMutexIsProbablyLocked bool
+}
+
+var sitesString = "$COMMENTS_SITES"
+var defaultSite *Site
+var namedSites = map[string]*Site{}
+
+var siteNameRegexp = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+func initSites() {
+	defaultSite = &Site{
+		Origins:            origins,
+		URL:                commentsURLString,
+		NotificationTarget: adminEmailNotificationTarget,
+		EmailFrom:          emailUsername,
+		Captcha:            newCaptchaSettings("COMMENTS_", nil, captchaAPIToken, captchaAPIURLString, captchaPublicURLString, captchaDifficultyLevelString),
+	}
+
+	sitesString = os.ExpandEnv(sitesString)
+	for _, name := range splitNonEmpty(sitesString, ",") {
+		name = strings.TrimSpace(name)
+		if !siteNameRegexp.MatchString(name) {
+			panic(fmt.Errorf("COMMENTS_SITES: the site name '%s' may only contain lowercase letters, digits and dashes", name))
+		}
+		prefix := fmt.Sprintf("COMMENTS_SITE_%s_", strings.ToUpper(strings.ReplaceAll(name, "-", "_")))
+		env := func(name string) string {
+			return strings.TrimSpace(os.Getenv(prefix + name))
+		}
+		site := &Site{
+			Name:               name,
+			PathPrefix:         strings.Trim(env("PATH_PREFIX"), "/"),
+			Origins:            defaultSite.Origins,
+			URL:                strings.TrimSuffix(env("BASE_URL"), "/"),
+			NotificationTarget: defaultSite.NotificationTarget,
+			EmailFrom:          defaultSite.EmailFrom,
+		}
+		for _, host := range splitNonEmpty(env("HOSTS"), ",") {
+			site.Hosts = append(site.Hosts, strings.ToLower(strings.TrimSpace(host)))
+		}
+		if len(site.Hosts) == 0 && site.PathPrefix == "" {
+			panic(fmt.Errorf("%sHOSTS or %sPATH_PREFIX has to be set", prefix, prefix))
+		}
+		if originsCSV := env("CORS_ORIGINS"); originsCSV != "" {
+			site.Origins = splitNonEmpty(originsCSV, ",")
+		}
+		if notificationTarget := env("NOTIFICATION_TARGET"); notificationTarget != "" {
+			site.NotificationTarget = notificationTarget
+		}
+		if emailFrom := env("EMAIL_FROM"); emailFrom != "" {
+			site.EmailFrom = emailFrom
+		}
+		site.Captcha = newCaptchaSettings(prefix, defaultSite.Captcha,
+			env("CAPTCHA_API_TOKEN"), env("CAPTCHA_API_URL"), env("CAPTCHA_PUBLIC_URL"), env("CAPTCHA_DIFFICULTY_LEVEL"))
+		if site.URL == "" {
+			site.URL = defaultSiteURL(site)
+		}
+		namedSites[name] = site
+		log.Printf("site '%s': hosts [%s], path prefix '%s', url %s, CORS origins [%s]\n",
+			name, strings.Join(site.Hosts, ", "), site.PathPrefix, site.URL, strings.Join(site.Origins, ", "))
+	}
+}
+
+// newCaptchaSettings returns the fallback settings if none of the settings are set
+func newCaptchaSettings(envPrefix string, fallback *captchaSettings, apiToken, apiURLString, publicURLString, difficultyLevelString string) *captchaSettings {
+	if fallback != nil && apiToken == "" && apiURLString == "" && publicURLString == "" && difficultyLevelString == "" {
+		return fallback
+	}
+	settings := &captchaSettings{
+		APIToken:        apiToken,
+		challengesMutex: &sync.Mutex{},
+		loadMutex:       &sync.Mutex{},
+	}
+	if fallback != nil {
+		if apiToken == "" {
+			settings.APIToken = fallback.APIToken
+		}
+		if apiURLString == "" {
+			apiURLString = fallback.APIURL.String()
+		}
+		if publicURLString == "" {
+			publicURLString = fallback.PublicURL.String()
+		}
+		if difficultyLevelString == "" {
+			difficultyLevelString = strconv.Itoa(fallback.DifficultyLevel)
+		}
+	}
+
+	var err error
+	settings.APIURL, err = url.Parse(apiURLString)
+	if err != nil || apiURLString == "" {
+		panic(errors.Wrapf(err, "can't parse %sCAPTCHA_API_URL '%s' as url", envPrefix, apiURLString))
+	}
+	settings.PublicURL, err = url.Parse(publicURLString)
+	if err != nil || publicURLString == "" {
+		panic(errors.Wrapf(err, "can't parse %sCAPTCHA_PUBLIC_URL '%s' as url", envPrefix, publicURLString))
+	}
+	settings.DifficultyLevel, err = strconv.Atoi(difficultyLevelString)
+	if err != nil {
+		panic(errors.Wrapf(err, "can't parse %sCAPTCHA_DIFFICULTY_LEVEL '%s' as int", envPrefix, difficultyLevelString))
+	}
+	return settings
+}
+
+// defaultSiteURL is the URL of the default site with the path prefix, or with the first host name of the site
+func defaultSiteURL(site *Site) string {
+	if site.PathPrefix != "" || len(site.Hosts) == 0 {
+		return fmt.Sprintf("%s/%s", commentsURLString, site.PathPrefix)
+	}
+	scheme := "https"
+	if commentsURL, err := url.Parse(commentsURLString); err == nil && commentsURL.Scheme != "" {
+		scheme = commentsURL.Scheme
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, site.Hosts[0], commentsBasePath)
+}
+
+// allSites returns the default site first
+func allSites() []*Site {
+	toReturn := []*Site{defaultSite}
+	for _, site := range namedSites {
+		toReturn = append(toReturn, site)
+	}
+	return toReturn
+}
+
+// BasePath is where the site is served, COMMENTS_BASE_PATH followed by the path prefix of the site
+func (site *Site) BasePath() string {
+	if site.PathPrefix == "" {
+		return commentsBasePath
+	}
+	return fmt.Sprintf("%s/%s", commentsBasePath, site.PathPrefix)
+}
+
+// DisplayName is used in log messages and on the admin pages
+func (site *Site) DisplayName() string {
+	if site.Name == "" {
+		return "default"
+	}
+	return site.Name
+}
+
+// siteForRequest matches the host name first, then the path prefix. everything else belongs to the default site.
+func siteForRequest(request *http.Request) *Site {
+	host := strings.ToLower(request.Host)
+	if hostOnly, _, err := net.SplitHostPort(host); err == nil {
+		host = hostOnly
+	}
+	for _, site := range namedSites {
+		for _, siteHost := range site.Hosts {
+			if siteHost == host {
+				return site
+			}
+		}
+	}
+	for _, site := range namedSites {
+		if site.PathPrefix != "" && strings.HasPrefix(request.URL.Path, fmt.Sprintf("%s/", site.BasePath())) {
+			return site
+		}
+	}
+	return defaultSite
+}
+
+// siteForDocument returns the site which the document belongs to, documentID is the namespaced DocumentID
+func siteForDocument(documentID string) *Site {
+	separator := strings.Index(documentID, siteDocumentSeparator)
+	if separator == -1 {
+		return defaultSite
+	}
+	if site, has := namedSites[documentID[:separator]]; has {
+		return site
+	}
+	return defaultSite
+}
+
+// DocumentID namespaces the DocumentID which was sent by the browser. it returns an empty string if the DocumentID
+// could reach into the namespace of another site: on a named site any DocumentID which contains the separator, on the
+// default site only one which starts with the name of a named site and the separator.
+func (site *Site) DocumentID(publicDocumentID string) string {
+	if site.Name == "" {
+		if siteForDocument(publicDocumentID) != defaultSite {
+			return ""
+		}
+		return publicDocumentID
+	}
+	if strings.Contains(publicDocumentID, siteDocumentSeparator) {
+		return ""
+	}
+	return fmt.Sprintf("%s%s%s", site.Name, siteDocumentSeparator, publicDocumentID)
+}
+
+// OwnsDocument is true if the namespaced DocumentID belongs to this site
+func (site *Site) OwnsDocument(documentID string) bool {
+	return siteForDocument(documentID) == site
+}
+
+// CanAdminister is true if admins of this site may see and moderate the document. the admins of the default site
+// administer the whole server, so they can see the documents of every site.
+func (site *Site) CanAdminister(documentID string) bool {
+	return site.Name == "" || site.OwnsDocument(documentID)
+}
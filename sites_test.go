@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestSiteDocumentID(t *testing.T) {
+	defaultSite = &Site{}
+	blog := &Site{Name: "blog"}
+	namedSites = map[string]*Site{"blog": blog}
+	defer (func() { namedSites = map[string]*Site{} })()
+
+	tests := []struct {
+		site             *Site
+		publicDocumentID string
+		documentID       string
+	}{
+		{defaultSite, "my-post", "my-post"},
+		{defaultSite, "my~post", "my~post"},
+		{defaultSite, "blog~my-post", ""},
+		{blog, "my-post", "blog~my-post"},
+		{blog, "my~post", ""},
+		{blog, "blog~my-post", ""},
+	}
+	for _, test := range tests {
+		if got := test.site.DocumentID(test.publicDocumentID); got != test.documentID {
+			t.Errorf("DocumentID(%q) on the %s site: expected %q, got %q", test.publicDocumentID, test.site.DisplayName(), test.documentID, got)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+	"github.com/boltdb/bolt"
+)
+
+const commentStatusPending = "pending"
+
+// a spamFilter looks at a comment that is about to be stored and returns a score and a human readable reason.
+// a score of 0 means the filter didn't find anything suspicious. the scores of all filters are added together
+// and compared against spamQueueThreshold and spamRejectThreshold.
+type spamFilter struct {
+	Name  string
+	Check func(comment *Comment) (float64, string)
+}
+
+var spamQueueThresholdString = "$COMMENTS_SPAM_QUEUE_THRESHOLD"
+var spamRejectThresholdString = "$COMMENTS_SPAM_REJECT_THRESHOLD"
+var spamMaxLinksString = "$COMMENTS_SPAM_MAX_LINKS"
+var spamBannedWordsString = "$COMMENTS_SPAM_BANNED_WORDS"
+var maxBodyLengthString = "$COMMENTS_MAX_BODY_LENGTH"
+
+var spamQueueThreshold float64 = 1
+var spamRejectThreshold float64 = 3
+var spamMaxLinks = 2
+var maxBodyLength = 10000
+var spamBannedWords []*regexp.Regexp
+var spamFilters []spamFilter
+
+var linkRegexp = regexp.MustCompile(`(?i)(https?://|www\.)`)
+var whitespaceRegexp = regexp.MustCompile(`[\s\t\n\r]+`)
+
+// how long a comment body is remembered for the purposes of duplicate detection
+const duplicateBodyWindow = time.Hour * 24 * 7
+
+func initSpamFilters() {
+	var err error
+	spamQueueThresholdString = os.ExpandEnv(spamQueueThresholdString)
+	if spamQueueThresholdString != "" {
+		spamQueueThreshold, err = strconv.ParseFloat(spamQueueThresholdString, 64)
+		if err != nil {
+			panic(errors.Wrapf(err, "can't parse COMMENTS_SPAM_QUEUE_THRESHOLD '%s' as a number", spamQueueThresholdString))
+		}
+	}
+	spamRejectThresholdString = os.ExpandEnv(spamRejectThresholdString)
+	if spamRejectThresholdString != "" {
+		spamRejectThreshold, err = strconv.ParseFloat(spamRejectThresholdString, 64)
+		if err != nil {
+			panic(errors.Wrapf(err, "can't parse COMMENTS_SPAM_REJECT_THRESHOLD '%s' as a number", spamRejectThresholdString))
+		}
+	}
+	// the default akismet and bayes scores depend on the thresholds
+	initAkismet()
+	initBayes()
+
+	spamMaxLinksString = os.ExpandEnv(spamMaxLinksString)
+	if spamMaxLinksString != "" {
+		spamMaxLinks, err = strconv.Atoi(spamMaxLinksString)
+		if err != nil {
+			panic(errors.Wrapf(err, "can't parse COMMENTS_SPAM_MAX_LINKS '%s' as int", spamMaxLinksString))
+		}
+	}
+	maxBodyLengthString = os.ExpandEnv(maxBodyLengthString)
+	if maxBodyLengthString != "" {
+		maxBodyLength, err = strconv.Atoi(maxBodyLengthString)
+		if err != nil {
+			panic(errors.Wrapf(err, "can't parse COMMENTS_MAX_BODY_LENGTH '%s' as int", maxBodyLengthString))
+		}
+	}
+	spamBannedWordsString = os.ExpandEnv(spamBannedWordsString)
+	spamBannedWords = []*regexp.Regexp{}
+	for _, pattern := range splitNonEmpty(spamBannedWordsString, ",") {
+		bannedWord, err := regexp.Compile(fmt.Sprintf("(?i)%s", strings.TrimSpace(pattern)))
+		if err != nil {
+			panic(errors.Wrapf(err, "can't parse COMMENTS_SPAM_BANNED_WORDS entry '%s' as a regular expression", pattern))
+		}
+		spamBannedWords = append(spamBannedWords, bannedWord)
+	}
+
+	spamFilters = []spamFilter{
+		{Name: "links", Check: checkSpamLinkCount},
+		{Name: "banned words", Check: checkSpamBannedWords},
+		{Name: "body length", Check: checkSpamBodyLength},
+		{Name: "duplicate", Check: checkSpamDuplicate},
+		{Name: "known bad identity", Check: checkSpamKnownBadIdentity},
+		{Name: "bayes", Check: checkSpamBayes},
+	}
+	if akismetAPIKey != "" {
+		spamFilters = append(spamFilters, spamFilter{Name: "akismet", Check: checkSpamAkismet})
+	}
+
+	log.Printf("spam filter: queue threshold %.2f, reject threshold %.2f\n", spamQueueThreshold, spamRejectThreshold)
+}
+
+// runSpamFilters runs every spam filter against the comment and stores the total score and the reasons on it.
+func runSpamFilters(comment *Comment) {
+	comment.SpamScore = 0
+	comment.SpamReasons = nil
+	comment.SpamProbability = 0
+	for _, filter := range spamFilters {
+		score, reason := filter.Check(comment)
+		if score > 0 {
+			comment.SpamScore += score
+			comment.SpamReasons = append(comment.SpamReasons, fmt.Sprintf("%s (+%.2f): %s", filter.Name, score, reason))
+		}
+	}
+}
+
+func checkSpamLinkCount(comment *Comment) (float64, string) {
+	linkCount := len(linkRegexp.FindAllString(comment.Body, -1))
+	if linkCount <= spamMaxLinks {
+		return 0, ""
+	}
+	return float64(linkCount - spamMaxLinks), fmt.Sprintf("contains %d links", linkCount)
+}
+
+func checkSpamBannedWords(comment *Comment) (float64, string) {
+	matched := []string{}
+	for _, bannedWord := range spamBannedWords {
+		if bannedWord.MatchString(comment.Body) || bannedWord.MatchString(comment.Username) {
+			matched = append(matched, strings.TrimPrefix(bannedWord.String(), "(?i)"))
+		}
+	}
+	if len(matched) == 0 {
+		return 0, ""
+	}
+	return float64(len(matched)), fmt.Sprintf("matched %s", strings.Join(matched, ", "))
+}
+
+func checkSpamBodyLength(comment *Comment) (float64, string) {
+	length := utf8.RuneCountInString(comment.Body)
+	if length <= maxBodyLength {
+		return 0, ""
+	}
+	return spamQueueThreshold, fmt.Sprintf("body is %d characters long", length)
+}
+
+func checkSpamDuplicate(comment *Comment) (float64, string) {
+	var previousDate int64
+	db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("spam_body_hashes"))
+		if bucket != nil {
+			previousDate, _ = strconv.ParseInt(string(bucket.Get(spamBodyHash(comment.Body))), 10, 64)
+		}
+		return nil
+	})
+	if previousDate < getMillisecondsSinceUnixEpoch()-int64(duplicateBodyWindow/time.Millisecond) {
+		return 0, ""
+	}
+	return spamQueueThreshold * 2, fmt.Sprintf("same body was posted on %s", time.Unix(previousDate/1000, 0).UTC().Format(time.RFC3339))
+}
+
+func checkSpamKnownBadIdentity(comment *Comment) (float64, string) {
+	if comment.AvatarHash == "" {
+		return 0, ""
+	}
+	count := 0
+	db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("spam_identities"))
+		if bucket != nil {
+			count, _ = strconv.Atoi(string(bucket.Get([]byte(comment.AvatarHash))))
+		}
+		return nil
+	})
+	if count == 0 {
+		return 0, ""
+	}
+	return float64(count), fmt.Sprintf("%d previous comments from %s were rejected as spam", count, comment.AvatarHash)
+}
+
+// rememberCommentForSpamFilters is called inside the transaction that stores a comment
+func rememberCommentForSpamFilters(tx *bolt.Tx, comment *Comment) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte("spam_body_hashes"))
+	if err != nil {
+		return err
+	}
+	return bucket.Put(spamBodyHash(comment.Body), []byte(strconv.FormatInt(comment.Date, 10)))
+}
+
+// markIdentityAsSpammer is called inside the transaction where an admin rejects a comment as spam
+func markIdentityAsSpammer(tx *bolt.Tx, avatarHash string) error {
+	if avatarHash == "" {
+		return nil
+	}
+	bucket, err := tx.CreateBucketIfNotExists([]byte("spam_identities"))
+	if err != nil {
+		return err
+	}
+	count := 0
+	countBytes := bucket.Get([]byte(avatarHash))
+	if countBytes != nil {
+		count, _ = strconv.Atoi(string(countBytes))
+	}
+	return bucket.Put([]byte(avatarHash), []byte(strconv.Itoa(count+1)))
+}
+
+func spamBodyHash(body string) []byte {
+	normalized := strings.ToLower(strings.TrimSpace(whitespaceRegexp.ReplaceAllString(body, " ")))
+	hash := sha256.Sum256([]byte(normalized))
+	return []byte(fmt.Sprintf("%x", hash))
+}
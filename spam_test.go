@@ -0,0 +1,201 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func openTestDB(t *testing.T) *bolt.DB {
+	testDB, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { testDB.Close() })
+	return testDB
+}
+
+func TestCheckSpamLinkCount(t *testing.T) {
+	spamMaxLinks = 2
+	tests := []struct {
+		body  string
+		score float64
+	}{
+		{"no links here", 0},
+		{"see https://example.com and http://example.org", 0},
+		{"https://a.com https://b.com www.c.com", 1},
+		{"HTTPS://A.COM http://b.com www.c.com https://d.com www.e.com", 3},
+	}
+	for _, test := range tests {
+		score, _ := checkSpamLinkCount(&Comment{Body: test.body})
+		if score != test.score {
+			t.Errorf("checkSpamLinkCount(%q): expected %.2f, got %.2f", test.body, test.score, score)
+		}
+	}
+}
+
+func TestCheckSpamBannedWords(t *testing.T) {
+	spamBannedWords = []*regexp.Regexp{regexp.MustCompile("(?i)casino"), regexp.MustCompile("(?i)cheap pills?")}
+	tests := []struct {
+		username string
+		body     string
+		score    float64
+	}{
+		{"alice", "a perfectly normal comment", 0},
+		{"alice", "visit my CASINO", 1},
+		{"casino king", "hello", 1},
+		{"alice", "cheap pills at the casino", 2},
+	}
+	for _, test := range tests {
+		score, _ := checkSpamBannedWords(&Comment{Username: test.username, Body: test.body})
+		if score != test.score {
+			t.Errorf("checkSpamBannedWords(%q, %q): expected %.2f, got %.2f", test.username, test.body, test.score, score)
+		}
+	}
+}
+
+func TestCheckSpamBodyLength(t *testing.T) {
+	maxBodyLength = 10
+	spamQueueThreshold = 1
+	tests := []struct {
+		body  string
+		score float64
+	}{
+		{"short", 0},
+		{"ünïcödé ök", 0},
+		{strings.Repeat("x", 11), 1},
+	}
+	for _, test := range tests {
+		score, _ := checkSpamBodyLength(&Comment{Body: test.body})
+		if score != test.score {
+			t.Errorf("checkSpamBodyLength(%q): expected %.2f, got %.2f", test.body, test.score, score)
+		}
+	}
+}
+
+func TestCheckSpamDuplicate(t *testing.T) {
+	db = openTestDB(t)
+	spamQueueThreshold = 1
+	now := getMillisecondsSinceUnixEpoch()
+	err := db.Update(func(tx *bolt.Tx) error {
+		err := rememberCommentForSpamFilters(tx, &Comment{Body: "First!  Great post.", Date: now})
+		if err != nil {
+			return err
+		}
+		return rememberCommentForSpamFilters(tx, &Comment{Body: "an old comment", Date: now - 2*int64(duplicateBodyWindow.Milliseconds())})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		body  string
+		score float64
+	}{
+		{"first! great   post.", 2},
+		{"a new comment", 0},
+		{"an old comment", 0},
+	}
+	for _, test := range tests {
+		score, _ := checkSpamDuplicate(&Comment{Body: test.body})
+		if score != test.score {
+			t.Errorf("checkSpamDuplicate(%q): expected %.2f, got %.2f", test.body, test.score, score)
+		}
+	}
+}
+
+func TestCheckSpamKnownBadIdentity(t *testing.T) {
+	db = openTestDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		for i := 0; i < 3; i++ {
+			if err := markIdentityAsSpammer(tx, "abc123"); err != nil {
+				return err
+			}
+		}
+		return markIdentityAsSpammer(tx, "")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		avatarHash string
+		score      float64
+	}{
+		{"abc123", 3},
+		{"def456", 0},
+		{"", 0},
+	}
+	for _, test := range tests {
+		score, _ := checkSpamKnownBadIdentity(&Comment{AvatarHash: test.avatarHash})
+		if score != test.score {
+			t.Errorf("checkSpamKnownBadIdentity(%q): expected %.2f, got %.2f", test.avatarHash, test.score, score)
+		}
+	}
+}
+
+func TestCheckSpamBayes(t *testing.T) {
+	db = openTestDB(t)
+	bayesScore = 2
+
+	untrained, err := classifyBayes(&Comment{Body: "cheap pills"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if untrained != -1 {
+		t.Fatalf("an untrained classifier should return -1, got %.2f", untrained)
+	}
+
+	spamBodies := []string{"cheap pills at https://pills.example", "buy cheap pills now", "cheap pills and casino", "casino bonus, cheap pills", "pills pills pills"}
+	hamBodies := []string{"great article, thanks", "thanks for writing this", "I disagree with the second part", "great point about the article", "what a great read"}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for i, body := range spamBodies {
+			if err := trainBayes(tx, &Comment{DocumentID: "doc", Date: int64(i), Body: body}, bayesLabelSpam); err != nil {
+				return err
+			}
+		}
+		for i, body := range hamBodies {
+			if err := trainBayes(tx, &Comment{DocumentID: "doc", Date: int64(100 + i), Body: body}, bayesLabelHam); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		body string
+		spam bool
+	}{
+		{"cheap pills at the casino", true},
+		{"thanks, great article", false},
+	}
+	for _, test := range tests {
+		score, _ := checkSpamBayes(&Comment{Body: test.body})
+		if (score > 0) != test.spam {
+			t.Errorf("checkSpamBayes(%q): expected spam=%t, got a score of %.2f", test.body, test.spam, score)
+		}
+		if score > bayesScore {
+			t.Errorf("checkSpamBayes(%q): the score %.2f should never exceed COMMENTS_BAYES_SCORE", test.body, score)
+		}
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		return trainBayes(tx, &Comment{DocumentID: "doc", Date: 0, Body: spamBodies[0]}, bayesLabelHam)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		spamComments, hamComments := getBayesTrainingCounts(tx)
+		if spamComments != len(spamBodies)-1 || hamComments != len(hamBodies)+1 {
+			t.Errorf("relabelling a comment should move it to the other class, got %d spam and %d ham", spamComments, hamComments)
+		}
+		return nil
+	})
+}
@@ -9,7 +9,10 @@
   let commentForm;
   let submitButton;
 
-  xhr("GET", `${commentsURL}/api/${documentID}?t=${Date.now()}`, undefined, displayCommentsFromJSON);
+  // the identity token lets the server recognize comments we posted ourselves
+  const identityTokenKey = "sqr-identity-token";
+
+  xhr("GET", `${commentsURL}/api/${documentID}?t=${Date.now()}${identityQuery()}`, undefined, displayCommentsFromJSON);
 
   let currentFormContainer;
 
@@ -21,6 +24,11 @@
       } else {
         response = responseRaw;
       }
+      if(response.identityToken) {
+        try {
+          window.localStorage.setItem(identityTokenKey, response.identityToken);
+        } catch (err) {}
+      }
       if(response.captchaURL.endsWith("/")) {
         response.captchaURL = response.captchaURL.substring(0, response.captchaURL.length-1);
       }
@@ -53,9 +61,14 @@
 
       commentContainer.innerHTML = "";
 
+      const isOpen = !response.documentState || response.documentState == "open";
       const rootReplyButton = createElement(commentContainer, "button", { "class": "sqr-btn sqr-reply" });
       createElement(rootReplyButton, "i", { "class": "fa fa-reply" }, "");
       appendFragment(rootReplyButton, " leave a comment ");
+      if(!isOpen) {
+        rootReplyButton.style.display = 'none';
+        createElement(commentContainer, "div", { "class": "sqr-notice" }, "Comments are closed.");
+      }
 
       const rootFormContainer = createElement(commentContainer, "div");
 
@@ -68,6 +81,10 @@
         rootReplyButton.onclick();
       }
 
+      if(response.notice) {
+        createElement(commentContainer, "div", { "class": "sqr-notice" }, response.notice);
+      }
+
       if(!response.comments || response.comments.length == 0) {
         createElement(
           commentContainer, 
@@ -100,6 +117,12 @@
         const postRow = createElement(postColumn, "div");
         createElement(postRow, "span", { "class": "sqr-username" }, x.username);
         createElement(postRow, "span", { "class": "sqr-avatar-hash" }, x.avatarHash);
+        if(x.isAuthor) {
+          createElement(postRow, "span", { "class": "sqr-badge" }, "author");
+        }
+        if(x.pinned) {
+          createElement(postRow, "span", { "class": "sqr-badge" }, "📌 pinned");
+        }
         if(parentComment) {
           const inReplyTo = createElement(postRow, "span", { "class": "sqr-in-reply-to" }, " in reply to ");
           inReplyTo.innerHTML = `${inReplyTo.innerHTML}&nbsp;&nbsp;&nbsp;`;
@@ -113,6 +136,9 @@
           { "class": "sqr-date" }, 
           new Date(Number(x.date)).toDateString()
         );
+        if(x.edited) {
+          createElement(postRow, "span", { "class": "sqr-date" }, "(edited)");
+        }
         const content = createElement(postColumn, "div");
         const bottomRow = createElement(postColumn, "div", {"class": "sqr-comment-bottom-row"});
         const linkURL = `${window.location.href.split("#")[0]}#${postID}`;
@@ -121,8 +147,13 @@
           Array.from(document.querySelectorAll(".sqr-post-column")).forEach(x => x.classList.remove("sqr-highlighted"));
           postColumn.classList.add("sqr-highlighted");
         };
-        appendFragment(bottomRow, " | ")
+        if(isOpen) {
+          appendFragment(bottomRow, " | ")
+        }
         const replyButton = createElement(bottomRow, "span", {}, "💬 reply");
+        if(!isOpen) {
+          replyButton.style.display = 'none';
+        }
         const formContainer = createElement(comment, "div", {
           "id": `sqr-form-container-${postID}`,
           "class": "sqr-reply-to-comment-form"
@@ -135,6 +166,18 @@
         if(justPostedReplyTo == postID && response.error) {
           replyButton.onclick();
         }
+        if(response.documentState != "archived") {
+          appendFragment(bottomRow, " | ")
+        }
+        const flagButton = createElement(bottomRow, "span", {}, "🚩 flag");
+        if(response.documentState == "archived") {
+          flagButton.style.display = 'none';
+        }
+        const flagContainer = createElement(postColumn, "div", { "class": "sqr-flag-form" });
+        flagButton.onclick = () => {
+          flagButton.onclick = null;
+          displayFlagForm(flagContainer, x);
+        };
         // TODO migrate to DOMPurify for this ?
         content.innerHTML = x.bodyHTML;
 
@@ -291,6 +334,36 @@
     }
   }
 
+  function displayFlagForm(parent, comment) {
+    const flagForm = createElement(parent, "form", { "method": "POST", "action": "#" });
+    const reasonSelect = createElement(flagForm, "select", { "name": "reason" });
+    ["spam", "abuse", "off-topic", "other"].forEach(x => createElement(reasonSelect, "option", { "value": x }, x));
+    const detailsInput = createElement(flagForm, "input", { "type": "text", "name": "details", "placeholder": "details (optional)" });
+    const flagSubmitButton = createElement(flagForm, "button", { "class": "sqr-btn" }, "flag this comment");
+
+    flagSubmitButton.onclick = function(event) {
+      flagSubmitButton.disabled = true;
+      const payload = { date: comment.date, reason: reasonSelect.value, details: detailsInput.value };
+      xhr("POST", `${commentsURL}/flag/${documentID}`, payload, (responseText) => {
+        let error = "";
+        try {
+          error = JSON.parse(responseText).error;
+        } catch (err) {
+          error = "error flagging comment";
+        }
+        parent.innerHTML = "";
+        if(error) {
+          createElement(parent, "div", { "class": "sqr-error" }, `Error: ${error}`);
+        } else {
+          createElement(parent, "div", { "class": "sqr-notice" }, "Thank you, a moderator will take a look at this comment.");
+        }
+      });
+
+      event.preventDefault();
+      return false;
+    };
+  }
+
   function postComment() {
     var payload = Array.prototype.slice.call(commentForm)
       .reduce(function(result, x) {
@@ -306,7 +379,7 @@
         return result;
       }, {});
 
-    xhr("POST", `${commentsURL}/api/${documentID}`, payload, (response) => displayCommentsFromJSON(response, payload.inReplyTo));
+    xhr("POST", `${commentsURL}/api/${documentID}?t=${Date.now()}${identityQuery()}`, payload, (response) => displayCommentsFromJSON(response, payload.inReplyTo));
   }
 
   window.sqrCaptchaCompleted = function() {
@@ -331,6 +404,15 @@
     parent.appendChild(fragment)
   }
   
+  function identityQuery() {
+    try {
+      const token = window.localStorage.getItem(identityTokenKey);
+      return token ? `&identity=${encodeURIComponent(token)}` : "";
+    } catch (err) {
+      return "";
+    }
+  }
+
   function xhr(method, url, body, callback) {
     var request = new XMLHttpRequest();
     request.addEventListener("load", function() {
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const statsDays = 30
+const statsTopCount = 10
+
+// EmailStats counts the emails sent on a single day, they are stored in the email_stats bucket keyed by YYYY-MM-DD
+type EmailStats struct {
+	Sent   int `json:"sent"`
+	Failed int `json:"failed"`
+}
+
+// CommentStats counts the comments posted on a single day, they are stored in the comment_stats bucket keyed by
+// YYYY-MM-DD. they are counted when a comment is written, so the admin index doesn't have to read every comment.
+// Commenters counts the commenters of every site, SiteCommenters only those of the named site.
+type CommentStats struct {
+	Comments       int                               `json:"comments"`
+	Documents      map[string]*statsCount            `json:"documents,omitempty"`
+	Commenters     map[string]*statsCount            `json:"commenters,omitempty"`
+	SiteCommenters map[string]map[string]*statsCount `json:"siteCommenters,omitempty"`
+}
+
+type statsCount struct {
+	Name  string `json:"name"`
+	Link  string `json:"link,omitempty"`
+	Count int    `json:"count"`
+}
+
+// adminStats is displayed on the admin index page. the charts are rendered on the server as SVG.
+type adminStats struct {
+	Days           int
+	Comments       int
+	EmailsSent     int
+	EmailsFailed   int
+	CommentsPerDay template.HTML
+	EmailsPerDay   template.HTML
+	TopDocuments   []statsCount
+	TopCommenters  []statsCount
+}
+
+// recordEmailResult is called once for every email, when it was sent or given up. retries are not counted.
+func recordEmailResult(sendErr error) {
+	day := time.Now().UTC().Format("2006-01-02")
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("email_stats"))
+		if err != nil {
+			return err
+		}
+		var stats EmailStats
+		statsBytes := bucket.Get([]byte(day))
+		if statsBytes != nil {
+			err = json.Unmarshal(statsBytes, &stats)
+			if err != nil {
+				return err
+			}
+		}
+		if sendErr == nil {
+			stats.Sent++
+		} else {
+			stats.Failed++
+		}
+		statsBytes, err = json.Marshal(stats)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(day), statsBytes)
+	})
+	if err != nil {
+		log.Printf("failed to record email stats: %v\n", err)
+	}
+}
+
+// initCommentStats counts the existing comments of the last statsDays days the first time the server starts
+// with statistics
+func initCommentStats() {
+	err := db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("comment_stats")) != nil {
+			return nil
+		}
+		_, err := tx.CreateBucket([]byte("comment_stats"))
+		if err != nil {
+			return err
+		}
+		from := time.Now().UTC().Add(-time.Hour * 24 * statsDays).Format("2006-01-02")
+		comments, err := findComments(tx, &commentFilter{From: from})
+		if err != nil {
+			return err
+		}
+		for i := range comments {
+			err = recordCommentStats(tx, &comments[i])
+			if err != nil {
+				return err
+			}
+		}
+		log.Printf("counted %d comments for the statistics\n", len(comments))
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to count the comments for the statistics: %v\n", err)
+	}
+}
+
+// recordCommentStats is called inside the transaction which writes a new comment
+func recordCommentStats(tx *bolt.Tx, comment *Comment) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte("comment_stats"))
+	if err != nil {
+		return err
+	}
+	day := []byte(time.Unix(comment.Date/1000, 0).UTC().Format("2006-01-02"))
+	stats := CommentStats{}
+	statsBytes := bucket.Get(day)
+	if statsBytes != nil {
+		err = json.Unmarshal(statsBytes, &stats)
+		if err != nil {
+			return err
+		}
+	}
+	if stats.Documents == nil {
+		stats.Documents = map[string]*statsCount{}
+	}
+	if stats.Commenters == nil {
+		stats.Commenters = map[string]*statsCount{}
+	}
+	if stats.SiteCommenters == nil {
+		stats.SiteCommenters = map[string]map[string]*statsCount{}
+	}
+	stats.Comments++
+
+	if _, has := stats.Documents[comment.DocumentID]; !has {
+		stats.Documents[comment.DocumentID] = &statsCount{Name: comment.DocumentTitle, Link: comment.DocumentID}
+	}
+	stats.Documents[comment.DocumentID].Count++
+
+	commenter := comment.AvatarHash
+	if commenter == "" {
+		commenter = fmt.Sprintf("username:%s", comment.Username)
+	}
+	if _, has := stats.Commenters[commenter]; !has {
+		stats.Commenters[commenter] = &statsCount{Name: comment.Username}
+		if comment.AvatarHash != "" {
+			stats.Commenters[commenter].Link = fmt.Sprintf("%sbulk?avatarHash=%s", adminPagePrefix, comment.AvatarHash)
+		}
+	}
+	stats.Commenters[commenter].Count++
+
+	// the bulk actions are only available on the default site, so the commenters of a named site have no link
+	if site := siteForDocument(comment.DocumentID); site.Name != "" {
+		if stats.SiteCommenters[site.Name] == nil {
+			stats.SiteCommenters[site.Name] = map[string]*statsCount{}
+		}
+		if _, has := stats.SiteCommenters[site.Name][commenter]; !has {
+			stats.SiteCommenters[site.Name][commenter] = &statsCount{Name: comment.Username}
+		}
+		stats.SiteCommenters[site.Name][commenter].Count++
+	}
+
+	statsBytes, err = json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(day, statsBytes)
+}
+
+// getAdminStats only counts the documents which the admins of the site can administer. the emails are counted for the
+// whole server, so they are left out of the stats of the named sites.
+func getAdminStats(tx *bolt.Tx, site *Site) (*adminStats, error) {
+	stats := &adminStats{Days: statsDays}
+
+	today := time.Now().UTC().Truncate(time.Hour * 24)
+	days := []string{}
+	for i := statsDays - 1; i >= 0; i-- {
+		days = append(days, today.Add(-time.Hour*24*time.Duration(i)).Format("2006-01-02"))
+	}
+
+	documents := map[string]*statsCount{}
+	commenters := map[string]*statsCount{}
+	commentCounts := make([]int, len(days))
+	commentStatsBucket := tx.Bucket([]byte("comment_stats"))
+	for i, day := range days {
+		if commentStatsBucket == nil {
+			break
+		}
+		statsBytes := commentStatsBucket.Get([]byte(day))
+		if statsBytes == nil {
+			continue
+		}
+		var commentStats CommentStats
+		err := json.Unmarshal(statsBytes, &commentStats)
+		if err != nil {
+			return nil, err
+		}
+		for documentID, count := range commentStats.Documents {
+			if !site.CanAdminister(documentID) {
+				continue
+			}
+			if _, has := documents[documentID]; !has {
+				documents[documentID] = &statsCount{Name: count.Name, Link: count.Link}
+			}
+			documents[documentID].Count += count.Count
+			commentCounts[i] += count.Count
+		}
+		stats.Comments += commentCounts[i]
+		if site.Name == "" {
+			addCounts(commenters, commentStats.Commenters)
+		} else {
+			addCounts(commenters, commentStats.SiteCommenters[site.Name])
+		}
+	}
+	stats.TopDocuments = topCounts(documents)
+	stats.TopCommenters = topCounts(commenters)
+	stats.CommentsPerDay = svgBarChart(days, [][]int{commentCounts}, []string{"#9359fa"})
+	if site.Name != "" {
+		return stats, nil
+	}
+
+	sent := make([]int, len(days))
+	failed := make([]int, len(days))
+	emailStatsBucket := tx.Bucket([]byte("email_stats"))
+	for i, day := range days {
+		if emailStatsBucket == nil {
+			continue
+		}
+		statsBytes := emailStatsBucket.Get([]byte(day))
+		if statsBytes == nil {
+			continue
+		}
+		var emailStats EmailStats
+		err := json.Unmarshal(statsBytes, &emailStats)
+		if err != nil {
+			return nil, err
+		}
+		sent[i] = emailStats.Sent
+		failed[i] = emailStats.Failed
+		stats.EmailsSent += emailStats.Sent
+		stats.EmailsFailed += emailStats.Failed
+	}
+
+	stats.EmailsPerDay = svgBarChart(days, [][]int{sent, failed}, []string{"#5995fa", "#fa5959"})
+	return stats, nil
+}
+
+// addCounts adds the counts of a single day to the totals
+func addCounts(totals map[string]*statsCount, counts map[string]*statsCount) {
+	for key, count := range counts {
+		if _, has := totals[key]; !has {
+			totals[key] = &statsCount{Name: count.Name, Link: count.Link}
+		}
+		totals[key].Count += count.Count
+	}
+}
+
+func topCounts(counts map[string]*statsCount) []statsCount {
+	top := []statsCount{}
+	for _, count := range counts {
+		top = append(top, *count)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count == top[j].Count {
+			return top[i].Name < top[j].Name
+		}
+		return top[i].Count > top[j].Count
+	})
+	if len(top) > statsTopCount {
+		top = top[:statsTopCount]
+	}
+	return top
+}
+
+// svgBarChart draws one bar per label, the series are stacked on top of each other in the given colors
+func svgBarChart(labels []string, series [][]int, colors []string) template.HTML {
+	const width = 600
+	const height = 150
+	const labelHeight = 16
+
+	max := 1
+	for i := range labels {
+		total := 0
+		for _, values := range series {
+			total += values[i]
+		}
+		max = maxInt(max, total)
+	}
+
+	barWidth := float64(width) / float64(len(labels))
+	chartHeight := float64(height - labelHeight*2)
+	var svg strings.Builder
+	svg.WriteString(fmt.Sprintf(
+		`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" class="sqr-chart">`,
+		width, height, width, height,
+	))
+	svg.WriteString(fmt.Sprintf(`<text x="0" y="12" font-size="12">%d</text>`, max))
+	for i, label := range labels {
+		y := float64(labelHeight) + chartHeight
+		tooltip := []string{}
+		for j, values := range series {
+			barHeight := chartHeight * float64(values[i]) / float64(max)
+			y -= barHeight
+			svg.WriteString(fmt.Sprintf(
+				`<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"/>`,
+				float64(i)*barWidth+1, y, barWidth-2, barHeight, colors[j],
+			))
+			tooltip = append(tooltip, fmt.Sprintf("%d", values[i]))
+		}
+		svg.WriteString(fmt.Sprintf(
+			`<rect x="%.1f" y="%d" width="%.1f" height="%.1f" fill-opacity="0"><title>%s: %s</title></rect>`,
+			float64(i)*barWidth, labelHeight, barWidth, chartHeight, html.EscapeString(label), strings.Join(tooltip, " / "),
+		))
+	}
+	svg.WriteString(fmt.Sprintf(`<text x="0" y="%d" font-size="12">%s</text>`, height-2, html.EscapeString(labels[0])))
+	svg.WriteString(fmt.Sprintf(
+		`<text x="%d" y="%d" font-size="12" text-anchor="end">%s</text>`,
+		width, height-2, html.EscapeString(labels[len(labels)-1]),
+	))
+	svg.WriteString(`</svg>`)
+	return template.HTML(svg.String())
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestCommentStats(t *testing.T) {
+	db = openTestDB(t)
+	defaultSite = &Site{}
+	blog := &Site{Name: "blog"}
+	namedSites = map[string]*Site{"blog": blog}
+	defer (func() { namedSites = map[string]*Site{} })()
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	yesterday := now - int64(time.Hour*24/time.Millisecond)
+	tooOld := now - int64(time.Hour*24*(statsDays+1)/time.Millisecond)
+	comments := []Comment{
+		{DocumentID: "a", DocumentTitle: "A", Username: "alice", AvatarHash: "abc123", Date: now},
+		{DocumentID: "a", DocumentTitle: "A", Username: "alice", AvatarHash: "abc123", Date: yesterday},
+		{DocumentID: "b", DocumentTitle: "B", Username: "bob", Date: yesterday},
+		{DocumentID: "b", DocumentTitle: "B", Username: "carol", Date: tooOld},
+		{DocumentID: "blog~c", DocumentTitle: "C", Username: "alice", AvatarHash: "abc123", Date: now},
+		{DocumentID: "blog~c", DocumentTitle: "C", Username: "dave", Date: yesterday},
+		{DocumentID: "blog~d", DocumentTitle: "D", Username: "dave", Date: now},
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		for i := range comments {
+			if err := recordCommentStats(tx, &comments[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stats *adminStats
+	err = db.View(func(tx *bolt.Tx) error {
+		var err error
+		stats, err = getAdminStats(tx, defaultSite)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Comments != 6 {
+		t.Errorf("expected 6 comments in the last %d days, got %d", statsDays, stats.Comments)
+	}
+	expectedDocuments := []statsCount{{Name: "A", Link: "a", Count: 2}, {Name: "C", Link: "blog~c", Count: 2}, {Name: "B", Link: "b", Count: 1}, {Name: "D", Link: "blog~d", Count: 1}}
+	if len(stats.TopDocuments) != len(expectedDocuments) {
+		t.Fatalf("expected %d documents, got %+v", len(expectedDocuments), stats.TopDocuments)
+	}
+	for i, expected := range expectedDocuments {
+		if stats.TopDocuments[i] != expected {
+			t.Errorf("expected top document %d to be %+v, got %+v", i, expected, stats.TopDocuments[i])
+		}
+	}
+	expectedCommenters := []statsCount{{Name: "alice", Link: adminPagePrefix + "bulk?avatarHash=abc123", Count: 3}, {Name: "dave", Count: 2}, {Name: "bob", Count: 1}}
+	if len(stats.TopCommenters) != len(expectedCommenters) {
+		t.Fatalf("expected %d commenters, got %+v", len(expectedCommenters), stats.TopCommenters)
+	}
+	for i, expected := range expectedCommenters {
+		if stats.TopCommenters[i] != expected {
+			t.Errorf("expected top commenter %d to be %+v, got %+v", i, expected, stats.TopCommenters[i])
+		}
+	}
+}
+
+func TestCommentStatsOfNamedSites(t *testing.T) {
+	db = openTestDB(t)
+	defaultSite = &Site{}
+	blog := &Site{Name: "blog"}
+	namedSites = map[string]*Site{"blog": blog}
+	defer (func() { namedSites = map[string]*Site{} })()
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	comments := []Comment{
+		{DocumentID: "a", DocumentTitle: "A", Username: "alice", AvatarHash: "abc123", Date: now},
+		{DocumentID: "blog~c", DocumentTitle: "C", Username: "alice", AvatarHash: "abc123", Date: now},
+		{DocumentID: "blog~c", DocumentTitle: "C", Username: "dave", Date: now},
+	}
+	var stats *adminStats
+	err := db.Update(func(tx *bolt.Tx) error {
+		for i := range comments {
+			if err := recordCommentStats(tx, &comments[i]); err != nil {
+				return err
+			}
+		}
+		var err error
+		stats, err = getAdminStats(tx, blog)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Comments != 2 {
+		t.Errorf("expected the 2 comments of the blog, got %d", stats.Comments)
+	}
+	if len(stats.TopDocuments) != 1 || stats.TopDocuments[0] != (statsCount{Name: "C", Link: "blog~c", Count: 2}) {
+		t.Errorf("expected only the document of the blog, got %+v", stats.TopDocuments)
+	}
+	expectedCommenters := []statsCount{{Name: "alice", Count: 1}, {Name: "dave", Count: 1}}
+	if len(stats.TopCommenters) != len(expectedCommenters) {
+		t.Fatalf("expected %d commenters, got %+v", len(expectedCommenters), stats.TopCommenters)
+	}
+	for i, expected := range expectedCommenters {
+		if stats.TopCommenters[i] != expected {
+			t.Errorf("expected top commenter %d to be %+v, got %+v", i, expected, stats.TopCommenters[i])
+		}
+	}
+	if stats.EmailsPerDay != "" {
+		t.Error("the emails of the whole server should not be in the stats of a named site")
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"html/template"
+	"image/png"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+	"github.com/boltdb/bolt"
+	"rsc.io/qr"
+)
+
+// two-factor authentication with time-based one-time passwords (RFC 6238), the kind that authenticator apps generate.
+// admins enrol on their account page, and COMMENTS_ADMIN_REQUIRE_TOTP makes it mandatory for some roles.
+
+const auditActionTOTPEnable = "user.totp.enable"
+const auditActionTOTPDisable = "user.totp.disable"
+const auditActionTOTPReset = "user.totp.reset"
+
+const totpPeriod = 30
+const totpDigits = 6
+const totpRecoveryCodes = 10
+
+// the second step of the login has to be completed within this time after the password was checked
+const totpLoginTimeout = time.Minute * 5
+
+var adminRequireTOTPString = "$COMMENTS_ADMIN_REQUIRE_TOTP"
+var adminRequireTOTPRoles = map[string]bool{}
+
+func initTOTP() {
+	adminRequireTOTPString = os.ExpandEnv(adminRequireTOTPString)
+	for _, role := range splitNonEmpty(adminRequireTOTPString, ",") {
+		role = strings.TrimSpace(role)
+		if !validAdminRole(role) {
+			panic(errors.Errorf("COMMENTS_ADMIN_REQUIRE_TOTP: unknown role '%s'", role))
+		}
+		adminRequireTOTPRoles[role] = true
+	}
+}
+
+func newTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret), nil
+}
+
+func totpCode(secret []byte, counter int64) string {
+	counterBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(counterBytes, uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counterBytes)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%uint32(math.Pow10(totpDigits)))
+}
+
+// verifyTOTP returns the time step of the code, or 0 if it is wrong. codes from one step before and after are
+// accepted because clocks drift, but a code is never accepted for a step at or before lastCounter, so it can't be replayed.
+func verifyTOTP(secretBase32, code string, lastCounter int64) int64 {
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secretBase32)
+	if err != nil {
+		return 0
+	}
+	code = strings.ReplaceAll(code, " ", "")
+	now := time.Now().Unix() / totpPeriod
+	for counter := now - 1; counter <= now+1; counter++ {
+		if counter > lastCounter && hmac.Equal([]byte(totpCode(secret, counter)), []byte(code)) {
+			return counter
+		}
+	}
+	return 0
+}
+
+func totpURI(username, secret string) string {
+	issuer := "comments"
+	if commentsURL, err := url.Parse(commentsURLString); err == nil && commentsURL.Host != "" {
+		issuer = fmt.Sprintf("comments on %s", commentsURL.Host)
+	}
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("period", strconv.Itoa(totpPeriod))
+	query.Set("digits", strconv.Itoa(totpDigits))
+	return fmt.Sprintf("otpauth://totp/%s:%s?%s", url.PathEscape(issuer), url.PathEscape(username), query.Encode())
+}
+
+// totpQRCode renders the enrolment QR code as a PNG data URI, so it never leaves the page it was shown on
+func totpQRCode(uri string) (template.URL, error) {
+	code, err := qr.Encode(uri, qr.M)
+	if err != nil {
+		return "", err
+	}
+	code.Scale = 5
+	var buffer bytes.Buffer
+	err = png.Encode(&buffer, code.Image())
+	if err != nil {
+		return "", err
+	}
+	return template.URL(fmt.Sprintf("data:image/png;base64,%s", base64.StdEncoding.EncodeToString(buffer.Bytes()))), nil
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(normalized)))
+}
+
+// newRecoveryCodes returns the codes to show to the admin once and the hashes to store
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := []string{}
+	hashes := []string{}
+	for i := 0; i < totpRecoveryCodes; i++ {
+		randomBytes := make([]byte, 5)
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		code := fmt.Sprintf("%x", randomBytes)
+		code = fmt.Sprintf("%s-%s", code[:5], code[5:])
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// checkSecondFactor accepts a code from the authenticator app or one of the recovery codes, which can only be used once.
+// it returns how the user was authenticated, or an empty string if the code is wrong.
+func checkSecondFactor(tx *bolt.Tx, user *AdminUser, code string) (string, error) {
+	if counter := verifyTOTP(user.TOTPSecret, code, user.TOTPLastCounter); counter != 0 {
+		user.TOTPLastCounter = counter
+		return "totp", putAdminUser(tx, user, "")
+	}
+	codeHash := hashRecoveryCode(code)
+	for i, recoveryCode := range user.RecoveryCodes {
+		if hmac.Equal([]byte(recoveryCode), []byte(codeHash)) {
+			user.RecoveryCodes = append(user.RecoveryCodes[:i], user.RecoveryCodes[i+1:]...)
+			return "recovery code", putAdminUser(tx, user, "")
+		}
+	}
+	return "", nil
+}
+
+// loginChallengeSignature proves that the password was already checked when the second step of the login is submitted
+func loginChallengeSignature(username string, expires int64) string {
+	return fmt.Sprintf("%x", serverSignature("login challenge", fmt.Sprintf("%s\n%d", username, expires)))
+}
+
+func verifyLoginChallenge(username, expires, signature string) bool {
+	expiresInt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || expiresInt < getMillisecondsSinceUnixEpoch() {
+		return false
+	}
+	return hmac.Equal([]byte(loginChallengeSignature(username, expiresInt)), []byte(signature))
+}
+
+// requiresTOTPEnrolment is true when the role of the user requires two-factor authentication and they have not set it up yet
+func requiresTOTPEnrolment(user *AdminUser) bool {
+	return adminRequireTOTPRoles[user.Role] && user.TOTPSecret == ""
+}
+
+// handleAccountTOTP handles the two-factor authentication forms on the account page
+func handleAccountTOTP(request *http.Request, user *AdminUser, page *accountPage) error {
+	switch request.PostForm.Get("action") {
+	case "totp-start":
+		secret, err := newTOTPSecret()
+		if err != nil {
+			return err
+		}
+		user.PendingTOTPSecret = secret
+		return db.Update(func(tx *bolt.Tx) error {
+			return putAdminUser(tx, user, "")
+		})
+	case "totp-confirm":
+		if user.PendingTOTPSecret == "" {
+			page.Error = "start the setup again"
+			return nil
+		}
+		counter := verifyTOTP(user.PendingTOTPSecret, request.PostForm.Get("code"), 0)
+		if counter == 0 {
+			page.Error = "the code is wrong, check that the clock on your device is correct"
+			return nil
+		}
+		codes, hashes, err := newRecoveryCodes()
+		if err != nil {
+			return err
+		}
+		err = db.Update(func(tx *bolt.Tx) error {
+			user.TOTPSecret = user.PendingTOTPSecret
+			user.PendingTOTPSecret = ""
+			user.TOTPLastCounter = counter
+			user.RecoveryCodes = hashes
+			err := putAdminUser(tx, user, "")
+			if err != nil {
+				return err
+			}
+			auditEntry := newAuditEntry(request, auditActionTOTPEnable)
+			auditEntry.Target = user.Username
+			return recordAudit(tx, auditEntry)
+		})
+		if err == nil {
+			page.RecoveryCodes = codes
+			page.Message = "two-factor authentication is turned on"
+		}
+		return err
+	case "totp-disable":
+		if adminRequireTOTPRoles[user.Role] {
+			page.Error = fmt.Sprintf("two-factor authentication is required for %s users", user.Role)
+			return nil
+		}
+		current, err := checkAdminPassword(user.Username, request.PostForm.Get("password"))
+		if err != nil || current == nil {
+			page.Error = "the current password is wrong"
+			return err
+		}
+		err = db.Update(func(tx *bolt.Tx) error {
+			user.TOTPSecret = ""
+			user.TOTPLastCounter = 0
+			user.RecoveryCodes = nil
+			err := putAdminUser(tx, user, "")
+			if err != nil {
+				return err
+			}
+			auditEntry := newAuditEntry(request, auditActionTOTPDisable)
+			auditEntry.Target = user.Username
+			return recordAudit(tx, auditEntry)
+		})
+		if err == nil {
+			page.Message = "two-factor authentication is turned off"
+		}
+		return err
+	}
+	return fmt.Errorf("unknown account action '%s'", request.PostForm.Get("action"))
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/base32"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// the shared secret of the test vectors in RFC 4226 appendix D and RFC 6238 appendix B
+var rfcTOTPSecret = []byte("12345678901234567890")
+
+func TestTOTPCodeRFC4226(t *testing.T) {
+	expected := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for counter, code := range expected {
+		if got := totpCode(rfcTOTPSecret, int64(counter)); got != code {
+			t.Errorf("counter %d: expected %s, got %s", counter, code, got)
+		}
+	}
+}
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// RFC 6238 lists 8 digit SHA1 codes, a 6 digit code is the last 6 digits of the same value
+	expected := []struct {
+		unixTime int64
+		code     string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, vector := range expected {
+		code := vector.code[len(vector.code)-totpDigits:]
+		if got := totpCode(rfcTOTPSecret, vector.unixTime/totpPeriod); got != code {
+			t.Errorf("time %d: expected %s, got %s", vector.unixTime, code, got)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secretBase32 := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(rfcTOTPSecret)
+	now := time.Now().Unix() / totpPeriod
+
+	if counter := verifyTOTP(secretBase32, totpCode(rfcTOTPSecret, now), 0); counter != now {
+		t.Errorf("the current code should be accepted for step %d, got %d", now, counter)
+	}
+	if counter := verifyTOTP(secretBase32, totpCode(rfcTOTPSecret, now-1), 0); counter != now-1 {
+		t.Errorf("the code of the previous step should be accepted for step %d, got %d", now-1, counter)
+	}
+	if counter := verifyTOTP(secretBase32, totpCode(rfcTOTPSecret, now-2), 0); counter != 0 {
+		t.Errorf("a code which is two steps old should be rejected, got %d", counter)
+	}
+	if counter := verifyTOTP(secretBase32, totpCode(rfcTOTPSecret, now), now); counter != 0 {
+		t.Errorf("a code which was already used should be rejected, got %d", counter)
+	}
+	if counter := verifyTOTP("not base32!", totpCode(rfcTOTPSecret, now), 0); counter != 0 {
+		t.Errorf("a broken secret should never accept a code, got %d", counter)
+	}
+}
+
+func TestLoginChallenge(t *testing.T) {
+	serverSecret = []byte("test secret")
+	expires := getMillisecondsSinceUnixEpoch() + 60000
+	expiresString := fmt.Sprintf("%d", expires)
+	signature := loginChallengeSignature("admin", expires)
+
+	if !verifyLoginChallenge("admin", expiresString, signature) {
+		t.Error("the challenge should be valid")
+	}
+	if verifyLoginChallenge("someone-else", expiresString, signature) {
+		t.Error("the challenge of another user should be rejected")
+	}
+	if verifyLoginChallenge("admin", fmt.Sprintf("%d", expires+1), signature) {
+		t.Error("a challenge with a changed expiry should be rejected")
+	}
+
+	expired := getMillisecondsSinceUnixEpoch() - 1
+	if verifyLoginChallenge("admin", fmt.Sprintf("%d", expired), loginChallengeSignature("admin", expired)) {
+		t.Error("an expired challenge should be rejected")
+	}
+
+	serverSecret = []byte("another secret")
+	if verifyLoginChallenge("admin", expiresString, signature) {
+		t.Error("a challenge signed with another server secret should be rejected")
+	}
+}
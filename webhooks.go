@@ -0,0 +1,645 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+	"github.com/boltdb/bolt"
+)
+
+const webhookEventCommentCreated = "comment.created"
+const webhookEventCommentDeleted = "comment.deleted"
+const webhookEventCommentApproved = "comment.approved"
+const webhookEventCommentFlagged = "comment.flagged"
+
+var webhookEvents = []string{webhookEventCommentCreated, webhookEventCommentDeleted, webhookEventCommentApproved, webhookEventCommentFlagged}
+
+const auditActionWebhookAdd = "webhook.add"
+const auditActionWebhookRemove = "webhook.remove"
+
+// a failed delivery is retried after webhookFirstRetry, and the wait doubles with every further failure,
+// up to webhookRetryMax. after webhookMaxAttempts it is given up and stays in the delivery log as failed.
+const webhookMaxAttempts = 10
+const webhookFirstRetry = time.Minute
+const webhookRetryMax = time.Hour * 6
+
+// the delivery log only keeps the most recent deliveries
+const webhookLogSize = 500
+
+const webhookSignatureHeader = "X-Comments-Signature"
+
+// Webhook receives a signed JSON payload for each of its Events. the secret is only shown when the webhook is
+// created, the receiver uses it to check the HMAC-SHA256 signature in the X-Comments-Signature header.
+type Webhook struct {
+	ID      string   `json:"id"`
+	URL     string   `json:"url"`
+	Secret  string   `json:"secret"`
+	Events  []string `json:"events"`
+	Created int64    `json:"created"`
+}
+
+// WebhookDelivery is kept in the webhook_queue bucket until it was delivered or given up,
+// then it moves to the webhook_log bucket. both are keyed by ID, which sorts by date.
+type WebhookDelivery struct {
+	ID          string `json:"id"`
+	WebhookID   string `json:"webhookId"`
+	URL         string `json:"url"`
+	Event       string `json:"event"`
+	Payload     string `json:"payload"`
+	Created     int64  `json:"created"`
+	Attempts    int    `json:"attempts"`
+	NextAttempt int64  `json:"nextAttempt"`
+	LastAttempt int64  `json:"lastAttempt,omitempty"`
+	LastStatus  int    `json:"lastStatus,omitempty"`
+	LastError   string `json:"lastError,omitempty"`
+	Delivered   bool   `json:"delivered,omitempty"`
+}
+
+// webhookPayload is what the receiver gets. the private fields of the comment, like the email and IP address,
+// are left out.
+type webhookPayload struct {
+	ID      string         `json:"id"`
+	Event   string         `json:"event"`
+	Date    int64          `json:"date"`
+	Site    string         `json:"site,omitempty"`
+	Action  string         `json:"action,omitempty"`
+	Comment webhookComment `json:"comment"`
+	Flag    *webhookFlag   `json:"flag,omitempty"`
+}
+
+type webhookComment struct {
+	DocumentID    string  `json:"documentId"`
+	Date          int64   `json:"date"`
+	URL           string  `json:"url,omitempty"`
+	DocumentTitle string  `json:"documentTitle,omitempty"`
+	Username      string  `json:"username"`
+	AvatarHash    string  `json:"avatarHash,omitempty"`
+	Body          string  `json:"body"`
+	InReplyTo     string  `json:"inReplyTo,omitempty"`
+	Status        string  `json:"status,omitempty"`
+	SpamScore     float64 `json:"spamScore,omitempty"`
+	Flags         int     `json:"flags,omitempty"`
+	AdminAuthor   string  `json:"adminAuthor,omitempty"`
+}
+
+type webhookFlag struct {
+	Reason  string `json:"reason"`
+	Details string `json:"details,omitempty"`
+}
+
+// webhookWake is signalled whenever a delivery is queued, so it doesn't have to wait for the next poll
+var webhookWake = make(chan bool, 1)
+
+var errWebhookNotFound = errors.New("webhook not found")
+
+func getWebhooks(tx *bolt.Tx) ([]Webhook, error) {
+	webhooks := []Webhook{}
+	bucket := tx.Bucket([]byte("webhooks"))
+	if bucket == nil {
+		return webhooks, nil
+	}
+	err := bucket.ForEach(func(k, v []byte) error {
+		var webhook Webhook
+		err := json.Unmarshal(v, &webhook)
+		if err != nil {
+			return err
+		}
+		webhooks = append(webhooks, webhook)
+		return nil
+	})
+	return webhooks, err
+}
+
+func getWebhook(tx *bolt.Tx, id string) (*Webhook, error) {
+	bucket := tx.Bucket([]byte("webhooks"))
+	if bucket == nil {
+		return nil, errWebhookNotFound
+	}
+	webhookBytes := bucket.Get([]byte(id))
+	if webhookBytes == nil {
+		return nil, errWebhookNotFound
+	}
+	var webhook Webhook
+	err := json.Unmarshal(webhookBytes, &webhook)
+	return &webhook, err
+}
+
+func randomHex(length int) (string, error) {
+	randomBytes := make([]byte, length)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", randomBytes), nil
+}
+
+// validateWebhookURL only allows absolute http and https URLs
+func validateWebhookURL(webhookURL string) error {
+	parsed, err := url.Parse(webhookURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("'%s' is not a valid http or https URL", webhookURL)
+	}
+	return nil
+}
+
+func createWebhook(tx *bolt.Tx, webhookURL string, events []string) (*Webhook, error) {
+	bucket, err := tx.CreateBucketIfNotExists([]byte("webhooks"))
+	if err != nil {
+		return nil, err
+	}
+	id, err := randomHex(6)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+	webhook := &Webhook{
+		ID:      id,
+		URL:     webhookURL,
+		Secret:  secret,
+		Events:  events,
+		Created: getMillisecondsSinceUnixEpoch(),
+	}
+	webhookBytes, err := json.Marshal(webhook)
+	if err != nil {
+		return nil, err
+	}
+	return webhook, bucket.Put([]byte(id), webhookBytes)
+}
+
+// removeWebhook also drops the deliveries which are still queued for it. it returns nil if there was no such webhook.
+func removeWebhook(tx *bolt.Tx, id string) (*Webhook, error) {
+	webhook, err := getWebhook(tx, id)
+	if err == errWebhookNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Bucket([]byte("webhooks")).Delete([]byte(id))
+	if err != nil {
+		return nil, err
+	}
+	queue := tx.Bucket([]byte("webhook_queue"))
+	if queue == nil {
+		return webhook, nil
+	}
+	cursor := queue.Cursor()
+	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+		var delivery WebhookDelivery
+		err = json.Unmarshal(v, &delivery)
+		if err != nil {
+			return nil, err
+		}
+		if delivery.WebhookID == id {
+			err = cursor.Delete()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return webhook, nil
+}
+
+func (webhook *Webhook) subscribes(event string) bool {
+	for _, subscribed := range webhook.Events {
+		if subscribed == event {
+			return true
+		}
+	}
+	return false
+}
+
+// signWebhookPayload returns the value of the X-Comments-Signature header
+func signWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return fmt.Sprintf("sha256=%x", mac.Sum(nil))
+}
+
+// exponentialBackoff is first after the first attempt, and doubles with every further attempt up to max
+func exponentialBackoff(first, max time.Duration, attempts int) time.Duration {
+	backoff := first
+	for i := 1; i < attempts && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+func putWebhookDelivery(tx *bolt.Tx, bucketName string, delivery *WebhookDelivery) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+	if err != nil {
+		return err
+	}
+	deliveryBytes, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(delivery.ID), deliveryBytes)
+}
+
+// queueWebhookEvent queues a delivery for every webhook which subscribes to the event. it is called after the
+// transaction which changed the comment has been committed. action is the moderation action for comment.deleted,
+// and flag is only set for comment.flagged.
+func queueWebhookEvent(event string, comment *Comment, action string, flag *CommentFlag) {
+	now := getMillisecondsSinceUnixEpoch()
+	payload := webhookPayload{
+		Event:  event,
+		Date:   now,
+		Site:   siteForDocument(comment.DocumentID).Name,
+		Action: action,
+		Comment: webhookComment{
+			DocumentID:    comment.DocumentID,
+			Date:          comment.Date,
+			URL:           comment.URL,
+			DocumentTitle: comment.DocumentTitle,
+			Username:      comment.Username,
+			AvatarHash:    comment.AvatarHash,
+			Body:          comment.Body,
+			InReplyTo:     comment.InReplyTo,
+			Status:        comment.Status,
+			SpamScore:     comment.SpamScore,
+			Flags:         len(comment.Flags),
+			AdminAuthor:   comment.AdminAuthor,
+		},
+	}
+	if flag != nil {
+		payload.Flag = &webhookFlag{Reason: flag.Reason, Details: flag.Details}
+	}
+
+	queued := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		webhooks, err := getWebhooks(tx)
+		if err != nil {
+			return err
+		}
+		for _, webhook := range webhooks {
+			if !webhook.subscribes(event) {
+				continue
+			}
+			random, err := randomHex(4)
+			if err != nil {
+				return err
+			}
+			payload.ID = fmt.Sprintf("%015d-%s", now, random)
+			payloadBytes, err := json.Marshal(payload)
+			if err != nil {
+				return err
+			}
+			err = putWebhookDelivery(tx, "webhook_queue", &WebhookDelivery{
+				ID:          payload.ID,
+				WebhookID:   webhook.ID,
+				URL:         webhook.URL,
+				Event:       event,
+				Payload:     string(payloadBytes),
+				Created:     now,
+				NextAttempt: now,
+			})
+			if err != nil {
+				return err
+			}
+			queued++
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to queue webhook %s for comment %s_%d: %v\n", event, comment.DocumentID, comment.Date, err)
+		return
+	}
+	if queued > 0 {
+		wakeWebhookWorker()
+	}
+}
+
+func wakeWebhookWorker() {
+	select {
+	case webhookWake <- true:
+	default:
+	}
+}
+
+// deliverWebhooksForever runs in its own goroutine. deliveries which were still queued when the server stopped
+// are picked up again when it starts.
+func deliverWebhooksForever() {
+	for {
+		wait := deliverDueWebhooks()
+		select {
+		case <-webhookWake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// deliverDueWebhooks attempts every delivery which is due and returns how long to wait until the next one is due
+func deliverDueWebhooks() time.Duration {
+	// since this will be called in a goroutine, we need to do this in case we hit a panic()
+	defer (func() {
+		if r := recover(); r != nil {
+			fmt.Printf("deliverDueWebhooks(): panic: %v\n", r)
+			debug.PrintStack()
+		}
+	})()
+
+	wait := time.Minute
+	now := getMillisecondsSinceUnixEpoch()
+	due := []WebhookDelivery{}
+	err := db.View(func(tx *bolt.Tx) error {
+		queue := tx.Bucket([]byte("webhook_queue"))
+		if queue == nil {
+			return nil
+		}
+		return queue.ForEach(func(k, v []byte) error {
+			var delivery WebhookDelivery
+			err := json.Unmarshal(v, &delivery)
+			if err != nil {
+				return err
+			}
+			if delivery.NextAttempt <= now {
+				due = append(due, delivery)
+			} else if untilDue := time.Duration(delivery.NextAttempt-now) * time.Millisecond; untilDue < wait {
+				wait = untilDue
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("failed to read the webhook queue: %v\n", err)
+		return wait
+	}
+
+	for _, delivery := range due {
+		attemptWebhookDelivery(&delivery)
+	}
+	return wait
+}
+
+// attemptWebhookDelivery posts the payload once and records the result
+func attemptWebhookDelivery(delivery *WebhookDelivery) {
+	var webhook *Webhook
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		webhook, err = getWebhook(tx, delivery.WebhookID)
+		return err
+	})
+	if err == errWebhookNotFound {
+		// the webhook was removed, but a delivery from the log was retried
+		err = db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("webhook_queue")).Delete([]byte(delivery.ID))
+		})
+		if err != nil {
+			log.Printf("failed to drop webhook delivery %s: %v\n", delivery.ID, err)
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("failed to read webhook %s: %v\n", delivery.WebhookID, err)
+		return
+	}
+
+	delivery.Attempts++
+	delivery.LastAttempt = getMillisecondsSinceUnixEpoch()
+	delivery.LastStatus, err = postWebhook(webhook, delivery)
+	delivery.LastError = ""
+	if err != nil {
+		delivery.LastError = err.Error()
+	}
+	delivery.Delivered = err == nil
+
+	retry := !delivery.Delivered && delivery.Attempts < webhookMaxAttempts
+	if retry {
+		backoff := exponentialBackoff(webhookFirstRetry, webhookRetryMax, delivery.Attempts)
+		delivery.NextAttempt = delivery.LastAttempt + int64(backoff/time.Millisecond)
+		log.Printf("webhook %s delivery %s failed (attempt %d), retrying in %s: %v\n", webhook.ID, delivery.ID, delivery.Attempts, backoff, err)
+	} else if !delivery.Delivered {
+		log.Printf("webhook %s delivery %s failed %d times, giving up: %v\n", webhook.ID, delivery.ID, delivery.Attempts, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if retry {
+			return putWebhookDelivery(tx, "webhook_queue", delivery)
+		}
+		err := tx.Bucket([]byte("webhook_queue")).Delete([]byte(delivery.ID))
+		if err != nil {
+			return err
+		}
+		delivery.NextAttempt = 0
+		err = putWebhookDelivery(tx, "webhook_log", delivery)
+		if err != nil {
+			return err
+		}
+		logBucket := tx.Bucket([]byte("webhook_log"))
+		excess := -webhookLogSize
+		logBucket.ForEach(func(k, v []byte) error {
+			excess++
+			return nil
+		})
+		cursor := logBucket.Cursor()
+		for k, _ := cursor.First(); k != nil && excess > 0; k, _ = cursor.First() {
+			err = cursor.Delete()
+			if err != nil {
+				return err
+			}
+			excess--
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to record webhook delivery %s: %v\n", delivery.ID, err)
+	}
+}
+
+// postWebhook returns the http status code, and an error unless the receiver answered with a 2xx status
+func postWebhook(webhook *Webhook, delivery *WebhookDelivery) (int, error) {
+	payload := []byte(delivery.Payload)
+	webhookRequest, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	webhookRequest.Header.Set("Content-Type", "application/json")
+	webhookRequest.Header.Set("User-Agent", "SequentialRead Comments")
+	webhookRequest.Header.Set("X-Comments-Event", delivery.Event)
+	webhookRequest.Header.Set("X-Comments-Delivery", delivery.ID)
+	webhookRequest.Header.Set(webhookSignatureHeader, signWebhookPayload(webhook.Secret, payload))
+
+	response, err := httpClient.Do(webhookRequest)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	responseBytes, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		responseString := string(responseBytes)
+		if len(responseString) > 200 {
+			responseString = responseString[:200]
+		}
+		return response.StatusCode, fmt.Errorf("http %d: %s", response.StatusCode, responseString)
+	}
+	return response.StatusCode, nil
+}
+
+// getWebhookDeliveries returns the deliveries in the given bucket, newest first
+func getWebhookDeliveries(tx *bolt.Tx, bucketName string) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	bucket := tx.Bucket([]byte(bucketName))
+	if bucket == nil {
+		return deliveries, nil
+	}
+	cursor := bucket.Cursor()
+	for k, v := cursor.Last(); k != nil; k, v = cursor.Prev() {
+		var delivery WebhookDelivery
+		err := json.Unmarshal(v, &delivery)
+		if err != nil {
+			return deliveries, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+// retryWebhookDelivery makes a queued delivery due now, or queues a delivery from the log again
+// with the same payload, so the receiver can recognize it by its id.
+func retryWebhookDelivery(tx *bolt.Tx, id string) error {
+	for _, bucketName := range []string{"webhook_queue", "webhook_log"} {
+		bucket := tx.Bucket([]byte(bucketName))
+		if bucket == nil {
+			continue
+		}
+		deliveryBytes := bucket.Get([]byte(id))
+		if deliveryBytes == nil {
+			continue
+		}
+		var delivery WebhookDelivery
+		err := json.Unmarshal(deliveryBytes, &delivery)
+		if err != nil {
+			return err
+		}
+		if bucketName == "webhook_log" {
+			err = bucket.Delete([]byte(id))
+			if err != nil {
+				return err
+			}
+			delivery.Attempts = 0
+		}
+		delivery.NextAttempt = getMillisecondsSinceUnixEpoch()
+		return putWebhookDelivery(tx, "webhook_queue", &delivery)
+	}
+	return nil
+}
+
+func adminWebhooks(responseWriter http.ResponseWriter, request *http.Request) {
+	templateData := struct {
+		Webhooks   []Webhook
+		Events     []string
+		NewWebhook *Webhook
+		Queue      []WebhookDelivery
+		Log        []WebhookDelivery
+		Error      string
+	}{
+		Events: webhookEvents,
+	}
+
+	var err error
+	if request.Method == "POST" {
+		err = request.ParseForm()
+		action := request.Form.Get("action")
+		if err == nil && action == "remove" {
+			id := request.Form.Get("id")
+			err = db.Update(func(tx *bolt.Tx) error {
+				removed, err := removeWebhook(tx, id)
+				if err != nil || removed == nil {
+					return err
+				}
+				// the secret doesn't belong in the audit log
+				removed.Secret = ""
+				auditEntry := newAuditEntry(request, auditActionWebhookRemove).withBefore(removed)
+				auditEntry.Target = id
+				return recordAudit(tx, auditEntry)
+			})
+			if err == nil {
+				log.Printf("admin: removed webhook %s\n", id)
+			}
+		} else if err == nil && action == "retry" {
+			id := request.Form.Get("id")
+			err = db.Update(func(tx *bolt.Tx) error {
+				return retryWebhookDelivery(tx, id)
+			})
+			if err == nil {
+				log.Printf("admin: retrying webhook delivery %s\n", id)
+				wakeWebhookWorker()
+			}
+		} else if err == nil {
+			webhookURL := strings.TrimSpace(request.Form.Get("url"))
+			events := []string{}
+			for _, event := range webhookEvents {
+				if request.Form.Get(event) != "" {
+					events = append(events, event)
+				}
+			}
+			if urlError := validateWebhookURL(webhookURL); urlError != nil {
+				templateData.Error = urlError.Error()
+			} else if len(events) == 0 {
+				templateData.Error = "choose at least one event"
+			} else {
+				err = db.Update(func(tx *bolt.Tx) error {
+					webhook, err := createWebhook(tx, webhookURL, events)
+					if err != nil {
+						return err
+					}
+					templateData.NewWebhook = webhook
+					auditEntry := newAuditEntry(request, auditActionWebhookAdd)
+					auditEntry.Target = webhook.ID
+					auditEntry.Details = fmt.Sprintf("%s (%s)", webhookURL, strings.Join(events, ", "))
+					return recordAudit(tx, auditEntry)
+				})
+				if err == nil {
+					log.Printf("admin: added webhook %s for %s\n", templateData.NewWebhook.ID, webhookURL)
+				}
+			}
+		}
+	}
+
+	if err == nil {
+		err = db.View(func(tx *bolt.Tx) error {
+			templateData.Webhooks, err = getWebhooks(tx)
+			if err != nil {
+				return err
+			}
+			templateData.Queue, err = getWebhookDeliveries(tx, "webhook_queue")
+			if err != nil {
+				return err
+			}
+			templateData.Log, err = getWebhookDeliveries(tx, "webhook_log")
+			return err
+		})
+	}
+	if err != nil {
+		log.Printf("admin webhooks page failed: %v\n", err)
+		responseWriter.WriteHeader(500)
+		responseWriter.Write([]byte("500 internal server error"))
+		return
+	}
+
+	sort.Slice(templateData.Webhooks, func(i, j int) bool {
+		return templateData.Webhooks[i].Created < templateData.Webhooks[j].Created
+	})
+
+	renderAdminTemplate(responseWriter, request, "admin-webhooks.html.gotemplate", templateData)
+}
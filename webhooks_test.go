@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignWebhookPayload(t *testing.T) {
+	signature := signWebhookPayload("key", []byte("The quick brown fox jumps over the lazy dog"))
+	expected := "sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"
+	if signature != expected {
+		t.Errorf("expected %s, got %s", expected, signature)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		backoff  time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{9, 256 * time.Minute},
+		{10, 6 * time.Hour},
+		{1000, 6 * time.Hour},
+	}
+	for _, test := range tests {
+		if got := exponentialBackoff(webhookFirstRetry, webhookRetryMax, test.attempts); got != test.backoff {
+			t.Errorf("after %d attempts: expected a backoff of %s, got %s", test.attempts, test.backoff, got)
+		}
+	}
+}